@@ -0,0 +1,3183 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/vinibalbino/trabalho-p2p-ppd/p2p"
+)
+
+const (
+	clientPort  = ":8081"
+	supernoPort = ":8082"
+	relayPort   = ":8087" // Retransmissão de transferências no super nó
+)
+
+// A conexão direta com o detentor falhou; o super nó pode intermediá-la
+var errPeerUnreachable = errors.New("cliente inalcançável")
+
+// O super nó não encontrou o arquivo pedido em nenhum super nó
+var errFileNotFound = errors.New("Arquivo não encontrado em nenhum super nó")
+
+// O arquivo no disco não tem mais o conteúdo publicado
+var errContentChanged = errors.New("arquivo alterado desde a publicação")
+
+// A retransmissão do super nó está sem vagas ou fora do ar; não é falha do detentor
+var errRelayUnavailable = errors.New("retransmissão do super nó indisponível")
+
+// Arquivo local publicado no super nó
+type sharedFile struct {
+	Path        string
+	Name        string
+	Hash        string // Hash anunciado ao super nó; do texto cifrado quando Key != nil
+	Size        int64  // Tamanho anunciado ao super nó
+	ContentHash string // Hash do conteúdo em claro no disco
+	PlainSize   int64
+	ModTime     time.Time
+	Visibility  string              // "public", "group:<grupo>" ou "private"
+	Key         []byte              // Chave AES-256 do arquivo; nil quando o conteúdo trafega em claro
+	KeyOwner    bool                // Este cliente cifrou o arquivo e entrega a chave a quem tiver permissão
+	ChunkHashes [][sha256.Size]byte // SHA-256 de cada bloco em claro, conferido antes de cifrá-lo no envio
+}
+
+// O conteúdo cifrado é dividido em blocos de 64 KiB, cada um selado com AES-GCM
+const encryptedChunkSize = 64 * 1024
+
+// Códigos de erro devolvidos pelo servidor de arquivos do cliente ("ERROR <código> <mensagem>")
+const (
+	errBadRequest  = 400
+	errForbidden   = 403
+	errNotFound    = 404
+	errConflict    = 409
+	errInternal    = 500
+	errUnavailable = 503
+)
+
+// Erro recebido de outro cliente ao pedir um arquivo
+type peerError struct {
+	Code    int
+	Message string
+}
+
+func (e *peerError) Error() string {
+	return fmt.Sprintf("Cliente respondeu com erro %d: %s", e.Code, e.Message)
+}
+
+var (
+	shareRoot     = "."             // Apenas arquivos dentro deste diretório podem ser compartilhados
+	shareDir      = ""              // Diretório compartilhado ao iniciar (opção -share-dir)
+	userName      = ""              // Usuário autenticado no super nó (opção -user)
+	userToken     = ""              // Token do usuário (opção -token ou variável P2P_TOKEN)
+	visibility    = "public"        // Visibilidade padrão dos arquivos publicados
+	encrypt       = false           // Cifra o conteúdo dos arquivos do diretório compartilhado
+	watchInterval = 2 * time.Second // Intervalo entre as varreduras do diretório compartilhado
+
+	sharesMu    sync.Mutex
+	sharedFiles = make(map[string]*sharedFile) // caminho absoluto -> arquivo publicado
+
+	activeSession *superNodeSession // Sessão com o super nó, usada para consultar grupos ao entregar chaves
+
+	// Limites de banda em KiB/s (0 = sem limite) e vagas de envio
+	uploadLimit       = 0
+	downloadLimit     = 0
+	peerUploadLimit   = 0
+	peerDownloadLimit = 0
+	maxUploadSlots    = 4  // Envios simultâneos; os demais pedidos esperam na fila
+	maxUploadQueue    = 32 // Pedidos em espera além dos quais o pedido é recusado
+
+	uploadLimiter   *p2p.RateLimiter // Limite global de envio
+	downloadLimiter *p2p.RateLimiter // Limite global de recebimento
+	peerLimitersMu  sync.Mutex
+	peerUploads     = make(map[string]*p2p.RateLimiter) // IP -> limite de envio para o cliente
+	peerDownloads   = make(map[string]*p2p.RateLimiter) // IP -> limite de recebimento do cliente
+	uploads         = &uploadSlots{}
+
+	superNodeHost = "172.26.1.249" // IP do super nó (modifique para o IP correto); muda com RECONNECT
+	hostMu        sync.Mutex
+	restoring     int32 // 1 enquanto a sessão principal está sendo restabelecida
+
+	keepaliveInterval = 15 * time.Second // Intervalo entre os PINGs ao super nó
+	sessionTimeout    = 45 * time.Second // Sem resposta do super nó por este tempo, a conexão é dada como morta
+	goneMu            sync.Mutex
+	goneHolders       = make(map[string]time.Time) // "<hash> <ip>" -> quando o super nó avisou que o detentor saiu
+
+	sessionToken = "" // Token para retomar a sessão no super nó (RESUME) depois de uma queda
+
+	subscriptionsMu sync.Mutex
+	subscriptions   []*clientSubscription // Refeitas a cada reconexão com o super nó
+	reverseMu       sync.Mutex
+	reverseWaits    = make(map[string]chan *pushedConn) // token -> download aguardando a conexão reversa
+
+	ratiosMu sync.Mutex
+	ratios   = make(map[string]cachedRatio) // IP -> razão envio/recebimento informada pelo super nó
+
+	// Linha de comando: subcomandos e daemon
+	jsonOutput   = false                 // Resultado dos subcomandos em JSON
+	daemonSocket = defaultDaemonSocket() // Socket local do daemon (serve)
+	peersMu      sync.Mutex
+	peers        = make(map[string]*peerInfo) // IP -> transferências com o cliente, listadas por peers
+
+	// Interface de terminal (-tui)
+	tuiMode      = false
+	transferKeep = 30 * time.Second // Tempo em que uma transferência encerrada continua na tela
+	transfersMu  sync.Mutex
+	transfers    []*transfer
+	tuiMu        sync.Mutex
+	tuiMessages  []string       // Saída do programa, exibida no painel de mensagens
+	tuiResults   []searchResult // Resultados da última busca
+	tuiQuery     string
+
+	metricsAddr = "" // Endereço do servidor de métricas (opção -metrics); vazio desativa
+
+	logLevel  = "info" // debug, info, warn ou error
+	logFormat = "text" // text ou json
+)
+
+// Verifica se a chave é um hash de conteúdo (SHA-256 em hexadecimal)
+func isContentHash(key string) bool {
+	if len(key) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(key)
+	return err == nil
+}
+
+// Procura um arquivo publicado pelo hash do conteúdo
+func findShare(hash string) *sharedFile {
+	sharesMu.Lock()
+	defer sharesMu.Unlock()
+	for _, share := range sharedFiles {
+		if share.Hash == hash {
+			return share
+		}
+	}
+	return nil
+}
+
+// Função para servir arquivos que o cliente possui para outros clientes
+func handleClientRequest(conn net.Conn) {
+	peerIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	servePeer(conn, peerIP)
+}
+
+// Atende um pedido de outro cliente. peerIP é o IP de quem pede, que numa
+// retransmissão difere do endereço da conexão (o do super nó).
+func servePeer(conn net.Conn, peerIP string) {
+	defer conn.Close()
+
+	if !p2p.PeerHasRole(conn, p2p.RoleClient, p2p.RoleNode) {
+		return
+	}
+
+	// Lê o comando do cliente solicitante
+	reader := bufio.NewReader(conn)
+	request, err := reader.ReadString('\n')
+	if err != nil {
+		slog.Error("Erro ao ler pedido de outro cliente", "peer", conn.RemoteAddr().String(), "error", err)
+		return
+	}
+	parts := strings.Split(strings.TrimSpace(request), " ")
+	switch {
+	case (len(parts) == 2 || len(parts) == 3) && parts[0] == "DOWNLOAD":
+		// DOWNLOAD <hash ou nome> [traceparent]
+		serveFile(conn, peerIP, parts[1], p2p.RequestContext(parts, 2))
+	case len(parts) == 3 && parts[0] == "KEY":
+		// KEY <hash> <chave pública>
+		handleKeyRequest(conn, parts[1], parts[2])
+	case len(parts) == 3 && parts[0] == "PUSH":
+		// PUSH <token> <hash>: detentor atrás de NAT conectando-se para enviar um arquivo pedido
+		acceptPush(conn, reader, parts[1])
+	case len(parts) == 1 && parts[0] == "PING":
+		// Sondagem do super nó para saber se a porta é alcançável
+		fmt.Fprintf(conn, "PONG\n")
+	case len(parts) == 2 && parts[0] == "HAS":
+		// HAS <hash>,<hash>...: sondagem do super nó para saber se os arquivos
+		// ainda estão aqui. Outros clientes não descobrem assim o que é compartilhado
+		if !fromSuperNode(conn, peerIP) {
+			sendPeerError(conn, errForbidden, "HAS só é aceito do super nó")
+			return
+		}
+		answerHas(conn, strings.Split(parts[1], ","))
+	default:
+		sendPeerError(conn, errBadRequest, "Comando inválido")
+	}
+}
+
+// Com TLS, o certificado diz se quem conecta é um super nó; sem TLS, só o
+// super nó a que o cliente está ligado é aceito
+func fromSuperNode(conn net.Conn, peerIP string) bool {
+	if p2p.TLSConfig != nil {
+		role, ok := p2p.PeerRole(conn)
+		return ok && role == p2p.RoleNode
+	}
+	return peerIP == currentSuperNodeHost()
+}
+
+// Responde "HAVE <bits>" com 1 para cada hash ainda publicado e presente no
+// disco com o conteúdo publicado, e 0 para os demais
+func answerHas(conn net.Conn, hashes []string) {
+	bits := make([]byte, len(hashes))
+	for i, hash := range hashes {
+		bits[i] = '0'
+		share := findShare(hash)
+		if share == nil {
+			continue
+		}
+		if info, err := os.Stat(share.Path); err == nil && info.Mode().IsRegular() && shareUnchanged(share, info) {
+			bits[i] = '1'
+		}
+	}
+	fmt.Fprintf(conn, "HAVE %s\n", bits)
+}
+
+// Confere se o arquivo no disco ainda tem o conteúdo publicado. Com a data
+// de modificação igual à da publicação basta o tamanho; com ela diferente o
+// conteúdo é lido de novo. Servir outro conteúdo com a mesma chave repetiria
+// os nonces dos blocos cifrados, por isso um arquivo alterado não é servido.
+func shareUnchanged(share *sharedFile, info os.FileInfo) bool {
+	if info.Size() != share.PlainSize {
+		return false
+	}
+	if info.ModTime().Equal(share.ModTime) {
+		return true
+	}
+	hash, _, err := hashFile(share.Path)
+	if err != nil || hash != share.ContentHash {
+		return false
+	}
+	// Só a data mudou: guarda a nova para não ler o arquivo de novo
+	updated := *share
+	updated.ModTime = info.ModTime()
+	sharesMu.Lock()
+	if sharedFiles[share.Path] == share {
+		sharedFiles[share.Path] = &updated
+	}
+	sharesMu.Unlock()
+	return true
+}
+
+// Envia um arquivo da tabela de compartilhamento a outro cliente
+func serveFile(conn net.Conn, peerIP string, key string, parent p2p.SpanContext) {
+	sp := p2p.StartSpan("serve", p2p.SpanServer, parent)
+	sp.Set("peer", peerIP)
+	var failure error
+	defer func() { sp.End(failure) }()
+
+	fileName, err := url.QueryUnescape(key)
+	if err != nil {
+		failure = err
+		sendPeerError(conn, errBadRequest, "Nome de arquivo mal codificado")
+		return
+	}
+	sp.Set("file", fileName)
+
+	// Pedidos com caminho absoluto ou com ".." são recusados antes de qualquer busca
+	if filepath.IsAbs(fileName) || hasDotDot(fileName) {
+		slog.Warn("Pedido recusado: caminho fora da raiz compartilhada", "peer", conn.RemoteAddr().String(), "path", fileName)
+		failure = errors.New("caminho fora da raiz compartilhada")
+		sendPeerError(conn, errForbidden, "Caminho '%s' não permitido", fileName)
+		return
+	}
+
+	// Só são servidos arquivos da tabela de compartilhamento, pelo hash ou pelo nome publicado
+	var share *sharedFile
+	if isContentHash(fileName) {
+		share = findShare(fileName)
+	} else {
+		share = findShareByName(fileName)
+	}
+	if share == nil {
+		failure = errors.New("arquivo não compartilhado")
+		sendPeerError(conn, errNotFound, "Arquivo '%s' não encontrado", fileName)
+		return
+	}
+
+	// Conhecer o hash não basta: arquivos privados ou de grupo só vão para
+	// quem o certificado identifica como dono ou membro do grupo
+	if requester := p2p.PeerUser(conn); !shareAllowed(share, requester) {
+		slog.Warn("Pedido recusado: sem permissão para o arquivo", "peer", peerIP, "file", share.Name, "user", requester)
+		failure = errors.New("sem permissão para o arquivo")
+		sendPeerError(conn, errForbidden, "Sem permissão para o arquivo '%s'", fileName)
+		return
+	}
+
+	// O caminho é resolvido de novo a cada pedido: um link simbólico trocado
+	// depois da publicação não pode apontar para fora da raiz
+	realPath, err := resolveSharePath(share.Path)
+	if err != nil {
+		slog.Warn("Pedido recusado", "peer", conn.RemoteAddr().String(), "error", err)
+		failure = err
+		sendPeerError(conn, errForbidden, "Arquivo '%s' não permitido", fileName)
+		return
+	}
+
+	// Espera uma vaga de envio; enquanto isso o solicitante recebe "QUEUED <posição>"
+	queued := time.Now()
+	if !uploads.acquire(conn, peerIP) {
+		failure = errors.New("fila de envio cheia")
+		return
+	}
+	defer uploads.release()
+	sp.Set("queue_ms", time.Since(queued).Milliseconds())
+
+	// Abre o arquivo solicitado
+	file, err := os.Open(realPath)
+	if err != nil {
+		failure = err
+		sendPeerError(conn, errNotFound, "Arquivo '%s' não encontrado", fileName)
+		return
+	}
+	defer file.Close()
+
+	// Obtém o tamanho do arquivo e confere se ele continua igual ao publicado
+	fileInfo, err := file.Stat()
+	if err != nil {
+		failure = err
+		sendPeerError(conn, errInternal, "Erro ao obter informações do arquivo")
+		return
+	}
+	if !shareUnchanged(share, fileInfo) {
+		slog.Warn("Pedido recusado: arquivo alterado desde a publicação", "peer", peerIP, "file", share.Name)
+		failure = errContentChanged
+		sendPeerError(conn, errConflict, "Arquivo '%s' foi alterado desde que foi publicado", fileName)
+		return
+	}
+	sp.Set("hash", share.Hash)
+
+	// Envia o tamanho anunciado ao super nó (o do texto cifrado, se for o caso)
+	fmt.Fprintf(conn, "%d\n", share.Size)
+
+	// Envia o conteúdo do arquivo, cifrando-o durante o envio quando necessário
+	sent := &countingWriter{}
+	progress := startTransfer("up", fileName, peerIP, share.Size)
+	writer := p2p.ThrottledWriter(io.MultiWriter(conn, sent, progress), uploadLimiter, peerLimiter(peerUploads, peerIP, peerUploadLimit))
+	if share.Key != nil {
+		err = encryptStream(writer, file, share.Key, share.checkChunk)
+	} else {
+		_, err = io.Copy(writer, file)
+	}
+	progress.finish(err)
+	sp.Set("bytes", sent.n)
+	if errors.Is(err, errContentChanged) {
+		slog.Warn("Envio interrompido: arquivo alterado durante o envio", "peer", peerIP, "file", share.Name, "bytes", sent.n)
+		failure = err
+		return
+	}
+	if err != nil {
+		slog.Error("Erro ao enviar arquivo", "peer", peerIP, "file", fileName, "error", err)
+		failure = err
+		return
+	}
+
+	slog.Info("Arquivo enviado", "peer", peerIP, "file", fileName, "bytes", sent.n)
+	reportTransfer("SENT", share.Hash, sent.n, peerIP)
+}
+
+// Informa ao super nó uma transferência concluída, para a contabilidade de envios e recebimentos
+func reportTransfer(kind string, hash string, bytes int64, peerIP string) {
+	if bytes <= 0 {
+		return
+	}
+	peersMu.Lock()
+	peer := peers[peerIP]
+	if peer == nil {
+		peer = &peerInfo{IP: peerIP}
+		peers[peerIP] = peer
+	}
+	if kind == "SENT" {
+		peer.Sent += bytes
+	} else {
+		peer.Received += bytes
+	}
+	peer.LastTransfer = time.Now()
+	peersMu.Unlock()
+
+	if activeSession == nil {
+		return
+	}
+	response, err := activeSession.request("REPORT %s %s %d %s", kind, hash, bytes, peerIP)
+	if err == nil && !strings.HasPrefix(response, "OK") {
+		err = errors.New(response)
+	}
+	if err != nil {
+		slog.Error("Erro ao informar a transferência ao super nó", "hash", hash, "error", err)
+	}
+}
+
+// Informa ao super nó que o download a partir de um detentor falhou, para
+// que ele o sonde e deixe de indicá-lo se o arquivo não estiver mais lá
+func reportFailure(session *superNodeSession, hash string, holderIP string) {
+	response, err := session.request("FAILED %s %s", hash, holderIP)
+	if err == nil && !strings.HasPrefix(response, "OK") {
+		err = errors.New(response)
+	}
+	if err != nil {
+		slog.Error("Erro ao informar a falha ao super nó", "hash", hash, "holder", holderIP, "error", err)
+	}
+}
+
+// Razão consultada no super nó, guardada por um minuto
+type cachedRatio struct {
+	Ratio float64
+	At    time.Time
+}
+
+// Razão envio/recebimento de outro cliente; 1 quando o super nó não informa
+func peerRatio(ip string) float64 {
+	ratiosMu.Lock()
+	cached, ok := ratios[ip]
+	ratiosMu.Unlock()
+	if ok && time.Since(cached.At) < time.Minute {
+		return cached.Ratio
+	}
+
+	ratio := 1.0
+	if activeSession != nil {
+		response, err := activeSession.request("RATIO %s", ip)
+		if err == nil && strings.HasPrefix(response, "OK ") {
+			if value, err := strconv.ParseFloat(strings.TrimPrefix(response, "OK "), 64); err == nil {
+				ratio = value
+			}
+		}
+	}
+	ratiosMu.Lock()
+	ratios[ip] = cachedRatio{Ratio: ratio, At: time.Now()}
+	ratiosMu.Unlock()
+	return ratio
+}
+
+// Entrega a chave de um arquivo cifrado por este cliente. A chave vai selada com
+// um segredo X25519 efêmero, de modo que só quem pediu consegue abri-la.
+func handleKeyRequest(conn net.Conn, hash string, publicKey string) {
+	share := findShare(hash)
+	if share == nil || !share.KeyOwner {
+		sendPeerError(conn, errNotFound, "Chave do arquivo '%s' não encontrada", hash)
+		return
+	}
+	requester := p2p.PeerUser(conn)
+	if !shareAllowed(share, requester) {
+		slog.Warn("Chave negada", "file", share.Name, "peer", conn.RemoteAddr().String(), "user", requester)
+		sendPeerError(conn, errForbidden, "Sem permissão para o arquivo '%s'", share.Name)
+		return
+	}
+	rawKey, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		sendPeerError(conn, errBadRequest, "Chave pública inválida")
+		return
+	}
+	peerKey, err := ecdh.X25519().NewPublicKey(rawKey)
+	if err != nil {
+		sendPeerError(conn, errBadRequest, "Chave pública inválida")
+		return
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		sendPeerError(conn, errInternal, "Erro ao gerar chave efêmera")
+		return
+	}
+	secret, err := ephemeral.ECDH(peerKey)
+	if err != nil {
+		sendPeerError(conn, errBadRequest, "Chave pública inválida")
+		return
+	}
+	wrapped, err := wrapKey(secret, hash, share.Key)
+	if err != nil {
+		sendPeerError(conn, errInternal, "Erro ao selar a chave")
+		return
+	}
+	fmt.Fprintf(conn, "KEY %s %s\n", base64.StdEncoding.EncodeToString(ephemeral.PublicKey().Bytes()),
+		base64.StdEncoding.EncodeToString(wrapped))
+	slog.Info("Chave entregue", "file", share.Name, "peer", conn.RemoteAddr().String())
+}
+
+// Aplica a visibilidade do arquivo ao usuário identificado pelo certificado.
+// Sem TLS, ou no modo de teste, não há identidade, e só arquivos públicos (e
+// as suas chaves) são entregues.
+func shareAllowed(share *sharedFile, requester string) bool {
+	if share.Visibility == "public" {
+		return true
+	}
+	if requester == "" {
+		return false
+	}
+	if requester == userName {
+		return true
+	}
+	group := strings.TrimPrefix(share.Visibility, "group:")
+	if group == share.Visibility || activeSession == nil {
+		return false
+	}
+	response, err := activeSession.request("GROUPS %s", requester)
+	if err != nil || !strings.HasPrefix(response, "OK ") {
+		return false
+	}
+	for _, g := range strings.Split(strings.TrimPrefix(response, "OK "), ",") {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// Cifra que sela a chave do arquivo com o segredo X25519, amarrada ao hash do arquivo
+func keyWrapCipher(secret []byte, hash string) (cipher.AEAD, error) {
+	wrapKey := sha256.Sum256(append(append([]byte{}, secret...), hash...))
+	block, err := aes.NewCipher(wrapKey[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Sela a chave do arquivo; o nonce aleatório vai no início do resultado
+func wrapKey(secret []byte, hash string, key []byte) ([]byte, error) {
+	aead, err := keyWrapCipher(secret, hash)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, key, nil), nil
+}
+
+func unwrapKey(secret []byte, hash string, wrapped []byte) ([]byte, error) {
+	aead, err := keyWrapCipher(secret, hash)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errors.New("chave selada truncada")
+	}
+	return aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], nil)
+}
+
+// Tamanho do texto cifrado: cada bloco ganha a etiqueta do GCM e um arquivo vazio vira um bloco vazio
+func encryptedSize(plainSize int64) int64 {
+	chunks := (plainSize + encryptedChunkSize - 1) / encryptedChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return plainSize + chunks*16
+}
+
+// O nonce de cada bloco é o seu índice, e o último bloco é marcado nos dados
+// autenticados; assim blocos não podem ser reordenados nem o arquivo truncado.
+// Com a mesma chave o texto cifrado é sempre o mesmo, e quem baixou pode
+// servir o arquivo com o mesmo hash do dono. Por isso uma chave nunca cifra
+// dois conteúdos: arquivos alterados não são servidos (shareUnchanged) e a
+// versão nova ganha outra chave ao ser publicada. Cada bloco ainda é
+// conferido com o publicado antes de ser cifrado no envio (checkChunk), pois o
+// arquivo pode mudar durante o envio sem mudar o tamanho nem a data.
+func chunkNonce(index uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, index)
+	return nonce
+}
+
+// Guarda o hash de cada bloco em claro em *hashes
+func recordChunks(hashes *[][sha256.Size]byte) chunkCheck {
+	return func(index uint64, plain []byte, final bool) error {
+		*hashes = append(*hashes, sha256.Sum256(plain))
+		return nil
+	}
+}
+
+// Confere cada bloco com o publicado antes de cifrá-lo. A data de
+// modificação não basta para saber se o arquivo mudou, e um bloco diferente
+// (ou o último bloco em outra posição) cifrado com a mesma chave e o mesmo
+// nonce exporia a chave do GCM; o envio é interrompido antes desse bloco.
+func (share *sharedFile) checkChunk(index uint64, plain []byte, final bool) error {
+	if index >= uint64(len(share.ChunkHashes)) || final != (index == uint64(len(share.ChunkHashes)-1)) ||
+		sha256.Sum256(plain) != share.ChunkHashes[index] {
+		return errContentChanged
+	}
+	return nil
+}
+
+func newContentCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Chamada com cada bloco em claro, antes de cifrá-lo ou depois de decifrá-lo;
+// um erro interrompe o fluxo antes que o bloco seja escrito
+type chunkCheck func(index uint64, plain []byte, final bool) error
+
+// Cifra src em blocos e escreve o resultado em dst; check pode ser nil
+func encryptStream(dst io.Writer, src io.Reader, key []byte, check chunkCheck) error {
+	aead, err := newContentCipher(key)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReaderSize(src, encryptedChunkSize)
+	chunk := make([]byte, encryptedChunkSize)
+	for index := uint64(0); ; index++ {
+		n, err := io.ReadFull(reader, chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		// O bloco é o último quando não há mais nada a ler depois dele
+		final := n < encryptedChunkSize
+		if !final {
+			if _, peekErr := reader.Peek(1); peekErr == io.EOF {
+				final = true
+			}
+		}
+		flag := []byte{0}
+		if final {
+			flag[0] = 1
+		}
+		if check != nil {
+			if err := check(index, chunk[:n], final); err != nil {
+				return err
+			}
+		}
+		if _, err := dst.Write(aead.Seal(nil, chunkNonce(index), chunk[:n], flag)); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+// Decifra e autentica os blocos de src, escrevendo o conteúdo em claro em dst;
+// check pode ser nil
+func decryptStream(dst io.Writer, src io.Reader, key []byte, check chunkCheck) error {
+	aead, err := newContentCipher(key)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReaderSize(src, encryptedChunkSize+aead.Overhead())
+	chunk := make([]byte, encryptedChunkSize+aead.Overhead())
+	for index := uint64(0); ; index++ {
+		n, err := io.ReadFull(reader, chunk)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("conteúdo cifrado truncado: %v", err)
+		}
+		final := n < len(chunk)
+		if !final {
+			if _, peekErr := reader.Peek(1); peekErr == io.EOF {
+				final = true
+			}
+		}
+		flag := []byte{0}
+		if final {
+			flag[0] = 1
+		}
+		plain, err := aead.Open(nil, chunkNonce(index), chunk[:n], flag)
+		if err != nil {
+			return fmt.Errorf("bloco %d do conteúdo cifrado não confere", index)
+		}
+		if check != nil {
+			if err := check(index, plain, final); err != nil {
+				return err
+			}
+		}
+		if _, err := dst.Write(plain); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+func sendPeerError(conn net.Conn, code int, format string, args ...interface{}) {
+	fmt.Fprintf(conn, "ERROR %d %s\n", code, fmt.Sprintf(format, args...))
+}
+
+// Interpreta "ERROR <código> <mensagem>" recebido de outro cliente
+func parsePeerError(line string) error {
+	parts := strings.SplitN(strings.TrimSpace(line), " ", 3)
+	if len(parts) < 2 {
+		return &peerError{Code: errInternal, Message: line}
+	}
+	code, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return &peerError{Code: errInternal, Message: strings.Join(parts[1:], " ")}
+	}
+	message := ""
+	if len(parts) == 3 {
+		message = parts[2]
+	}
+	return &peerError{Code: code, Message: message}
+}
+
+// Verifica se algum componente do caminho é ".."
+func hasDotDot(path string) bool {
+	for _, part := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if part == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve links simbólicos e garante que o caminho real está dentro da raiz compartilhada
+func resolveSharePath(path string) (string, error) {
+	root, err := filepath.Abs(shareRoot)
+	if err != nil {
+		return "", err
+	}
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", fmt.Errorf("raiz compartilhada '%s' inválida: %v", shareRoot, err)
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	realPath, err := filepath.EvalSymlinks(absPath)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, realPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("'%s' está fora da raiz compartilhada '%s'", path, root)
+	}
+	return realPath, nil
+}
+
+// Limite de um cliente específico, criado no primeiro uso
+func peerLimiter(limiters map[string]*p2p.RateLimiter, ip string, kibPerSecond int) *p2p.RateLimiter {
+	if kibPerSecond <= 0 {
+		return nil
+	}
+	peerLimitersMu.Lock()
+	defer peerLimitersMu.Unlock()
+	limiter := limiters[ip]
+	if limiter == nil {
+		limiter = p2p.NewRateLimiter(kibPerSecond)
+		limiters[ip] = limiter
+	}
+	return limiter
+}
+
+// Vagas de envio: no máximo maxUploadSlots envios ao mesmo tempo. Os demais
+// pedidos esperam em fila, na frente quem tem melhor razão envio/recebimento
+// e, entre razões iguais, pela ordem de chegada
+type uploadSlots struct {
+	mu     sync.Mutex
+	active int
+	queue  []*queuedUpload
+}
+
+type queuedUpload struct {
+	peer  string
+	ratio float64
+	ready chan struct{} // Fechado quando a vaga é entregue a este pedido
+}
+
+// Ocupa uma vaga livre, se houver e ninguém estiver esperando. Requer u.mu.
+func (u *uploadSlots) take() bool {
+	if maxUploadSlots <= 0 || (u.active < maxUploadSlots && len(u.queue) == 0) {
+		u.active++
+		return true
+	}
+	return false
+}
+
+// Posição do pedido na fila, a partir de 1; 0 se ele já recebeu a vaga
+func (u *uploadSlots) position(entry *queuedUpload) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for i, queued := range u.queue {
+		if queued == entry {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Obtém uma vaga de envio, informando ao solicitante a posição na fila
+// sempre que ela muda. Retorna false se a fila está cheia ou o solicitante desistiu.
+func (u *uploadSlots) acquire(conn net.Conn, peer string) bool {
+	u.mu.Lock()
+	taken := u.take()
+	u.mu.Unlock()
+	if taken {
+		return true
+	}
+
+	// A razão é consultada no super nó fora da trava; a vaga pode ter vagado nesse meio tempo
+	ratio := peerRatio(peer)
+	u.mu.Lock()
+	if u.take() {
+		u.mu.Unlock()
+		return true
+	}
+	if len(u.queue) >= maxUploadQueue {
+		u.mu.Unlock()
+		sendPeerError(conn, errUnavailable, "Fila de envio cheia, tente novamente mais tarde")
+		return false
+	}
+	entry := &queuedUpload{peer: peer, ratio: ratio, ready: make(chan struct{})}
+	i := len(u.queue)
+	for i > 0 && u.queue[i-1].ratio < ratio {
+		i--
+	}
+	u.queue = append(u.queue, nil)
+	copy(u.queue[i+1:], u.queue[i:])
+	u.queue[i] = entry
+	u.mu.Unlock()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	lastPosition := 0
+	for {
+		if position := u.position(entry); position > 0 && position != lastPosition {
+			if _, err := fmt.Fprintf(conn, "QUEUED %d\n", position); err != nil {
+				u.cancel(entry)
+				return false
+			}
+			lastPosition = position
+		}
+		select {
+		case <-entry.ready:
+			return true
+		case <-ticker.C:
+		}
+	}
+}
+
+// Retira um pedido da fila; se a vaga já tinha sido entregue, ela é devolvida
+func (u *uploadSlots) cancel(entry *queuedUpload) {
+	u.mu.Lock()
+	for i, queued := range u.queue {
+		if queued == entry {
+			u.queue = append(u.queue[:i], u.queue[i+1:]...)
+			u.mu.Unlock()
+			return
+		}
+	}
+	u.mu.Unlock()
+	u.release()
+}
+
+// Libera a vaga, entregando-a diretamente ao primeiro da fila
+func (u *uploadSlots) release() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.queue) > 0 {
+		next := u.queue[0]
+		u.queue = u.queue[1:]
+		close(next.ready)
+		return
+	}
+	u.active--
+}
+
+// Conexão com o super nó; o leitor é compartilhado entre as requisições para
+// que nenhuma resposta já bufferizada se perca
+type superNodeSession struct {
+	mu     sync.Mutex // Serializa as requisições do usuário e da sincronização do diretório
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newSuperNodeSession(conn net.Conn) *superNodeSession {
+	return &superNodeSession{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// Envia um comando ao super nó e retorna a linha de resposta
+func (s *superNodeSession) request(format string, args ...interface{}) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	message := fmt.Sprintf(format, args...)
+	start := time.Now()
+	defer func() {
+		requestDuration.Observe(p2p.Label("command", strings.SplitN(message, " ", 2)[0]), time.Since(start).Seconds())
+	}()
+
+	s.conn.SetDeadline(time.Now().Add(sessionTimeout))
+	defer s.conn.SetDeadline(time.Time{})
+	if _, err := fmt.Fprintf(s.conn, "%s\n", message); err != nil {
+		return "", fmt.Errorf("Erro ao enviar comando ao super nó: %v", err)
+	}
+	response, err := s.reader.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("Erro ao ler a resposta do super nó: %v", err)
+	}
+	return strings.TrimSpace(response), nil
+}
+
+// Envia um comando cuja resposta tem várias linhas, terminadas por END
+func (s *superNodeSession) requestLines(format string, args ...interface{}) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.conn.SetDeadline(time.Now().Add(sessionTimeout))
+	defer s.conn.SetDeadline(time.Time{})
+	if _, err := fmt.Fprintf(s.conn, format+"\n", args...); err != nil {
+		return nil, fmt.Errorf("Erro ao enviar comando ao super nó: %v", err)
+	}
+	var lines []string
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("Erro ao ler a resposta do super nó: %v", err)
+		}
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "ERROR") {
+			return nil, errors.New(line)
+		}
+		if line == "END" {
+			return lines, nil
+		}
+		lines = append(lines, line)
+	}
+}
+
+// Encerra a sessão avisando o super nó
+func (s *superNodeSession) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintf(s.conn, "CLOSE\n")
+	s.conn.Close()
+}
+
+// Os nomes trafegam escapados para não quebrar os campos separados por espaço
+func encodeName(name string) string {
+	return url.QueryEscape(name)
+}
+
+// Procura um arquivo publicado pelo nome anunciado ao super nó
+func findShareByName(name string) *sharedFile {
+	sharesMu.Lock()
+	defer sharesMu.Unlock()
+	for _, share := range sharedFiles {
+		if share.Name == name {
+			return share
+		}
+	}
+	return nil
+}
+
+// Calcula o hash SHA-256 (hexadecimal) e o tamanho do conteúdo de um arquivo
+func hashFile(filePath string) (string, int64, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, file)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), size, nil
+}
+
+// Prepara um arquivo para publicação; com encrypted, gera uma chave nova e
+// anuncia o hash e o tamanho do texto cifrado
+func newShare(filePath string, info os.FileInfo, fileVisibility string, encrypted bool) (*sharedFile, error) {
+	hash, size, err := hashFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	share := &sharedFile{
+		Path:        filePath,
+		Name:        filepath.Base(filePath),
+		Hash:        hash,
+		Size:        size,
+		ContentHash: hash,
+		PlainSize:   size,
+		ModTime:     info.ModTime(),
+		Visibility:  fileVisibility,
+	}
+	if !encrypted {
+		return share, nil
+	}
+
+	share.Key = make([]byte, 32)
+	if _, err := rand.Read(share.Key); err != nil {
+		return nil, err
+	}
+	share.KeyOwner = true
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	if err := encryptStream(hasher, file, share.Key, recordChunks(&share.ChunkHashes)); err != nil {
+		return nil, err
+	}
+	share.Hash, share.Size = hex.EncodeToString(hasher.Sum(nil)), encryptedSize(size)
+	return share, nil
+}
+
+func uploadFile(session *superNodeSession, filePath string, fileVisibility string, encrypted bool) error {
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		return fmt.Errorf("Caminho inválido '%s': %v", filePath, err)
+	}
+	info, err := os.Stat(absPath)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("Arquivo '%s' não existe", filePath)
+	}
+	if err != nil {
+		return fmt.Errorf("Erro ao acessar o arquivo '%s': %v", filePath, err)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("'%s' é um diretório; use a opção de compartilhar diretório", filePath)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("'%s' não é um arquivo regular", filePath)
+	}
+	if _, err := resolveSharePath(absPath); err != nil {
+		return err
+	}
+	share, err := newShare(absPath, info, fileVisibility, encrypted)
+	if err != nil {
+		return fmt.Errorf("Erro ao ler o arquivo '%s': %v", filePath, err)
+	}
+	return announceShare(session, share)
+}
+
+// Identifica o usuário no início da sessão; com TLS mútuo o certificado já basta
+func authenticate(session *superNodeSession) error {
+	response, err := session.request("AUTH %s %s", userName, userToken)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(response, "OK") {
+		return fmt.Errorf("Falha na autenticação: %s", response)
+	}
+	slog.Info("Autenticado no super nó", "user", userName)
+	return nil
+}
+
+// Visibilidade informada na resposta FOUND; cópias baixadas mantêm a do original
+func visibilityOf(parts []string) string {
+	if len(parts) >= 7 {
+		return parts[6]
+	}
+	return "public"
+}
+
+// Registra o arquivo no super nó e na tabela de arquivos compartilhados
+func announceShare(session *superNodeSession, share *sharedFile) error {
+	command := fmt.Sprintf("UPLOAD %s %d %s %s", share.Hash, share.Size, encodeName(share.Name), share.Visibility)
+	if share.KeyOwner {
+		command += " enc"
+	} else if share.Key != nil {
+		command += " enccopy" // Cópia cifrada baixada de outro cliente
+	}
+	response, err := session.request("%s", command)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(response, "OK") {
+		return errors.New(response)
+	}
+
+	sharesMu.Lock()
+	sharedFiles[share.Path] = share
+	sharesMu.Unlock()
+
+	slog.Info("Arquivo registrado no super nó", "file", share.Name, "hash", share.Hash, "size", share.Size)
+	return nil
+}
+
+// Retira o arquivo da tabela e avisa o super nó, a menos que outro arquivo
+// compartilhado tenha o mesmo conteúdo
+func withdrawShare(session *superNodeSession, share *sharedFile) error {
+	sharesMu.Lock()
+	delete(sharedFiles, share.Path)
+	sharesMu.Unlock()
+
+	if findShare(share.Hash) != nil {
+		return nil
+	}
+	response, err := session.request("REMOVE %s", share.Hash)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(response, "OK") {
+		return errors.New(response)
+	}
+	slog.Info("Arquivo removido do super nó", "file", share.Name, "hash", share.Hash)
+	return nil
+}
+
+// Compartilha todos os arquivos de um diretório e passa a acompanhar suas mudanças
+func shareDirectory(session *superNodeSession, dir string) error {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return fmt.Errorf("Caminho inválido '%s': %v", dir, err)
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return fmt.Errorf("Erro ao acessar o diretório '%s': %v", dir, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("'%s' não é um diretório", dir)
+	}
+	if _, err := resolveSharePath(root); err != nil {
+		return err
+	}
+
+	syncDirectory(session, root)
+	go watchDirectory(session, root)
+	return nil
+}
+
+// Varre o diretório periodicamente, enviando ao super nó as inclusões, alterações e remoções
+func watchDirectory(session *superNodeSession, root string) {
+	for {
+		time.Sleep(watchInterval)
+		syncDirectory(session, root)
+	}
+}
+
+// Compara o conteúdo atual do diretório com o último estado anunciado e envia as diferenças
+func syncDirectory(session *superNodeSession, root string) {
+	current := make(map[string]os.FileInfo)
+	filepath.WalkDir(root, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return nil // Ignora entradas que não puderam ser lidas
+		}
+		// Downloads em andamento usam o sufixo .part e só são publicados ao final
+		if entry.Type().IsRegular() && !strings.HasSuffix(path, ".part") {
+			if info, err := entry.Info(); err == nil {
+				current[path] = info
+			}
+		}
+		// Diretórios que são links para fora da raiz não são percorridos
+		if entry.IsDir() && path != root {
+			if _, err := resolveSharePath(path); err != nil {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+
+	previous := make(map[string]*sharedFile)
+	sharesMu.Lock()
+	for path, share := range sharedFiles {
+		if path == root || strings.HasPrefix(path, root+string(filepath.Separator)) {
+			previous[path] = share
+		}
+	}
+	sharesMu.Unlock()
+
+	// Arquivos apagados
+	for path, share := range previous {
+		if _, ok := current[path]; !ok {
+			if err := withdrawShare(session, share); err != nil {
+				slog.Error("Erro ao remover arquivo do super nó", "path", path, "error", err)
+			}
+		}
+	}
+
+	// Arquivos novos ou modificados
+	for path, info := range current {
+		old := previous[path]
+		if old != nil && old.PlainSize == info.Size() && old.ModTime.Equal(info.ModTime()) {
+			continue
+		}
+		hash, _, err := hashFile(path)
+		if err != nil {
+			slog.Error("Erro ao ler arquivo do diretório compartilhado", "path", path, "error", err)
+			continue
+		}
+		if old != nil && old.ContentHash == hash {
+			// Só a data mudou: mantém o hash anunciado e a chave
+			updated := *old
+			updated.ModTime = info.ModTime()
+			sharesMu.Lock()
+			sharedFiles[path] = &updated
+			sharesMu.Unlock()
+			continue
+		}
+		share, err := newShare(path, info, visibility, encrypt)
+		if err != nil {
+			slog.Error("Erro ao ler arquivo do diretório compartilhado", "path", path, "error", err)
+			continue
+		}
+		if old != nil {
+			if err := withdrawShare(session, old); err != nil {
+				slog.Error("Erro ao remover a versão anterior do super nó", "path", path, "error", err)
+			}
+		}
+		if err := announceShare(session, share); err != nil {
+			slog.Error("Erro ao registrar arquivo no super nó", "path", path, "error", err)
+		}
+	}
+}
+
+// Baixa um arquivo pelo nome ou pelo hash do conteúdo. O super nó indica os
+// detentores; cada um é tentado até que o conteúdo recebido confira com o hash,
+// e só então o download é confirmado ao super nó. Retorna o arquivo publicado.
+func downloadFile(session *superNodeSession, key string) (_ *sharedFile, err error) {
+	// O span do download é a raiz do trace; o ID do trace é o ID da requisição
+	// nos logs deste cliente, do super nó e dos super nós consultados por ele
+	root := p2p.StartSpan("download", p2p.SpanInternal, p2p.SpanContext{})
+	root.Set("file", key)
+	defer func() { root.End(err) }()
+	reqLog := slog.With("request", root.Context.TraceID, "file", key)
+
+	// Solicita o download ao super nó
+	lookup := p2p.StartSpan("DOWNLOAD", p2p.SpanClient, root.Context)
+	lookup.Set("supernode", currentSuperNodeHost())
+	response, err := session.request("DOWNLOAD %s %s", encodeName(key), lookup.Context.Traceparent())
+	if err == nil && strings.HasPrefix(response, "NOTFOUND") {
+		err = fmt.Errorf("%w: %s", errFileNotFound, key)
+	} else if err == nil && strings.HasPrefix(response, "ERROR") {
+		err = errors.New(response) // Retorna o erro diretamente
+	}
+	lookup.End(err)
+	if err != nil {
+		return nil, err
+	}
+
+	// Resposta esperada: FOUND <hash> <tamanho> <ip>[,<ip>...] <nome> <dono> <visibilidade> <cifragem>
+	parts := strings.Split(response, " ")
+	if len(parts) < 5 || parts[0] != "FOUND" || !isContentHash(parts[1]) {
+		return nil, fmt.Errorf("Resposta inesperada do super nó: %s", response)
+	}
+	hash, holders := parts[1], strings.Split(parts[3], ",")
+	expectedSize, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Tamanho inválido na resposta do super nó: %s", response)
+	}
+	fileName, err := url.QueryUnescape(parts[4])
+	if err != nil {
+		return nil, fmt.Errorf("Nome inválido na resposta do super nó: %s", response)
+	}
+	fileName = filepath.Base(fileName)
+	if fileName == "." || fileName == ".." || fileName == string(filepath.Separator) {
+		return nil, fmt.Errorf("Nome inválido na resposta do super nó: %s", response)
+	}
+	localPath := filepath.Join(shareRoot, fileName) // Downloads ficam na raiz compartilhada
+
+	// Conteúdo cifrado: a chave é pedida ao dono antes de baixar, para falhar cedo sem permissão
+	var fileKey []byte
+	if len(parts) >= 8 && strings.HasPrefix(parts[7], "enc:") {
+		keyHolders := strings.TrimPrefix(parts[7], "enc:")
+		if keyHolders == "-" {
+			return nil, fmt.Errorf("Nenhum detentor da chave do arquivo '%s' está disponível", fileName)
+		}
+		if fileKey, err = requestKey(strings.Split(keyHolders, ","), hash); err != nil {
+			return nil, err
+		}
+	}
+
+	tempName := localPath + ".part"
+	err = fmt.Errorf("Nenhum detentor informado pelo super nó")
+	for _, ipClient := range holders {
+		if holderGone(hash, ipClient) {
+			reqLog.Info("Detentor deixou de compartilhar o arquivo; pulando", "holder", ipClient)
+			continue
+		}
+		reqLog.Info("Iniciando download", "hash", hash, "holder", ipClient)
+		err = fetchFromPeer(ipClient, hash, expectedSize, tempName, root.Context)
+		if errors.Is(err, errPeerUnreachable) {
+			// Detentor atrás de NAT ou firewall: o super nó intermedeia a conexão
+			reqLog.Info("Detentor inalcançável; pedindo ao super nó conexão reversa ou retransmissão", "holder", ipClient, "error", err)
+			err = fetchThroughSuperNode(session, ipClient, hash, expectedSize, tempName, root.Context)
+		}
+		if err == nil {
+			// O detentor só ganha crédito com a confirmação de quem baixou
+			reportTransfer("RECV", hash, expectedSize, ipClient)
+			break
+		}
+		reqLog.Warn("Falha ao baixar do detentor", "holder", ipClient, "error", err)
+		// Fila cheia, falta de permissão ou retransmissão sem vaga não indicam problema com o detentor
+		var peerErr *peerError
+		if errors.Is(err, errRelayUnavailable) {
+			continue
+		}
+		if !errors.As(err, &peerErr) || (peerErr.Code != errUnavailable && peerErr.Code != errForbidden) {
+			reportFailure(session, hash, ipClient)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	share := &sharedFile{Name: fileName, Hash: hash, Size: expectedSize, ContentHash: hash, PlainSize: expectedSize,
+		ModTime: time.Now(), Visibility: visibilityOf(parts), Key: fileKey}
+	if fileKey != nil {
+		share.ContentHash, share.PlainSize, share.ChunkHashes, err = decryptFile(tempName, localPath, fileKey)
+		os.Remove(tempName)
+		if err != nil {
+			return nil, fmt.Errorf("Erro ao decifrar o arquivo '%s': %v", fileName, err)
+		}
+	} else if err := os.Rename(tempName, localPath); err != nil {
+		os.Remove(tempName)
+		return nil, fmt.Errorf("Erro ao salvar o arquivo: %v", err)
+	}
+
+	// Só depois da verificação o arquivo é publicado e o super nó passa a indicar este cliente
+	absPath, err := filepath.Abs(localPath)
+	if err != nil {
+		return nil, fmt.Errorf("Erro ao resolver o caminho '%s': %v", localPath, err)
+	}
+	share.Path = absPath
+	if info, err := os.Stat(absPath); err == nil {
+		share.ModTime = info.ModTime()
+	}
+	sharesMu.Lock()
+	sharedFiles[absPath] = share
+	sharesMu.Unlock()
+
+	confirm := p2p.StartSpan("CONFIRM", p2p.SpanClient, root.Context)
+	response, err = session.request("CONFIRM %s %d %s %s", hash, expectedSize, encodeName(fileName), confirm.Context.Traceparent())
+	if err == nil && !strings.HasPrefix(response, "OK") {
+		err = errors.New(response)
+	}
+	confirm.End(err)
+	if err != nil {
+		sharesMu.Lock()
+		delete(sharedFiles, absPath)
+		sharesMu.Unlock()
+		return nil, fmt.Errorf("Arquivo '%s' baixado, mas não foi registrado no super nó: %v", fileName, err)
+	}
+
+	reqLog.Info("Download concluído", "hash", hash, "size", expectedSize)
+	return share, nil
+}
+
+// Pede a chave de um arquivo cifrado aos detentores que a guardam
+func requestKey(keyHolders []string, hash string) ([]byte, error) {
+	err := fmt.Errorf("Nenhum detentor da chave informado pelo super nó")
+	for _, ipClient := range keyHolders {
+		var key []byte
+		if key, err = fetchKey(ipClient, hash); err == nil {
+			return key, nil
+		}
+		slog.Warn("Falha ao obter a chave do detentor", "holder", ipClient, "hash", hash, "error", err)
+	}
+	return nil, err
+}
+
+// Troca chaves X25519 efêmeras com o dono e abre a chave do arquivo selada por ele
+func fetchKey(ipClient string, hash string) ([]byte, error) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := p2p.Dial(ipClient + clientPort)
+	if err != nil {
+		return nil, fmt.Errorf("Erro ao conectar ao cliente: %v", err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "KEY %s %s\n", hash, base64.StdEncoding.EncodeToString(private.PublicKey().Bytes()))
+	response, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("Erro ao ler a chave: %v", err)
+	}
+	if strings.HasPrefix(response, "ERROR") {
+		return nil, parsePeerError(response)
+	}
+	parts := strings.Split(strings.TrimSpace(response), " ")
+	if len(parts) != 3 || parts[0] != "KEY" {
+		return nil, fmt.Errorf("Resposta inesperada do cliente: %s", response)
+	}
+	rawKey, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("Chave efêmera inválida: %v", err)
+	}
+	ownerKey, err := ecdh.X25519().NewPublicKey(rawKey)
+	if err != nil {
+		return nil, fmt.Errorf("Chave efêmera inválida: %v", err)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("Chave selada inválida: %v", err)
+	}
+	secret, err := private.ECDH(ownerKey)
+	if err != nil {
+		return nil, err
+	}
+	key, err := unwrapKey(secret, hash, wrapped)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("Não foi possível abrir a chave do arquivo")
+	}
+	return key, nil
+}
+
+// Decifra o arquivo baixado para localPath e retorna o hash, o tamanho e os
+// hashes dos blocos do conteúdo em claro
+func decryptFile(encryptedPath string, localPath string, key []byte) (string, int64, [][sha256.Size]byte, error) {
+	src, err := os.Open(encryptedPath)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	defer src.Close()
+
+	tempName := localPath + ".plain.part"
+	dst, err := os.Create(tempName)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	hasher := sha256.New()
+	counter := &countingWriter{}
+	var chunks [][sha256.Size]byte
+	err = decryptStream(io.MultiWriter(dst, hasher, counter), src, key, recordChunks(&chunks))
+	dst.Close()
+	if err != nil {
+		os.Remove(tempName)
+		return "", 0, nil, err
+	}
+	if err := os.Rename(tempName, localPath); err != nil {
+		os.Remove(tempName)
+		return "", 0, nil, err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), counter.n, chunks, nil
+}
+
+// Transferência acompanhada pela interface de terminal; conta os bytes
+// escritos nela e estima a velocidade
+type transfer struct {
+	Kind    string // "up" (envio) ou "down" (recebimento)
+	Name    string
+	Peer    string
+	Size    int64
+	Started time.Time
+	bytes   int64 // Atualizado atomicamente durante a cópia
+
+	mu          sync.Mutex
+	finished    time.Time
+	err         string
+	sampleAt    time.Time
+	sampleBytes int64
+	speed       float64 // Bytes por segundo, média móvel
+}
+
+func (t *transfer) Write(p []byte) (int, error) {
+	atomic.AddInt64(&t.bytes, int64(len(p)))
+	if t.Kind == "up" {
+		bytesServed.Add("", float64(len(p)))
+	} else {
+		bytesReceived.Add("", float64(len(p)))
+	}
+	return len(p), nil
+}
+
+func (t *transfer) done() int64 {
+	return atomic.LoadInt64(&t.bytes)
+}
+
+// Velocidade recente, recalculada no máximo a cada meio segundo
+func (t *transfer) rate() float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if !t.finished.IsZero() {
+		return t.speed
+	}
+	if elapsed := now.Sub(t.sampleAt).Seconds(); elapsed >= 0.5 {
+		current := float64(t.done()-t.sampleBytes) / elapsed
+		if t.speed == 0 {
+			t.speed = current
+		} else {
+			t.speed = 0.7*t.speed + 0.3*current
+		}
+		t.sampleAt, t.sampleBytes = now, t.done()
+	}
+	return t.speed
+}
+
+// Encerra a transferência; ela continua listada por transferKeep
+func (t *transfer) finish(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.finished = time.Now()
+	time.AfterFunc(transferKeep, func() { forgetTransfer(t) })
+	result := "ok"
+	if err != nil {
+		t.err = err.Error()
+		result = "error"
+	}
+	transfersTotal.Inc(p2p.Label("direction", t.Kind) + "," + p2p.Label("result", result))
+}
+
+func (t *transfer) status() (time.Time, string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.finished, t.err
+}
+
+func startTransfer(kind string, name string, peer string, size int64) *transfer {
+	now := time.Now()
+	t := &transfer{Kind: kind, Name: name, Peer: peer, Size: size, Started: now, sampleAt: now}
+	transfersMu.Lock()
+	transfers = append(transfers, t)
+	transfersMu.Unlock()
+	return t
+}
+
+// Tira da lista uma transferência encerrada há transferKeep
+func forgetTransfer(t *transfer) {
+	transfersMu.Lock()
+	defer transfersMu.Unlock()
+	for i, listed := range transfers {
+		if listed == t {
+			transfers = append(transfers[:i], transfers[i+1:]...)
+			return
+		}
+	}
+}
+
+// Transferências em andamento e as encerradas há menos de transferKeep
+func currentTransfers() []*transfer {
+	transfersMu.Lock()
+	defer transfersMu.Unlock()
+	return append([]*transfer(nil), transfers...)
+}
+
+type countingWriter struct{ n int64 }
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// Baixa o conteúdo de um detentor para tempName, conferindo tamanho e hash
+func fetchFromPeer(ipClient string, hash string, expectedSize int64, tempName string, parent p2p.SpanContext) (err error) {
+	sp := p2p.StartSpan("fetch", p2p.SpanClient, parent)
+	sp.Set("holder", ipClient)
+	sp.Set("hash", hash)
+	sp.Set("bytes", expectedSize)
+	defer func() { sp.End(err) }()
+
+	// Conecta ao cliente que possui o arquivo
+	clientConn, err := p2p.DialTimeout(ipClient+clientPort, 5*time.Second) // Porta onde o cliente está aguardando
+	if err != nil {
+		return fmt.Errorf("%w: %v", errPeerUnreachable, err)
+	}
+	defer clientConn.Close()
+
+	// Solicita o arquivo ao cliente, com o contexto do trace
+	fmt.Fprintf(clientConn, "DOWNLOAD %s %s\n", hash, sp.Context.Traceparent())
+	return receiveFile(bufio.NewReader(clientConn), ipClient, hash, expectedSize, tempName)
+}
+
+// Lê a resposta a um pedido de arquivo e grava o conteúdo em tempName
+func receiveFile(reader *bufio.Reader, ipClient string, hash string, expectedSize int64, tempName string) error {
+	// Lê o tamanho do arquivo; antes dele podem vir linhas "QUEUED <posição>"
+	// enquanto o pedido espera uma vaga de envio
+	var fileSizeStr string
+	var err error
+	for {
+		fileSizeStr, err = reader.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("Erro ao obter o tamanho do arquivo: %v", err)
+		}
+		if !strings.HasPrefix(fileSizeStr, "QUEUED ") {
+			break
+		}
+		slog.Info("Aguardando na fila do detentor", "holder", ipClient, "position", strings.TrimSpace(strings.TrimPrefix(fileSizeStr, "QUEUED ")))
+	}
+	if strings.HasPrefix(fileSizeStr, "ERROR") {
+		return parsePeerError(fileSizeStr)
+	}
+
+	fileSize, err := strconv.ParseInt(strings.TrimSpace(fileSizeStr), 10, 64)
+	if err != nil {
+		return fmt.Errorf("Erro ao converter o tamanho do arquivo: %v", err)
+	}
+	if fileSize != expectedSize {
+		return fmt.Errorf("Tamanho anunciado pelo cliente (%d) difere do registrado no super nó (%d)", fileSize, expectedSize)
+	}
+
+	// Baixa para um arquivo temporário, que só é usado depois de conferido o hash
+	file, err := os.Create(tempName)
+	if err != nil {
+		return fmt.Errorf("Erro ao criar o arquivo local: %v", err)
+	}
+
+	hasher := sha256.New()
+	progress := startTransfer("down", filepath.Base(strings.TrimSuffix(tempName, ".part")), ipClient, fileSize)
+	limited := p2p.ThrottledReader(reader, downloadLimiter, peerLimiter(peerDownloads, ipClient, peerDownloadLimit))
+	receivedBytes, err := io.CopyN(io.MultiWriter(file, hasher, progress), limited, fileSize)
+	file.Close()
+	if err != nil {
+		os.Remove(tempName)
+		err = fmt.Errorf("Erro ao baixar o arquivo (%d de %d bytes): %v", receivedBytes, fileSize, err)
+		progress.finish(err)
+		return err
+	}
+
+	if received := hex.EncodeToString(hasher.Sum(nil)); received != hash {
+		os.Remove(tempName)
+		err = fmt.Errorf("Hash do arquivo recebido (%s) não confere com o esperado (%s)", received, hash)
+		progress.finish(err)
+		return err
+	}
+	progress.finish(nil)
+	return nil
+}
+
+// Conexão aberta por um detentor em resposta a um pedido REVERSE
+type pushedConn struct {
+	reader *bufio.Reader
+	done   chan struct{} // Fechado quando quem baixa termina de usar a conexão
+}
+
+// Gera um token aleatório para identificar uma conexão intermediada pelo super nó
+func newConnectToken() string {
+	token := make([]byte, 16)
+	rand.Read(token)
+	return hex.EncodeToString(token)
+}
+
+// Entrega a conexão de um detentor ao download que a aguarda
+func acceptPush(conn net.Conn, reader *bufio.Reader, token string) {
+	reverseMu.Lock()
+	wait := reverseWaits[token]
+	reverseMu.Unlock()
+	if wait == nil {
+		slog.Warn("Conexão reversa com token desconhecido recusada", "peer", conn.RemoteAddr().String())
+		return
+	}
+	pushed := &pushedConn{reader: reader, done: make(chan struct{})}
+	select {
+	case wait <- pushed:
+		<-pushed.done
+	default:
+	}
+}
+
+// Baixa de um detentor inalcançável com ajuda do super nó: ou o detentor se
+// conecta a este cliente (REVERSE), ou os dois se encontram na porta de
+// retransmissão do super nó (RELAY)
+func fetchThroughSuperNode(session *superNodeSession, holderIP string, hash string, expectedSize int64, tempName string, parent p2p.SpanContext) (err error) {
+	sp := p2p.StartSpan("CONNECT", p2p.SpanClient, parent)
+	sp.Set("holder", holderIP)
+	sp.Set("hash", hash)
+	defer func() { sp.End(err) }()
+
+	token := newConnectToken()
+	wait := make(chan *pushedConn, 1)
+	reverseMu.Lock()
+	reverseWaits[token] = wait
+	reverseMu.Unlock()
+	defer func() {
+		reverseMu.Lock()
+		delete(reverseWaits, token)
+		reverseMu.Unlock()
+	}()
+
+	response, err := session.request("CONNECT %s %s %s %s", holderIP, hash, token, sp.Context.Traceparent())
+	if err != nil {
+		return err
+	}
+	sp.Set("mode", strings.TrimPrefix(response, "OK "))
+	switch response {
+	case "OK REVERSE":
+		select {
+		case pushed := <-wait:
+			defer close(pushed.done)
+			slog.Info("Detentor conectou-se de volta", "holder", holderIP)
+			return receiveFile(pushed.reader, holderIP, hash, expectedSize, tempName)
+		case <-time.After(30 * time.Second):
+			return fmt.Errorf("Detentor %s não se conectou de volta", holderIP)
+		}
+	case "OK RELAY":
+		conn, err := p2p.DialTimeout(currentSuperNodeHost()+relayPort, 5*time.Second)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errRelayUnavailable, err)
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "RELAY %s\n", token)
+		peer := conn
+		if p2p.TLSConfig != nil {
+			// TLS de ponta a ponta com o detentor, dentro da conexão com o super nó
+			peer = tls.Client(conn, relayClientConfig())
+			if !p2p.PeerHasRole(peer, p2p.RoleClient) {
+				return fmt.Errorf("Detentor %s não apresentou um certificado de cliente", holderIP)
+			}
+		}
+		slog.Info("Baixando pela retransmissão do super nó", "holder", holderIP)
+		fmt.Fprintf(peer, "DOWNLOAD %s %s\n", hash, sp.Context.Traceparent())
+		return receiveFile(bufio.NewReader(peer), holderIP, hash, expectedSize, tempName)
+	default:
+		if strings.HasPrefix(response, "BUSY") {
+			return fmt.Errorf("%w: %s", errRelayUnavailable, strings.TrimSpace(strings.TrimPrefix(response, "BUSY")))
+		}
+		return errors.New(response)
+	}
+}
+
+// Do outro lado de uma retransmissão não há nome de host a conferir: a
+// cadeia do certificado é verificada diretamente contra a CA do cluster
+func relayClientConfig() *tls.Config {
+	config := p2p.TLSConfig.Clone()
+	config.InsecureSkipVerify = true
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		return p2p.VerifyClusterChain(rawCerts, x509.ExtKeyUsageServerAuth)
+	}
+	return config
+}
+
+// Mantém uma segunda conexão com o super nó, por onde ele pede a este
+// cliente conexões reversas e retransmissões
+func runControlChannel() {
+	for {
+		err := controlLoop()
+		slog.Warn("Canal de controle com o super nó encerrado; reconectando em 5s", "error", err)
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func controlLoop() error {
+	conn, err := p2p.DialTimeout(currentSuperNodeHost()+supernoPort, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	session := newSuperNodeSession(conn)
+	if userName != "" && userToken != "" {
+		if err := authenticate(session); err != nil {
+			return err
+		}
+	}
+	response, err := session.request("CONTROL")
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(response, "OK") {
+		return errors.New(response)
+	}
+
+	// PINGs periódicos mantêm a sessão viva; se as respostas (PONG) pararem
+	// de chegar, a leitura expira e o canal é refeito
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(keepaliveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				session.mu.Lock()
+				fmt.Fprintf(conn, "PING\n")
+				session.mu.Unlock()
+			}
+		}
+	}()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(sessionTimeout))
+		line, err := session.reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		handleControlMessage(strings.Split(strings.TrimSpace(line), " "))
+	}
+}
+
+// Pedidos e eventos enviados pelo super nó pelo canal de controle
+func handleControlMessage(parts []string) {
+	switch {
+	case parts[0] == "PONG":
+	case parts[0] == "HOLDER_GONE" && len(parts) == 3:
+		// HOLDER_GONE <hash> <ip>: um detentor de um download em andamento saiu
+		slog.Info("Super nó avisa que o detentor saiu", "holder", parts[2], "hash", parts[1])
+		goneMu.Lock()
+		goneHolders[parts[1]+" "+parts[2]] = time.Now()
+		goneMu.Unlock()
+	case parts[0] == "RECONNECT" && len(parts) == 2 && net.ParseIP(parts[1]) != nil:
+		// RECONNECT <ip>: super nó indicado para a próxima conexão
+		slog.Info("Super nó indica reconexão em outro super nó", "addr", parts[1])
+		setSuperNodeHost(parts[1])
+	case parts[0] == "MATCH" && len(parts) == 4:
+		// MATCH <assinatura> <hash> <nome>: arquivo assinado foi publicado
+		handleMatch(parts[1], parts[2], parts[3])
+	case parts[0] == "SHUTDOWN":
+		slog.Warn("Super nó está encerrando; reconectando")
+		if activeSession != nil {
+			go restoreSession(activeSession)
+		}
+	case parts[0] == "REVERSE" && (len(parts) == 4 || len(parts) == 5) && net.ParseIP(parts[2]) != nil:
+		// REVERSE <token> <ip de quem baixa> <hash> [traceparent]. Atrás do
+		// mesmo IP pode haver outros clientes; só atende quem tem o conteúdo
+		if findShare(parts[3]) != nil {
+			go serveReverse(parts[1], parts[2], parts[3], p2p.RequestContext(parts, 4))
+		}
+	case parts[0] == "RELAY" && len(parts) == 5 && net.ParseIP(parts[2]) != nil:
+		// RELAY <token> <ip do super nó> <ip de quem baixa> <hash>
+		if findShare(parts[4]) != nil {
+			go serveRelay(parts[1], parts[2], parts[3])
+		}
+	}
+}
+
+// Verifica se o super nó avisou, há menos de um minuto, que o detentor saiu
+func holderGone(hash string, ip string) bool {
+	goneMu.Lock()
+	defer goneMu.Unlock()
+	for key, at := range goneHolders {
+		if time.Since(at) > time.Minute {
+			delete(goneHolders, key)
+		}
+	}
+	_, gone := goneHolders[hash+" "+ip]
+	return gone
+}
+
+func currentSuperNodeHost() string {
+	hostMu.Lock()
+	defer hostMu.Unlock()
+	return superNodeHost
+}
+
+func setSuperNodeHost(host string) {
+	hostMu.Lock()
+	superNodeHost = host
+	hostMu.Unlock()
+}
+
+// Envia PING periodicamente pela sessão principal e a restabelece quando o super nó não responde
+func keepSessionAlive(session *superNodeSession) {
+	for {
+		time.Sleep(keepaliveInterval)
+		response, err := session.request("PING")
+		if err == nil && response == "PONG" {
+			continue
+		}
+		slog.Warn("Super nó não respondeu ao PING; reconectando", "error", err)
+		restoreSession(session)
+	}
+}
+
+// Reconecta a sessão principal, tentando a cada 5 segundos até conseguir
+func restoreSession(session *superNodeSession) {
+	if !atomic.CompareAndSwapInt32(&restoring, 0, 1) {
+		return // Outra goroutine já está reconectando
+	}
+	defer atomic.StoreInt32(&restoring, 0)
+
+	for {
+		host := currentSuperNodeHost()
+		err := reconnectSession(session, host)
+		if err == nil {
+			return
+		}
+		slog.Error("Erro ao reconectar ao super nó", "addr", host, "error", err)
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// Troca a conexão da sessão por uma nova com o super nó em host, autentica
+// de novo e reanuncia os arquivos compartilhados
+func reconnectSession(session *superNodeSession, host string) error {
+	conn, err := p2p.DialTimeout(host+supernoPort, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	session.mu.Lock()
+	session.conn.Close()
+	session.conn, session.reader = conn, bufio.NewReader(conn)
+	session.mu.Unlock()
+	slog.Info("Sessão restabelecida com o super nó", "addr", host)
+
+	if userName != "" && userToken != "" {
+		if err := authenticate(session); err != nil {
+			return err
+		}
+	}
+
+	// Dentro do período de tolerância o super nó ainda guarda os arquivos e
+	// as assinaturas; basta retomar a sessão, mesmo que o IP tenha mudado
+	if sessionToken != "" {
+		response, err := session.request("RESUME %s", sessionToken)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(response, "OK") {
+			slog.Info("Sessão retomada no super nó", "files", strings.TrimPrefix(response, "OK "))
+			return nil
+		}
+		slog.Warn("Não foi possível retomar a sessão; anunciando os arquivos de novo", "response", response)
+	}
+	defer requestSessionToken(session)
+
+	sharesMu.Lock()
+	shares := make([]*sharedFile, 0, len(sharedFiles))
+	for _, share := range sharedFiles {
+		shares = append(shares, share)
+	}
+	sharesMu.Unlock()
+	for _, share := range shares {
+		if err := announceShare(session, share); err != nil {
+			slog.Error("Erro ao reanunciar arquivo", "file", share.Name, "error", err)
+		}
+	}
+
+	subscriptionsMu.Lock()
+	subs := append([]*clientSubscription(nil), subscriptions...)
+	subscriptionsMu.Unlock()
+	for _, sub := range subs {
+		if err := registerSubscription(session, sub); err != nil {
+			slog.Error("Erro ao refazer assinatura", "value", sub.Value, "error", err)
+		}
+	}
+	return nil
+}
+
+// Guarda o token com que a sessão pode ser retomada depois de uma queda
+func requestSessionToken(session *superNodeSession) {
+	response, err := session.request("SESSION")
+	if err != nil || !strings.HasPrefix(response, "OK ") {
+		slog.Warn("Super nó não forneceu token de sessão", "error", err, "response", response)
+		return
+	}
+	sessionToken = strings.TrimPrefix(response, "OK ")
+}
+
+// Assinatura feita por este cliente
+type clientSubscription struct {
+	ID    int // Número dado pelo super nó atual
+	Kind  string
+	Value string
+	Auto  bool // Baixa o arquivo assim que o aviso chega
+}
+
+// Pede ao super nó para ser avisado quando um arquivo com o nome, o padrão ou o hash for publicado
+func subscribe(session *superNodeSession, kind string, value string, auto bool) error {
+	sub := &clientSubscription{Kind: kind, Value: value, Auto: auto}
+	if err := registerSubscription(session, sub); err != nil {
+		return err
+	}
+	subscriptionsMu.Lock()
+	subscriptions = append(subscriptions, sub)
+	subscriptionsMu.Unlock()
+	return nil
+}
+
+func registerSubscription(session *superNodeSession, sub *clientSubscription) error {
+	response, err := session.request("SUBSCRIBE %s %s", sub.Kind, encodeName(sub.Value))
+	if err != nil {
+		return err
+	}
+	var id int
+	if _, err := fmt.Sscanf(response, "OK %d", &id); err != nil {
+		return errors.New(response)
+	}
+	subscriptionsMu.Lock()
+	sub.ID = id
+	subscriptionsMu.Unlock()
+	return nil
+}
+
+// Trata o aviso de que um arquivo assinado foi publicado
+func handleMatch(idStr string, hash string, encodedName string) {
+	name, _ := url.QueryUnescape(encodedName)
+	id, _ := strconv.Atoi(idStr)
+	var sub *clientSubscription
+	subscriptionsMu.Lock()
+	for _, candidate := range subscriptions {
+		if candidate.ID == id {
+			sub = candidate
+		}
+	}
+	subscriptionsMu.Unlock()
+	if sub == nil || !isContentHash(hash) {
+		return
+	}
+
+	// Pelo log, que a interface de terminal mostra no painel de mensagens
+	slog.Info("Aviso: arquivo assinado foi publicado", "file", name, "hash", hash)
+	if !sub.Auto || findShare(hash) != nil || activeSession == nil {
+		return
+	}
+	go func() {
+		slog.Info("Baixando arquivo assinado automaticamente", "file", name, "hash", hash)
+		if _, err := downloadFile(activeSession, hash); err != nil {
+			slog.Error("Erro no download automático", "file", name, "error", err)
+		}
+	}()
+}
+
+// Conecta-se a quem pediu o arquivo e o envia por essa conexão
+func serveReverse(token string, requesterIP string, hash string, parent p2p.SpanContext) {
+	conn, err := p2p.DialTimeout(requesterIP+clientPort, 10*time.Second)
+	if err != nil {
+		slog.Error("Erro na conexão reversa", "peer", requesterIP, "error", err)
+		return
+	}
+	defer conn.Close()
+	if !p2p.PeerHasRole(conn, p2p.RoleClient) {
+		return
+	}
+	slog.Info("Enviando por conexão reversa", "peer", requesterIP, "hash", hash)
+	fmt.Fprintf(conn, "PUSH %s %s\n", token, hash)
+	serveFile(conn, requesterIP, hash, parent)
+}
+
+// Conecta-se à retransmissão do super nó e atende por ela o pedido de quem baixa
+func serveRelay(token string, relayHost string, requesterIP string) {
+	conn, err := p2p.DialTimeout(relayHost+relayPort, 10*time.Second)
+	if err != nil {
+		slog.Error("Erro ao conectar à retransmissão", "addr", relayHost, "error", err)
+		return
+	}
+	fmt.Fprintf(conn, "RELAY %s\n", token)
+	peer := conn
+	if p2p.TLSConfig != nil {
+		peer = tls.Server(conn, p2p.TLSConfig)
+	}
+	slog.Info("Atendendo pela retransmissão do super nó", "peer", requesterIP, "addr", relayHost)
+	servePeer(peer, requesterIP)
+}
+
+func handleUserInteraction(session *superNodeSession) {
+	for {
+		// Permite que o usuário faça várias requisições enquanto a conexão está aberta
+		var choice int
+		fmt.Println("\nEscolha uma opção: 1 - Upload | 2 - Download | 3 - Compartilhar diretório | 4 - Assinar arquivo | 5 - Sair")
+		fmt.Scan(&choice)
+
+		if choice == 1 {
+			fmt.Println("Digite o caminho do arquivo para upload:")
+			var filePath string
+			fmt.Scan(&filePath)
+			fmt.Println("Visibilidade (public, private ou group:<grupo>):")
+			var fileVisibility string
+			fmt.Scan(&fileVisibility)
+			fmt.Println("Cifrar o conteúdo? (s/n):")
+			var encryptAnswer string
+			fmt.Scan(&encryptAnswer)
+			err := uploadFile(session, filePath, fileVisibility, encryptAnswer == "s")
+			if err != nil {
+				fmt.Println(err)
+			} else {
+				fmt.Println("Upload registrado com sucesso.")
+			}
+		} else if choice == 2 {
+			fmt.Println("Digite o nome ou o hash do arquivo para download:")
+			var fileName string
+			fmt.Scan(&fileName)
+			_, err := downloadFile(session, fileName)
+			if err != nil {
+				fmt.Println(err)
+				if errors.Is(err, errFileNotFound) {
+					fmt.Println("Use a opção 4 para ser avisado quando o arquivo aparecer.")
+				}
+			} else {
+				fmt.Println("Download concluído com sucesso.")
+			}
+		} else if choice == 3 {
+			fmt.Println("Digite o caminho do diretório a compartilhar:")
+			var dirPath string
+			fmt.Scan(&dirPath)
+			err := shareDirectory(session, dirPath)
+			if err != nil {
+				fmt.Println(err)
+			} else {
+				fmt.Println("Diretório compartilhado; alterações serão enviadas automaticamente.")
+			}
+		} else if choice == 4 {
+			fmt.Println("Assinar por nome, padrão (ex.: *.pdf) ou hash? (name, pattern ou hash):")
+			var kind string
+			fmt.Scan(&kind)
+			fmt.Println("Digite o valor:")
+			var value string
+			fmt.Scan(&value)
+			fmt.Println("Baixar automaticamente quando aparecer? (s/n):")
+			var autoAnswer string
+			fmt.Scan(&autoAnswer)
+			err := subscribe(session, kind, value, autoAnswer == "s")
+			if err != nil {
+				fmt.Println(err)
+			} else {
+				fmt.Println("Assinatura registrada; o aviso chega assim que o arquivo for publicado.")
+			}
+		} else if choice == 5 {
+			fmt.Println("Fechando a conexão e saindo...")
+			session.close()
+			break
+		} else {
+			fmt.Println("Opção inválida")
+		}
+	}
+}
+
+// Interface de terminal (-tui): tela cheia redesenhada a cada meio segundo
+// com o estado do super nó, as transferências, os arquivos publicados, os
+// resultados da última busca e as mensagens do programa. Os comandos são
+// digitados na última linha.
+func runTUI(session *superNodeSession) {
+	screen := os.Stdout
+	width, height := terminalSize()
+
+	// O log e as mensagens dos comandos vão para o painel, não para a tela
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	setupLogging(writer)
+	defer setupLogging(screen)
+	go collectMessages(reader)
+
+	fmt.Fprint(screen, "\x1b[?1049h\x1b[2J") // Tela alternativa, restaurada ao sair
+	defer fmt.Fprint(screen, "\x1b[?1049l")
+	tuiPrompt(screen, height)
+
+	input := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			input <- strings.TrimSpace(scanner.Text())
+		}
+		close(input)
+	}()
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case line, ok := <-input:
+			if !ok || line == "q" {
+				session.close()
+				return
+			}
+			handleTUICommand(session, line, writer)
+			tuiPrompt(screen, height)
+		case <-ticker.C:
+		}
+		renderTUI(screen, width, height)
+	}
+}
+
+// Tamanho do terminal pelas variáveis COLUMNS e LINES, com um padrão razoável
+func terminalSize() (int, int) {
+	width, height := 100, 32
+	if n, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && n >= 60 {
+		width = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("LINES")); err == nil && n >= 20 {
+		height = n
+	}
+	return width, height
+}
+
+func collectMessages(reader io.Reader) {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		tuiMu.Lock()
+		tuiMessages = append(tuiMessages, time.Now().Format("15:04:05")+" "+line)
+		if len(tuiMessages) > 200 {
+			tuiMessages = tuiMessages[len(tuiMessages)-200:]
+		}
+		tuiMu.Unlock()
+	}
+}
+
+// Limpa a linha de comando e deixa o cursor nela
+func tuiPrompt(screen io.Writer, height int) {
+	fmt.Fprintf(screen, "\x1b[%d;1H\x1b[K> ", height)
+}
+
+// Comandos: /<padrão> busca, g <nº|nome|hash> baixa, s <caminho> compartilha, q sai.
+// As mensagens vão para out, o painel de mensagens.
+func handleTUICommand(session *superNodeSession, line string, out io.Writer) {
+	switch {
+	case line == "":
+	case strings.HasPrefix(line, "/"):
+		pattern := strings.TrimSpace(strings.TrimPrefix(line, "/"))
+		go func() {
+			results, err := searchFiles(session, pattern)
+			if err != nil {
+				fmt.Fprintf(out, "Erro na busca por '%s': %v\n", pattern, err)
+				return
+			}
+			tuiMu.Lock()
+			tuiResults, tuiQuery = results, pattern
+			tuiMu.Unlock()
+			fmt.Fprintf(out, "Busca por '%s': %d resultado(s)\n", pattern, len(results))
+		}()
+	case strings.HasPrefix(line, "g "):
+		key := strings.TrimSpace(strings.TrimPrefix(line, "g "))
+		if n, err := strconv.Atoi(key); err == nil {
+			tuiMu.Lock()
+			if n >= 1 && n <= len(tuiResults) {
+				key = tuiResults[n-1].Hash
+			}
+			tuiMu.Unlock()
+		}
+		go func() {
+			if _, err := downloadFile(session, key); err != nil {
+				fmt.Fprintln(out, err)
+			}
+		}()
+	case strings.HasPrefix(line, "s "):
+		path := strings.TrimSpace(strings.TrimPrefix(line, "s "))
+		go func() {
+			info, err := os.Stat(path)
+			if err == nil && info.IsDir() {
+				err = shareDirectory(session, path)
+			} else if err == nil {
+				err = uploadFile(session, path, visibility, encrypt)
+			}
+			if err != nil {
+				fmt.Fprintln(out, err)
+			}
+		}()
+	default:
+		fmt.Fprintf(out, "Comando desconhecido: %s\n", line)
+	}
+}
+
+// Redesenha tudo acima da linha de comando, preservando o cursor onde o usuário digita
+func renderTUI(screen io.Writer, width int, height int) {
+	var lines []string
+	section := func(title string) {
+		title = truncate(title, width-8)
+		lines = append(lines, "\x1b[1m── "+title+" "+strings.Repeat("─", width-len([]rune(title))-4)+"\x1b[0m")
+	}
+
+	// Estado da sessão e velocidade total
+	state := "\x1b[32mconectado\x1b[0m"
+	if atomic.LoadInt32(&restoring) == 1 {
+		state = "\x1b[33mreconectando\x1b[0m"
+	}
+	user := userName
+	if user == "" {
+		user = "anônimo"
+	}
+	active := currentTransfers()
+	var up, down float64
+	for _, t := range active {
+		if finished, _ := t.status(); finished.IsZero() {
+			if t.Kind == "up" {
+				up += t.rate()
+			} else {
+				down += t.rate()
+			}
+		}
+	}
+	sharesMu.Lock()
+	shares := len(sharedFiles)
+	sharesMu.Unlock()
+	lines = append(lines, fmt.Sprintf("\x1b[1mP2P\x1b[0m  super nó %s (%s)  usuário %s  %d arquivo(s) publicados  ↑ %s/s  ↓ %s/s",
+		currentSuperNodeHost(), state, user, shares, formatBytes(int64(up)), formatBytes(int64(down))))
+
+	section("Transferências")
+	if len(active) == 0 {
+		lines = append(lines, "  nenhuma")
+	}
+	for _, t := range active {
+		lines = append(lines, formatTransfer(t, width))
+	}
+
+	tuiMu.Lock()
+	results, query := tuiResults, tuiQuery
+	messages := append([]string(nil), tuiMessages...)
+	tuiMu.Unlock()
+	if query != "" {
+		section(fmt.Sprintf("Busca '%s'", query))
+		for i, result := range results {
+			lines = append(lines, truncate(fmt.Sprintf("  %2d. %-40s %10s  %s  %d detentor(es)", i+1, result.Name, formatBytes(result.Size), result.Hash[:12], len(result.Holders)), width))
+		}
+		if len(results) == 0 {
+			lines = append(lines, "  nenhum resultado")
+		}
+	}
+
+	section("Arquivos publicados")
+	for _, share := range listShares() {
+		lines = append(lines, truncate(fmt.Sprintf("  %-40s %10s  %s  %s", share.Name, formatBytes(share.Size), share.Hash[:12], share.Visibility), width))
+	}
+
+	// As mensagens ocupam o espaço que sobrar, das mais recentes para trás
+	section("Mensagens")
+	help := "\x1b[2m/<padrão> buscar | g <nº|nome|hash> baixar | s <caminho> compartilhar | q sair\x1b[0m"
+	room := height - 2 - len(lines)
+	if room > 0 && len(messages) > room {
+		messages = messages[len(messages)-room:]
+	}
+	for _, message := range messages {
+		if room <= 0 {
+			break
+		}
+		lines = append(lines, truncate("  "+message, width))
+	}
+	if len(lines) > height-2 {
+		lines = lines[:height-2]
+	}
+	for len(lines) < height-2 {
+		lines = append(lines, "")
+	}
+	lines = append(lines, help)
+
+	var b strings.Builder
+	b.WriteString("\x1b7\x1b[H") // Guarda o cursor e vai para o topo
+	for _, line := range lines {
+		b.WriteString(line + "\x1b[K\r\n")
+	}
+	b.WriteString("\x1b8") // Volta o cursor para a linha de comando
+	fmt.Fprint(screen, b.String())
+}
+
+// Uma linha de transferência: direção, nome, outro cliente, barra, velocidade e tempo restante
+func formatTransfer(t *transfer, width int) string {
+	arrow := "↓"
+	if t.Kind == "up" {
+		arrow = "↑"
+	}
+	done := t.done()
+	fraction := 1.0
+	if done < t.Size {
+		fraction = float64(done) / float64(t.Size)
+	}
+	barWidth := 20
+	filled := int(fraction * float64(barWidth))
+	bar := strings.Repeat("█", filled) + strings.Repeat("░", barWidth-filled)
+
+	finished, failure := t.status()
+	var state, color, tail string
+	switch {
+	case failure != "":
+		state, color = "falhou", "\x1b[31m"
+	case !finished.IsZero():
+		state, color = "concluído", "\x1b[32m"
+		tail = " em " + finished.Sub(t.Started).Round(time.Second).String()
+	default:
+		eta := "--:--"
+		if speed := t.rate(); speed > 0 {
+			remaining := time.Duration(float64(t.Size-done)/speed) * time.Second
+			eta = fmt.Sprintf("%02d:%02d", int(remaining.Minutes()), int(remaining.Seconds())%60)
+		}
+		tail = fmt.Sprintf("%s/s  ETA %s", formatBytes(int64(t.rate())), eta)
+	}
+	name := truncate(t.Name, 30)
+	line := fmt.Sprintf("  %s %-30s %-15s %s %3.0f%%  %s/%s  ", arrow, name, t.Peer, bar, fraction*100, formatBytes(done), formatBytes(t.Size))
+
+	// Linhas mais largas que o terminal são cortadas sem cor, para que nenhuma
+	// sequência de escape fique pela metade
+	if len([]rune(line+state+tail)) > width {
+		return truncate(line+state+tail, width)
+	}
+	if color != "" {
+		state = color + state + "\x1b[0m"
+	}
+	return line + state + tail
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, exp := float64(n)/unit, 0
+	for value >= unit && exp < 3 {
+		value /= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGT"[exp])
+}
+
+func truncate(s string, width int) string {
+	runes := []rune(s)
+	if len(runes) <= width {
+		return s
+	}
+	if width < 2 {
+		return string(runes[:width])
+	}
+	return string(runes[:width-1]) + "…"
+}
+
+// Códigos de saída dos subcomandos
+const (
+	exitOK          = 0
+	exitFailure     = 1 // A operação falhou
+	exitUsage       = 2 // Subcomando ou argumentos inválidos
+	exitNotFound    = 3 // Nenhum arquivo encontrado
+	exitUnavailable = 4 // Super nó ou daemon indisponível
+)
+
+// Subcomando já interpretado; é o que a linha de comando envia ao daemon
+type commandRequest struct {
+	Command    string `json:"command"`
+	Target     string `json:"target,omitempty"` // Caminho, nome, hash ou padrão
+	Output     string `json:"output,omitempty"` // Destino de uma cópia do arquivo baixado (get -o)
+	Visibility string `json:"visibility,omitempty"`
+	Encrypt    bool   `json:"encrypt,omitempty"`
+	Detach     bool   `json:"-"`
+}
+
+// Resultado de um subcomando: o texto para o terminal e os dados para -json
+type commandResponse struct {
+	Code   int         `json:"code"`
+	Error  string      `json:"error,omitempty"`
+	Text   string      `json:"text,omitempty"`
+	Result interface{} `json:"result,omitempty"`
+}
+
+// Arquivo publicado, como listado por ls, share e get
+type shareInfo struct {
+	Name       string `json:"name"`
+	Path       string `json:"path"`
+	Hash       string `json:"hash"`
+	Size       int64  `json:"size"`
+	Visibility string `json:"visibility"`
+	Encrypted  bool   `json:"encrypted"`
+}
+
+// Conteúdo encontrado por search
+type searchResult struct {
+	Hash       string   `json:"hash"`
+	Size       int64    `json:"size"`
+	Name       string   `json:"name"`
+	Owner      string   `json:"owner"`
+	Visibility string   `json:"visibility"`
+	Holders    []string `json:"holders"`
+	Encrypted  bool     `json:"encrypted"`
+}
+
+// Estado da conexão e dos outros clientes com quem houve transferências (peers)
+type peersInfo struct {
+	SuperNode    string     `json:"supernode"`
+	Reconnecting bool       `json:"reconnecting"`
+	Shares       int        `json:"shares"`
+	Peers        []peerInfo `json:"peers"`
+}
+
+type peerInfo struct {
+	IP           string    `json:"ip"`
+	Sent         int64     `json:"sent"`
+	Received     int64     `json:"received"`
+	LastTransfer time.Time `json:"last_transfer"`
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Uso: client [opções] [subcomando]
+
+Sem subcomando, abre o menu interativo (com -tui, a interface de terminal). Subcomandos:
+  share <caminho> [-visibility v] [-encrypt]   publica um arquivo ou diretório (requer o daemon)
+  get <nome ou hash> [-o destino]              baixa um arquivo para a raiz compartilhada
+  search <padrão>                              busca arquivos pelo nome em todos os super nós (ex.: '*.pdf')
+  ls                                           lista os arquivos publicados pelo daemon
+  peers                                        mostra o super nó e os clientes com quem houve transferências
+  serve [-detach]                              executa o daemon, que atende os subcomandos pelo socket local
+
+Todos os subcomandos aceitam -json. Códigos de saída: 0 sucesso, 1 falha,
+2 uso inválido, 3 nada encontrado, 4 super nó ou daemon indisponível.
+
+Opções:
+`)
+	flag.PrintDefaults()
+}
+
+// Interpreta os argumentos de um subcomando; as opções podem vir antes ou
+// depois dos argumentos posicionais
+func parseCommand(args []string) (commandRequest, error) {
+	req := commandRequest{Command: args[0], Visibility: visibility, Encrypt: encrypt}
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	fs.BoolVar(&jsonOutput, "json", jsonOutput, "resultado em JSON")
+	expected := 0
+	switch req.Command {
+	case "share":
+		fs.StringVar(&req.Visibility, "visibility", req.Visibility, "public, private ou group:<grupo>")
+		fs.BoolVar(&req.Encrypt, "encrypt", req.Encrypt, "cifra o conteúdo")
+		expected = 1
+	case "get":
+		fs.StringVar(&req.Output, "o", "", "copia o arquivo baixado para este caminho")
+		expected = 1
+	case "search":
+		expected = 1
+	case "serve":
+		fs.BoolVar(&req.Detach, "detach", false, "executa o daemon em segundo plano")
+	case "ls", "peers":
+	default:
+		return req, fmt.Errorf("Subcomando desconhecido '%s'", req.Command)
+	}
+
+	var positional []string
+	rest := args[1:]
+	for {
+		if err := fs.Parse(rest); err != nil {
+			return req, err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		rest = fs.Args()[1:]
+	}
+	if len(positional) != expected {
+		return req, fmt.Errorf("'%s' espera %d argumento(s), recebeu %d", req.Command, expected, len(positional))
+	}
+	if expected == 1 {
+		req.Target = positional[0]
+	}
+
+	// Caminhos relativos são do diretório de quem chama, não do daemon
+	var err error
+	if req.Command == "share" {
+		req.Target, err = filepath.Abs(req.Target)
+	}
+	if req.Output != "" {
+		req.Output, err = filepath.Abs(req.Output)
+	}
+	return req, err
+}
+
+// Executa um subcomando e retorna o código de saída
+func runCommand(args []string) int {
+	req, err := parseCommand(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	// A saída padrão fica só com o resultado; as mensagens de andamento e o
+	// log (setupLogging) vão para stderr
+	if req.Command == "serve" {
+		if req.Detach {
+			return detachDaemon(os.Stderr)
+		}
+		return runDaemon(os.Stderr)
+	}
+
+	resp, ok := callDaemon(req)
+	if !ok {
+		switch req.Command {
+		case "share", "ls", "peers":
+			resp = commandResponse{Code: exitUnavailable, Error: fmt.Sprintf("Nenhum daemon em execução em %s; inicie-o com 'serve'", daemonSocket)}
+		default:
+			resp = runStandalone(req)
+		}
+	}
+
+	if jsonOutput {
+		resp.Text = ""
+		json.NewEncoder(os.Stdout).Encode(resp)
+	} else if resp.Error != "" {
+		fmt.Fprintln(os.Stderr, resp.Error)
+	} else if resp.Text != "" {
+		fmt.Fprint(os.Stdout, resp.Text)
+	}
+	return resp.Code
+}
+
+// Envia o subcomando ao daemon; retorna false se não há daemon no socket
+func callDaemon(req commandRequest) (commandResponse, bool) {
+	conn, err := net.Dial("unix", daemonSocket)
+	if err != nil {
+		return commandResponse{}, false
+	}
+	defer conn.Close()
+
+	var resp commandResponse
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return commandResponse{Code: exitFailure, Error: fmt.Sprintf("Erro ao enviar o pedido ao daemon: %v", err)}, true
+	}
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return commandResponse{Code: exitFailure, Error: fmt.Sprintf("Erro ao ler a resposta do daemon: %v", err)}, true
+	}
+	return resp, true
+}
+
+// Sem daemon, get e search abrem uma sessão própria com o super nó
+func runStandalone(req commandRequest) commandResponse {
+	go startClientServer() // Recebe conexões reversas de detentores atrás de NAT
+	session, err := connectSuperNode()
+	if err != nil {
+		return commandResponse{Code: exitUnavailable, Error: err.Error()}
+	}
+	defer session.close()
+	return executeCommand(session, req)
+}
+
+// Executa o subcomando com a sessão do daemon ou de uma execução avulsa
+func executeCommand(session *superNodeSession, req commandRequest) commandResponse {
+	switch req.Command {
+	case "share":
+		info, err := os.Stat(req.Target)
+		if err != nil {
+			return failedCommand(err)
+		}
+		if info.IsDir() {
+			// O diretório usa a visibilidade e a cifragem definidas ao iniciar o daemon
+			err = shareDirectory(session, req.Target)
+		} else {
+			err = uploadFile(session, req.Target, req.Visibility, req.Encrypt)
+		}
+		if err != nil {
+			return failedCommand(err)
+		}
+		var shares []shareInfo
+		for _, share := range listShares() {
+			if share.Path == req.Target || strings.HasPrefix(share.Path, req.Target+string(filepath.Separator)) {
+				shares = append(shares, share)
+			}
+		}
+		return commandResponse{Text: formatShares(shares), Result: shares}
+	case "get":
+		share, err := downloadFile(session, req.Target)
+		if err != nil {
+			return failedCommand(err)
+		}
+		path := share.Path
+		if req.Output != "" {
+			if path, err = copyDownload(share.Path, req.Output); err != nil {
+				return failedCommand(err)
+			}
+		}
+		return commandResponse{Text: path + "\n", Result: describeShare(share)}
+	case "search":
+		results, err := searchFiles(session, req.Target)
+		if err != nil {
+			return failedCommand(err)
+		}
+		if len(results) == 0 {
+			return commandResponse{Code: exitNotFound, Error: fmt.Sprintf("Nenhum arquivo corresponde a '%s'", req.Target), Result: results}
+		}
+		return commandResponse{Text: formatSearchResults(results), Result: results}
+	case "ls":
+		shares := listShares()
+		return commandResponse{Text: formatShares(shares), Result: shares}
+	case "peers":
+		info := currentPeers()
+		return commandResponse{Text: formatPeers(info), Result: info}
+	}
+	return commandResponse{Code: exitUsage, Error: fmt.Sprintf("Subcomando '%s' não é atendido pelo daemon", req.Command)}
+}
+
+func failedCommand(err error) commandResponse {
+	code := exitFailure
+	var peerErr *peerError
+	if errors.Is(err, errFileNotFound) || errors.Is(err, os.ErrNotExist) || (errors.As(err, &peerErr) && peerErr.Code == errNotFound) {
+		code = exitNotFound
+	}
+	return commandResponse{Code: code, Error: err.Error()}
+}
+
+// Copia o arquivo baixado para o destino de get -o; se o destino é um
+// diretório, a cópia mantém o nome. O original continua publicado.
+func copyDownload(source string, dest string) (string, error) {
+	if info, err := os.Stat(dest); err == nil && info.IsDir() {
+		dest = filepath.Join(dest, filepath.Base(source))
+	}
+	if dest == source {
+		return dest, nil
+	}
+	in, err := os.Open(source)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return "", fmt.Errorf("Erro ao criar '%s': %v", dest, err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return "", fmt.Errorf("Erro ao copiar para '%s': %v", dest, err)
+	}
+	return dest, out.Close()
+}
+
+// Busca por padrão de nome em todos os super nós (FIND)
+func searchFiles(session *superNodeSession, pattern string) ([]searchResult, error) {
+	sp := p2p.StartSpan("FIND", p2p.SpanClient, p2p.SpanContext{})
+	sp.Set("pattern", pattern)
+	lines, err := session.requestLines("FIND %s %s", encodeName(pattern), sp.Context.Traceparent())
+	sp.End(err)
+	if err != nil {
+		return nil, err
+	}
+	results := []searchResult{}
+	for _, line := range lines {
+		// FOUND <hash> <tamanho> <ip>[,<ip>...] <nome> <dono> <visibilidade> <cifragem>
+		parts := strings.Split(line, " ")
+		if len(parts) != 8 || parts[0] != "FOUND" || !isContentHash(parts[1]) {
+			continue
+		}
+		size, sizeErr := strconv.ParseInt(parts[2], 10, 64)
+		name, nameErr := url.QueryUnescape(parts[4])
+		owner, ownerErr := url.QueryUnescape(parts[5])
+		if sizeErr != nil || nameErr != nil || ownerErr != nil {
+			continue
+		}
+		results = append(results, searchResult{Hash: parts[1], Size: size, Name: name, Owner: owner, Visibility: parts[6],
+			Holders: strings.Split(parts[3], ","), Encrypted: strings.HasPrefix(parts[7], "enc:")})
+	}
+	return results, nil
+}
+
+func describeShare(share *sharedFile) shareInfo {
+	return shareInfo{Name: share.Name, Path: share.Path, Hash: share.Hash, Size: share.Size, Visibility: share.Visibility, Encrypted: share.Key != nil}
+}
+
+// Arquivos publicados, em ordem de caminho
+func listShares() []shareInfo {
+	sharesMu.Lock()
+	shares := make([]shareInfo, 0, len(sharedFiles))
+	for _, share := range sharedFiles {
+		shares = append(shares, describeShare(share))
+	}
+	sharesMu.Unlock()
+	sort.Slice(shares, func(i, j int) bool { return shares[i].Path < shares[j].Path })
+	return shares
+}
+
+func currentPeers() peersInfo {
+	info := peersInfo{SuperNode: currentSuperNodeHost(), Reconnecting: atomic.LoadInt32(&restoring) == 1, Peers: []peerInfo{}}
+	sharesMu.Lock()
+	info.Shares = len(sharedFiles)
+	sharesMu.Unlock()
+	peersMu.Lock()
+	for _, peer := range peers {
+		info.Peers = append(info.Peers, *peer)
+	}
+	peersMu.Unlock()
+	sort.Slice(info.Peers, func(i, j int) bool { return info.Peers[i].LastTransfer.After(info.Peers[j].LastTransfer) })
+	return info
+}
+
+func formatShares(shares []shareInfo) string {
+	var b strings.Builder
+	for _, share := range shares {
+		fmt.Fprintf(&b, "%s  %10d  %-12s  %s\n", share.Hash, share.Size, share.Visibility, share.Path)
+	}
+	return b.String()
+}
+
+func formatSearchResults(results []searchResult) string {
+	var b strings.Builder
+	for _, result := range results {
+		encrypted := ""
+		if result.Encrypted {
+			encrypted = " (cifrado)"
+		}
+		fmt.Fprintf(&b, "%s  %10d  %s%s  [%s]\n", result.Hash, result.Size, result.Name, encrypted, strings.Join(result.Holders, ","))
+	}
+	return b.String()
+}
+
+func formatPeers(info peersInfo) string {
+	var b strings.Builder
+	state := "conectado"
+	if info.Reconnecting {
+		state = "reconectando"
+	}
+	fmt.Fprintf(&b, "Super nó %s (%s), %d arquivo(s) publicados\n", info.SuperNode, state, info.Shares)
+	for _, peer := range info.Peers {
+		fmt.Fprintf(&b, "%-15s  enviados %d  recebidos %d  última transferência %s\n", peer.IP, peer.Sent, peer.Received, peer.LastTransfer.Format(time.RFC3339))
+	}
+	return b.String()
+}
+
+// Socket do daemon num diretório só do usuário: o de execução
+// ($XDG_RUNTIME_DIR) ou, sem ele, um diretório por usuário no temporário
+func defaultDaemonSocket() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "p2p-client.sock")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("p2p-client-%d", os.Getuid()), "p2p-client.sock")
+}
+
+// Cria o diretório do socket (0700) e remove o socket deixado por um daemon
+// que não terminou direito. Só é removido um socket num diretório que
+// outros usuários não podem alterar; qualquer outro arquivo é mantido.
+func prepareDaemonSocket() error {
+	dir := filepath.Dir(daemonSocket)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("Erro ao criar o diretório do socket '%s': %v", dir, err)
+	}
+	info, err := os.Lstat(daemonSocket)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("'%s' existe e não é um socket; não será removido", daemonSocket)
+	}
+	dirInfo, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !dirInfo.IsDir() || dirInfo.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("O socket '%s' está num diretório que outros usuários podem alterar; remova-o manualmente ou use -socket", daemonSocket)
+	}
+	return os.Remove(daemonSocket)
+}
+
+// Executa o daemon: mantém a sessão com o super nó, serve arquivos aos outros
+// clientes e atende os subcomandos pelo socket local até receber SIGINT ou SIGTERM.
+// As mensagens de andamento vão para out.
+func runDaemon(out io.Writer) int {
+	if conn, err := net.Dial("unix", daemonSocket); err == nil {
+		conn.Close()
+		fmt.Fprintf(out, "Já há um daemon em execução em %s\n", daemonSocket)
+		return exitFailure
+	}
+	if err := prepareDaemonSocket(); err != nil {
+		fmt.Fprintln(out, err)
+		return exitFailure
+	}
+
+	go startClientServer()
+	session, err := startSession()
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return exitUnavailable
+	}
+	defer session.close()
+
+	ln, err := net.Listen("unix", daemonSocket)
+	if err != nil {
+		slog.Error("Erro ao abrir o socket do daemon", "error", err)
+		return exitFailure
+	}
+	defer os.Remove(daemonSocket)
+	slog.Info("Daemon atendendo subcomandos", "socket", daemonSocket)
+
+	// SIGINT ou SIGTERM fecham o socket; main exporta os spans pendentes ao sair
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupt
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			slog.Info("Encerrando o daemon")
+			return exitOK
+		}
+		go serveCommand(session, conn)
+	}
+}
+
+// Atende um subcomando recebido pelo socket do daemon
+func serveCommand(session *superNodeSession, conn net.Conn) {
+	defer conn.Close()
+	var req commandRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		slog.Warn("Pedido inválido no socket do daemon", "error", err)
+		return
+	}
+	slog.Info("Subcomando recebido", "command", req.Command, "target", req.Target)
+	json.NewEncoder(conn).Encode(executeCommand(session, req))
+}
+
+// Inicia o daemon em segundo plano, com a saída gravada ao lado do socket, e
+// espera o socket ficar disponível. As mensagens de andamento vão para out.
+func detachDaemon(out io.Writer) int {
+	var args []string
+	for _, arg := range os.Args[1:] {
+		if arg != "-detach" && arg != "--detach" && arg != "-detach=true" && arg != "--detach=true" {
+			args = append(args, arg)
+		}
+	}
+	logPath := strings.TrimSuffix(daemonSocket, ".sock") + ".log"
+	if err := os.MkdirAll(filepath.Dir(logPath), 0700); err != nil {
+		fmt.Fprintln(out, "Erro ao criar o diretório do daemon:", err)
+		return exitFailure
+	}
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		fmt.Fprintln(out, "Erro ao abrir o log do daemon:", err)
+		return exitFailure
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Stdout, cmd.Stderr = logFile, logFile
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintln(out, "Erro ao iniciar o daemon:", err)
+		return exitFailure
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	for deadline := time.Now().Add(15 * time.Second); time.Now().Before(deadline); {
+		select {
+		case <-exited:
+			fmt.Fprintf(out, "O daemon terminou ao iniciar; veja %s\n", logPath)
+			return exitFailure
+		case <-time.After(200 * time.Millisecond):
+		}
+		if conn, err := net.Dial("unix", daemonSocket); err == nil {
+			conn.Close()
+			fmt.Fprintf(out, "Daemon iniciado (pid %d); log em %s\n", cmd.Process.Pid, logPath)
+			return exitOK
+		}
+	}
+	fmt.Fprintf(out, "O daemon não abriu o socket %s a tempo; veja %s\n", daemonSocket, logPath)
+	return exitUnavailable
+}
+
+// Métricas expostas em /metrics com -metrics
+var (
+	metricsTopPeers = 20 // Clientes com série própria em p2p_peer_bytes
+
+	bytesServed        = p2p.NewMetric("p2p_bytes_served_total", "counter", "Bytes enviados a outros clientes")
+	bytesReceived      = p2p.NewMetric("p2p_bytes_received_total", "counter", "Bytes recebidos de outros clientes")
+	transfersTotal     = p2p.NewMetric("p2p_transfers_total", "counter", "Transferências encerradas, por direção e resultado")
+	peerBytes          = p2p.NewMetric("p2p_peer_bytes", "gauge", "Bytes de transferências concluídas, por cliente e direção")
+	activeTransfers    = p2p.NewMetric("p2p_active_transfers", "gauge", "Transferências em andamento, por direção")
+	sharedFilesGauge   = p2p.NewMetric("p2p_shared_files", "gauge", "Arquivos publicados")
+	uploadQueueGauge   = p2p.NewMetric("p2p_upload_queue_length", "gauge", "Pedidos esperando uma vaga de envio")
+	superNodeConnected = p2p.NewMetric("p2p_supernode_connected", "gauge", "1 se a sessão com o super nó está ativa, 0 durante a reconexão")
+	requestDuration    = p2p.NewMetric("p2p_supernode_request_duration_seconds", "histogram", "Duração das requisições ao super nó, por comando")
+)
+
+// Atualiza as métricas que refletem o estado atual, antes de cada coleta
+func collectGauges() {
+	up, down := 0, 0
+	for _, t := range currentTransfers() {
+		if finished, _ := t.status(); finished.IsZero() {
+			if t.Kind == "up" {
+				up++
+			} else {
+				down++
+			}
+		}
+	}
+	activeTransfers.Set(`direction="up"`, float64(up))
+	activeTransfers.Set(`direction="down"`, float64(down))
+
+	sharesMu.Lock()
+	sharedFilesGauge.Set("", float64(len(sharedFiles)))
+	sharesMu.Unlock()
+	uploads.mu.Lock()
+	uploadQueueGauge.Set("", float64(len(uploads.queue)))
+	uploads.mu.Unlock()
+	connected := 1.0
+	if atomic.LoadInt32(&restoring) == 1 {
+		connected = 0
+	}
+	superNodeConnected.Set("", connected)
+
+	sent := make(map[string]float64)
+	received := make(map[string]float64)
+	peersMu.Lock()
+	for ip, peer := range peers {
+		sent[ip] = float64(peer.Sent)
+		received[ip] = float64(peer.Received)
+	}
+	peersMu.Unlock()
+	peerBytes.Reset()
+	peerBytes.SetTop("peer", sent, metricsTopPeers, `direction="up"`)
+	peerBytes.SetTop("peer", received, metricsTopPeers, `direction="down"`)
+}
+
+// Configura o log estruturado (log/slog) conforme -log-level e -log-format,
+// escrito em out; cada linha leva o papel e a identidade do cliente (usuário
+// ou nome da máquina)
+func setupLogging(out io.Writer) error {
+	handler, err := p2p.NewLogHandler(out, logLevel, logFormat)
+	if err != nil {
+		return err
+	}
+	node := userName
+	if node == "" {
+		node, _ = os.Hostname()
+	}
+	slog.SetDefault(slog.New(handler).With("role", "client", "node", node))
+	p2p.SetTraceService("p2p-client", node)
+	return nil
+}
+
+// Servidor HTTP só com /metrics, no formato de texto do Prometheus
+func startMetricsServer() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		collectGauges()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		p2p.WriteMetrics(w)
+	})
+	slog.Info("Métricas no ar", "url", "http://"+metricsAddr+"/metrics")
+	if err := http.ListenAndServe(metricsAddr, mux); err != nil {
+		slog.Error("Erro no servidor de métricas", "error", err)
+	}
+}
+
+func startClientServer() {
+	ln, err := p2p.Listen(clientPort) // Escutando na porta 8082
+	if err != nil {
+		slog.Error("Erro ao iniciar o servidor do cliente", "error", err)
+		return
+	}
+	defer ln.Close()
+	slog.Info("Cliente aguardando pedidos de outros clientes", "port", clientPort)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			slog.Error("Erro ao aceitar conexão de outro cliente", "error", err)
+			continue
+		}
+
+		go handleClientRequest(conn) // Lida com a requisição de outro cliente em uma goroutine
+	}
+}
+
+func main() {
+	flag.StringVar(&shareRoot, "share-root", shareRoot, "raiz fora da qual nenhum arquivo é compartilhado nem servido")
+	flag.StringVar(&userName, "user", userName, "usuário para autenticar no super nó")
+	flag.StringVar(&userToken, "token", os.Getenv("P2P_TOKEN"), "token do usuário (padrão: variável P2P_TOKEN)")
+	flag.StringVar(&visibility, "visibility", visibility, "visibilidade dos arquivos do diretório compartilhado: public, private ou group:<grupo>")
+	flag.StringVar(&shareDir, "share-dir", shareDir, "diretório compartilhado e sincronizado com o super nó")
+	flag.BoolVar(&encrypt, "encrypt", encrypt, "cifra o conteúdo dos arquivos do diretório compartilhado")
+	flag.IntVar(&uploadLimit, "upload-limit", uploadLimit, "limite total de envio em KiB/s (0 = sem limite)")
+	flag.IntVar(&downloadLimit, "download-limit", downloadLimit, "limite total de recebimento em KiB/s (0 = sem limite)")
+	flag.IntVar(&peerUploadLimit, "peer-upload-limit", peerUploadLimit, "limite de envio para cada cliente em KiB/s (0 = sem limite)")
+	flag.IntVar(&peerDownloadLimit, "peer-download-limit", peerDownloadLimit, "limite de recebimento de cada cliente em KiB/s (0 = sem limite)")
+	flag.IntVar(&maxUploadSlots, "upload-slots", maxUploadSlots, "envios simultâneos; os demais pedidos esperam na fila (0 = sem limite)")
+	flag.IntVar(&maxUploadQueue, "upload-queue", maxUploadQueue, "tamanho máximo da fila de envio")
+	flag.StringVar(&p2p.TLSCAFile, "tls-ca", p2p.TLSCAFile, "certificado da CA do cluster (habilita TLS mútuo com -tls-cert e -tls-key)")
+	flag.StringVar(&p2p.TLSCertFile, "tls-cert", p2p.TLSCertFile, "certificado deste cliente, com OU \""+p2p.RoleClient+"\"")
+	flag.StringVar(&p2p.TLSKeyFile, "tls-key", p2p.TLSKeyFile, "chave privada do certificado deste cliente")
+	flag.StringVar(&p2p.TLSTestDir, "tls-test", p2p.TLSTestDir, "modo de teste: emite o certificado com a CA de clientes deste diretório (criada por um super nó com -tls-test)")
+	flag.StringVar(&superNodeHost, "supernode", superNodeHost, "IP do super nó")
+	flag.BoolVar(&jsonOutput, "json", jsonOutput, "resultado dos subcomandos em JSON")
+	flag.StringVar(&daemonSocket, "socket", daemonSocket, "socket local por onde os subcomandos falam com o daemon")
+	flag.BoolVar(&tuiMode, "tui", tuiMode, "interface de terminal em tela cheia, com o progresso das transferências")
+	flag.StringVar(&metricsAddr, "metrics", metricsAddr, "endereço onde servir as métricas do Prometheus em /metrics (ex.: 127.0.0.1:9108; vazio desativa)")
+	flag.StringVar(&logLevel, "log-level", logLevel, "nível mínimo do log: debug, info, warn ou error")
+	flag.StringVar(&logFormat, "log-format", logFormat, "formato do log: text ou json")
+	flag.StringVar(&p2p.TraceFile, "trace-file", p2p.TraceFile, "arquivo onde gravar os spans do rastreamento em OTLP/JSON (vazio desativa)")
+	flag.StringVar(&p2p.TraceEndpoint, "trace-endpoint", p2p.TraceEndpoint, "coletor OTLP/HTTP que recebe os spans (ex.: http://127.0.0.1:4318/v1/traces)")
+	flag.Usage = usage
+	flag.Parse()
+
+	// Com subcomando, a saída padrão fica só com o resultado
+	var logOutput io.Writer = os.Stdout
+	if flag.NArg() > 0 {
+		logOutput = os.Stderr
+	}
+	if err := setupLogging(logOutput); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitUsage)
+	}
+
+	uploadLimiter = p2p.NewRateLimiter(uploadLimit)
+	downloadLimiter = p2p.NewRateLimiter(downloadLimit)
+
+	if err := p2p.SetupTLS(p2p.RoleClient, userName); err != nil {
+		slog.Error("Erro ao configurar TLS", "error", err)
+		if flag.NArg() > 0 {
+			os.Exit(exitFailure)
+		}
+		return
+	}
+
+	if metricsAddr != "" {
+		go startMetricsServer()
+	}
+	if p2p.TraceFile != "" || p2p.TraceEndpoint != "" {
+		go p2p.ExportSpans()
+		defer p2p.FlushSpans()
+	}
+
+	// Com subcomando o cliente executa a operação (ou a pede ao daemon) e sai;
+	// os spans pendentes são exportados antes da saída
+	if flag.NArg() > 0 {
+		code := runCommand(flag.Args())
+		p2p.FlushSpans()
+		os.Exit(code)
+	}
+
+	// Inicia o servidor do cliente em uma goroutine
+	go startClientServer()
+
+	session, err := startSession()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	// Inicia o loop de interação com o usuário
+	if tuiMode {
+		runTUI(session)
+	} else {
+		handleUserInteraction(session)
+	}
+}
+
+// Conecta e autentica no super nó
+func connectSuperNode() (*superNodeSession, error) {
+	superNodeConn, err := p2p.Dial(currentSuperNodeHost() + supernoPort)
+	if err != nil {
+		return nil, fmt.Errorf("Erro ao conectar ao super nó: %v", err)
+	}
+
+	slog.Info("Conexão estabelecida com o super nó", "addr", currentSuperNodeHost())
+	session := newSuperNodeSession(superNodeConn)
+	activeSession = session
+
+	if userName != "" && userToken != "" {
+		if err := authenticate(session); err != nil {
+			superNodeConn.Close()
+			return nil, err
+		}
+	}
+	return session, nil
+}
+
+// Abre a sessão de longa duração do menu e do daemon: canal de controle,
+// PINGs, token para retomar a sessão e o diretório compartilhado
+func startSession() (*superNodeSession, error) {
+	session, err := connectSuperNode()
+	if err != nil {
+		return nil, err
+	}
+	requestSessionToken(session)
+	go runControlChannel()
+	go keepSessionAlive(session)
+
+	if shareDir != "" {
+		if err := shareDirectory(session, shareDir); err != nil {
+			slog.Error("Erro ao compartilhar o diretório", "dir", shareDir, "error", err)
+		}
+	}
+	return session, nil
+}
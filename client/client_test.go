@@ -0,0 +1,659 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vinibalbino/trabalho-p2p-ppd/p2p"
+)
+
+func testContentKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestEncryptDecryptRoundTrip(t *testing.T) {
+	key := testContentKey(t)
+	sizes := []int{0, 1, encryptedChunkSize - 1, encryptedChunkSize, encryptedChunkSize + 1, 2*encryptedChunkSize + 5}
+	for _, size := range sizes {
+		plain := make([]byte, size)
+		rand.Read(plain)
+
+		var sealed bytes.Buffer
+		if err := encryptStream(&sealed, bytes.NewReader(plain), key, nil); err != nil {
+			t.Fatalf("tamanho %d: %v", size, err)
+		}
+		if int64(sealed.Len()) != encryptedSize(int64(size)) {
+			t.Errorf("tamanho %d: texto cifrado com %d bytes, esperado %d", size, sealed.Len(), encryptedSize(int64(size)))
+		}
+
+		// A mesma chave gera sempre o mesmo texto cifrado, então o hash publicado confere
+		var again bytes.Buffer
+		if err := encryptStream(&again, bytes.NewReader(plain), key, nil); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(sealed.Bytes(), again.Bytes()) {
+			t.Errorf("tamanho %d: cifragem não é determinística", size)
+		}
+
+		var opened bytes.Buffer
+		if err := decryptStream(&opened, bytes.NewReader(sealed.Bytes()), key, nil); err != nil {
+			t.Fatalf("tamanho %d: %v", size, err)
+		}
+		if !bytes.Equal(opened.Bytes(), plain) {
+			t.Errorf("tamanho %d: conteúdo decifrado difere do original", size)
+		}
+	}
+}
+
+// Os nonces por índice e a marca do último bloco impedem reordenar, truncar ou alterar blocos
+func TestDecryptRejectsTampering(t *testing.T) {
+	key := testContentKey(t)
+	plain := make([]byte, 3*encryptedChunkSize)
+	rand.Read(plain)
+	var sealed bytes.Buffer
+	if err := encryptStream(&sealed, bytes.NewReader(plain), key, nil); err != nil {
+		t.Fatal(err)
+	}
+	block := encryptedChunkSize + 16
+	data := sealed.Bytes()
+
+	swapped := append(append(append([]byte{}, data[block:2*block]...), data[:block]...), data[2*block:]...)
+	flipped := append([]byte{}, data...)
+	flipped[10] ^= 1
+
+	tests := []struct {
+		name string
+		data []byte
+		key  []byte
+	}{
+		{"blocos trocados", swapped, key},
+		{"truncado no fim de um bloco", data[:2*block], key},
+		{"truncado no meio", data[:block+100], key},
+		{"byte alterado", flipped, key},
+		{"outra chave", data, testContentKey(t)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var opened bytes.Buffer
+			if err := decryptStream(&opened, bytes.NewReader(tt.data), tt.key, nil); err == nil {
+				t.Error("conteúdo adulterado foi aceito")
+			}
+		})
+	}
+}
+
+func TestChunkNonce(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, index := range []uint64{0, 1, 2, 1 << 32, 1<<64 - 1} {
+		nonce := chunkNonce(index)
+		if len(nonce) != 12 {
+			t.Fatalf("nonce com %d bytes, esperado 12", len(nonce))
+		}
+		if seen[string(nonce)] {
+			t.Errorf("nonce repetido para o índice %d", index)
+		}
+		seen[string(nonce)] = true
+	}
+}
+
+// Um arquivo reescrito no lugar, com o mesmo tamanho e a mesma data, não é
+// cifrado de novo com a chave publicada: o envio para antes do bloco alterado
+func TestServeStopsAtChangedChunk(t *testing.T) {
+	plain := make([]byte, 3*encryptedChunkSize)
+	rand.Read(plain)
+	path := filepath.Join(t.TempDir(), "a.bin")
+	if err := os.WriteFile(path, plain, 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	share, err := newShare(path, info, "public", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(share.ChunkHashes) != 3 {
+		t.Fatalf("%d hashes de bloco, esperado 3", len(share.ChunkHashes))
+	}
+	block := encryptedChunkSize + 16
+
+	tests := []struct {
+		name    string
+		content []byte
+		sent    int // bytes cifrados enviados antes de parar
+	}{
+		{"sem alteração", plain, 3 * block},
+		{"segundo bloco alterado", append(append(append([]byte{}, plain[:encryptedChunkSize]...), make([]byte, encryptedChunkSize)...), plain[2*encryptedChunkSize:]...), block},
+		{"truncado no fim de um bloco", plain[:2*encryptedChunkSize], block},
+		{"bloco a mais", append(append([]byte{}, plain...), 1), 2 * block},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := os.WriteFile(path, tt.content, 0644); err != nil {
+				t.Fatal(err)
+			}
+			os.Chtimes(path, time.Now(), info.ModTime())
+			file, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			var sent bytes.Buffer
+			err = encryptStream(&sent, file, share.Key, share.checkChunk)
+			if changed := !bytes.Equal(tt.content, plain); changed != errors.Is(err, errContentChanged) {
+				t.Errorf("erro = %v, alterado = %v", err, changed)
+			}
+			if sent.Len() != tt.sent {
+				t.Errorf("%d bytes enviados, esperado %d", sent.Len(), tt.sent)
+			}
+		})
+	}
+}
+
+// A cópia baixada guarda os hashes dos blocos e pode ser servida com a mesma chave
+func TestDecryptFileRecordsChunks(t *testing.T) {
+	key := testContentKey(t)
+	plain := make([]byte, encryptedChunkSize+10)
+	rand.Read(plain)
+	dir := t.TempDir()
+	var sealed bytes.Buffer
+	var published [][32]byte
+	if err := encryptStream(&sealed, bytes.NewReader(plain), key, recordChunks(&published)); err != nil {
+		t.Fatal(err)
+	}
+	encryptedPath := filepath.Join(dir, "a.enc")
+	if err := os.WriteFile(encryptedPath, sealed.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, size, chunks, err := decryptFile(encryptedPath, filepath.Join(dir, "a.bin"), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(plain)) || len(chunks) != len(published) {
+		t.Fatalf("tamanho %d com %d blocos, esperado %d com %d", size, len(chunks), len(plain), len(published))
+	}
+	copyShare := &sharedFile{Key: key, ChunkHashes: chunks}
+	var served bytes.Buffer
+	if err := encryptStream(&served, bytes.NewReader(plain), key, copyShare.checkChunk); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(served.Bytes(), sealed.Bytes()) {
+		t.Error("a cópia não é servida com o mesmo texto cifrado do dono")
+	}
+}
+
+func TestHasDotDot(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"..", true},
+		{"a/../b", true},
+		{"../etc/passwd", true},
+		{"a\\..\\b", true},
+		{"a/..", true},
+		{"a..b", false},
+		{"...", false},
+		{"a/b.txt", false},
+		{"%2e%2e/etc", false}, // só é verificado depois de decodificado
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := hasDotDot(tt.path); got != tt.want {
+				t.Errorf("hasDotDot(%q) = %v, esperado %v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+// Caminhos absolutos ou com "..", mesmo codificados, são recusados antes de qualquer busca
+func TestServeFileRejectsPaths(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+	}{
+		{"ponto ponto", "../segredo.txt"},
+		{"ponto ponto no meio", "a/../../segredo.txt"},
+		{"ponto ponto codificado", "%2e%2e%2fsegredo.txt"},
+		{"barra codificada", "..%2Fsegredo.txt"},
+		{"absoluto", "%2Fetc%2Fpasswd"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer client.Close()
+			go func() {
+				defer server.Close()
+				serveFile(server, "10.0.0.2", tt.key, p2p.SpanContext{})
+			}()
+			line, err := bufio.NewReader(client).ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(line, "ERROR 403 ") {
+				t.Errorf("resposta %q, esperado ERROR 403", line)
+			}
+		})
+	}
+}
+
+func TestResolveSharePath(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "raiz")
+	outside := filepath.Join(base, "fora.txt")
+	inside := filepath.Join(root, "a.txt")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{outside, inside} {
+		if err := os.WriteFile(path, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "fora")); err != nil {
+		t.Skipf("links simbólicos indisponíveis: %v", err)
+	}
+	if err := os.Symlink(inside, filepath.Join(root, "dentro")); err != nil {
+		t.Fatal(err)
+	}
+	previous := shareRoot
+	shareRoot = root
+	t.Cleanup(func() { shareRoot = previous })
+
+	tests := []struct {
+		name string
+		path string
+		ok   bool
+	}{
+		{"arquivo na raiz", inside, true},
+		{"a própria raiz", root, true},
+		{"link para dentro da raiz", filepath.Join(root, "dentro"), true},
+		{"link para fora da raiz", filepath.Join(root, "fora"), false},
+		{"ponto ponto", filepath.Join(root, "..", "fora.txt"), false},
+		{"absoluto fora da raiz", outside, false},
+		{"inexistente", filepath.Join(root, "nada.txt"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := resolveSharePath(tt.path)
+			if (err == nil) != tt.ok {
+				t.Errorf("resolveSharePath(%q) erro = %v, esperado ok = %v", tt.path, err, tt.ok)
+			}
+		})
+	}
+}
+
+// Conexão falsa que só registra o que foi escrito
+type testConn struct {
+	net.Conn
+	mu  sync.Mutex
+	out strings.Builder
+}
+
+func (c *testConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.out.Write(p)
+}
+
+func (c *testConn) output() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.out.String()
+}
+
+func waitUntil(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condição não atingida")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// A fila põe na frente a maior razão e, entre razões iguais, quem chegou antes;
+// cada pedido recebe a sua posição e a fila cheia recusa novos pedidos
+func TestUploadSlotsQueue(t *testing.T) {
+	previousSlots, previousQueue := maxUploadSlots, maxUploadQueue
+	maxUploadSlots, maxUploadQueue = 1, 3
+	t.Cleanup(func() { maxUploadSlots, maxUploadQueue = previousSlots, previousQueue })
+	ratiosMu.Lock()
+	for ip, ratio := range map[string]float64{"b": 0.5, "c": 2, "d": 1, "e": 0.5} {
+		ratios[ip] = cachedRatio{Ratio: ratio, At: time.Now()}
+	}
+	ratiosMu.Unlock()
+
+	var u uploadSlots
+	if !u.acquire(&testConn{}, "a") {
+		t.Fatal("vaga livre não foi ocupada")
+	}
+
+	granted := make(chan string, 3)
+	conns := make(map[string]*testConn)
+	arrivals := []struct {
+		peer     string
+		position string
+	}{{"b", "QUEUED 1\n"}, {"c", "QUEUED 1\n"}, {"e", "QUEUED 3\n"}}
+	for _, arrival := range arrivals {
+		conn := &testConn{}
+		conns[arrival.peer] = conn
+		go func(peer string) {
+			if u.acquire(conn, peer) {
+				granted <- peer
+			}
+		}(arrival.peer)
+		waitUntil(t, func() bool { return conn.output() != "" })
+		if got := conn.output(); got != arrival.position {
+			t.Errorf("%s recebeu %q, esperado %q", arrival.peer, got, arrival.position)
+		}
+	}
+	var order []string
+	u.mu.Lock()
+	for _, entry := range u.queue {
+		order = append(order, entry.peer)
+	}
+	u.mu.Unlock()
+	if strings.Join(order, ",") != "c,b,e" {
+		t.Errorf("fila %v, esperado [c b e]", order)
+	}
+	// Quem foi ultrapassado é avisado da nova posição
+	waitUntil(t, func() bool { return conns["b"].output() == "QUEUED 1\nQUEUED 2\n" })
+
+	full := &testConn{}
+	if u.acquire(full, "d") {
+		t.Error("pedido aceito com a fila cheia")
+	}
+	if got := full.output(); !strings.HasPrefix(got, "ERROR 503 ") {
+		t.Errorf("fila cheia respondeu %q", got)
+	}
+
+	for _, want := range []string{"c", "b", "e"} {
+		u.release()
+		if got := <-granted; got != want {
+			t.Errorf("vaga entregue a %s, esperado %s", got, want)
+		}
+	}
+	u.release()
+	if u.active != 0 || len(u.queue) != 0 {
+		t.Errorf("%d vagas ocupadas e %d na fila depois de liberar todas", u.active, len(u.queue))
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		args []string
+		want commandRequest
+		ok   bool
+	}{
+		{"opção antes do argumento", []string{"get", "-o", "saida", "a.txt"},
+			commandRequest{Command: "get", Target: "a.txt", Output: filepath.Join(dir, "saida"), Visibility: "public"}, true},
+		{"opção depois do argumento", []string{"get", "a.txt", "-o", "saida"},
+			commandRequest{Command: "get", Target: "a.txt", Output: filepath.Join(dir, "saida"), Visibility: "public"}, true},
+		{"share com caminho relativo", []string{"share", "docs", "-visibility", "private", "-encrypt"},
+			commandRequest{Command: "share", Target: filepath.Join(dir, "docs"), Visibility: "private", Encrypt: true}, true},
+		{"search", []string{"search", "*.pdf"}, commandRequest{Command: "search", Target: "*.pdf", Visibility: "public"}, true},
+		{"ls sem argumentos", []string{"ls"}, commandRequest{Command: "ls", Visibility: "public"}, true},
+		{"serve -detach", []string{"serve", "-detach"}, commandRequest{Command: "serve", Visibility: "public", Detach: true}, true},
+		{"get sem argumento", []string{"get"}, commandRequest{}, false},
+		{"get com dois argumentos", []string{"get", "a.txt", "b.txt"}, commandRequest{}, false},
+		{"ls com argumento", []string{"ls", "a.txt"}, commandRequest{}, false},
+		{"opção de outro subcomando", []string{"search", "a", "-o", "saida"}, commandRequest{}, false},
+		{"subcomando desconhecido", []string{"rm", "a.txt"}, commandRequest{}, false},
+	}
+	previous := jsonOutput
+	t.Cleanup(func() { jsonOutput = previous })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCommand(tt.args)
+			if (err == nil) != tt.ok {
+				t.Fatalf("parseCommand(%q) erro = %v, esperado ok = %v", tt.args, err, tt.ok)
+			}
+			if tt.ok && got != tt.want {
+				t.Errorf("parseCommand(%q) = %+v, esperado %+v", tt.args, got, tt.want)
+			}
+		})
+	}
+
+	jsonOutput = false
+	if _, err := parseCommand([]string{"ls", "-json"}); err != nil || !jsonOutput {
+		t.Errorf("-json depois do subcomando: erro %v, jsonOutput = %v", err, jsonOutput)
+	}
+}
+
+// Super nó falso: responde a cada comando com as linhas devolvidas por reply
+func fakeSuperNode(t *testing.T, reply func(command string) []string) *superNodeSession {
+	t.Helper()
+	server, client := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go func() {
+		defer server.Close()
+		reader := bufio.NewReader(server)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			for _, response := range reply(strings.TrimSpace(line)) {
+				fmt.Fprintf(server, "%s\n", response)
+			}
+		}
+	}()
+	return newSuperNodeSession(client)
+}
+
+func TestExecuteCommand(t *testing.T) {
+	hash := strings.Repeat("ab", 32)
+	session := fakeSuperNode(t, func(command string) []string {
+		if strings.HasPrefix(command, "FIND nada") {
+			return []string{"END"}
+		}
+		return []string{"FOUND " + hash + " 10 10.0.0.1,10.0.0.2 a.txt alice public plain", "END"}
+	})
+
+	tests := []struct {
+		name string
+		req  commandRequest
+		code int
+	}{
+		{"busca com resultado", commandRequest{Command: "search", Target: "a*"}, exitOK},
+		{"busca sem resultado", commandRequest{Command: "search", Target: "nada"}, exitNotFound},
+		{"share de arquivo inexistente", commandRequest{Command: "share", Target: filepath.Join(t.TempDir(), "nada.txt")}, exitNotFound},
+		{"subcomando não atendido", commandRequest{Command: "serve"}, exitUsage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := executeCommand(session, tt.req)
+			if resp.Code != tt.code {
+				t.Errorf("código %d, esperado %d (erro %q)", resp.Code, tt.code, resp.Error)
+			}
+		})
+	}
+
+	resp := executeCommand(session, commandRequest{Command: "search", Target: "a*"})
+	results, ok := resp.Result.([]searchResult)
+	if !ok || len(results) != 1 {
+		t.Fatalf("resultado %#v", resp.Result)
+	}
+	want := searchResult{Hash: hash, Size: 10, Name: "a.txt", Owner: "alice", Visibility: "public", Holders: []string{"10.0.0.1", "10.0.0.2"}}
+	if got := results[0]; got.Hash != want.Hash || got.Size != want.Size || got.Name != want.Name || got.Owner != want.Owner ||
+		strings.Join(got.Holders, ",") != strings.Join(want.Holders, ",") || got.Encrypted {
+		t.Errorf("resultado %+v, esperado %+v", got, want)
+	}
+}
+
+// Sem daemon, os subcomandos que dependem dele saem com 4 e, com -json, a
+// saída padrão tem só a resposta em JSON
+func TestRunCommandWithoutDaemon(t *testing.T) {
+	previousSocket, previousJSON, previousStdout := daemonSocket, jsonOutput, os.Stdout
+	daemonSocket = filepath.Join(t.TempDir(), "nenhum.sock")
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = writer
+	t.Cleanup(func() { daemonSocket, jsonOutput, os.Stdout = previousSocket, previousJSON, previousStdout })
+
+	code := runCommand([]string{"ls", "-json"})
+	writer.Close()
+	os.Stdout = previousStdout
+	var resp commandResponse
+	if err := json.NewDecoder(reader).Decode(&resp); err != nil {
+		t.Fatalf("saída não é JSON: %v", err)
+	}
+	if code != exitUnavailable || resp.Code != exitUnavailable || resp.Error == "" || resp.Text != "" {
+		t.Errorf("código %d, resposta %+v; esperado %d com erro", code, resp, exitUnavailable)
+	}
+
+	if code := runCommand([]string{"ls", "a.txt"}); code != exitUsage {
+		t.Errorf("uso inválido saiu com %d, esperado %d", code, exitUsage)
+	}
+}
+
+func TestCopyDownload(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "a.txt")
+	if err := os.WriteFile(source, []byte("conteúdo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	outDir := filepath.Join(dir, "saida")
+	if err := os.Mkdir(outDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		dest string
+		want string
+	}{
+		{"para um diretório mantém o nome", outDir, filepath.Join(outDir, "a.txt")},
+		{"para um arquivo", filepath.Join(outDir, "b.txt"), filepath.Join(outDir, "b.txt")},
+		{"para o próprio arquivo", source, source},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := copyDownload(source, tt.dest)
+			if err != nil || got != tt.want {
+				t.Fatalf("copyDownload = %q, %v; esperado %q", got, err, tt.want)
+			}
+			if data, err := os.ReadFile(got); err != nil || string(data) != "conteúdo" {
+				t.Errorf("cópia com %q, erro %v", data, err)
+			}
+		})
+	}
+	if _, err := os.Stat(source); err != nil {
+		t.Errorf("o original não existe mais: %v", err)
+	}
+	if _, err := copyDownload(source, filepath.Join(dir, "nada", "c.txt")); err == nil {
+		t.Error("cópia para diretório inexistente foi aceita")
+	}
+}
+
+func TestHandleControlMessage(t *testing.T) {
+	previous := currentSuperNodeHost()
+	t.Cleanup(func() { setSuperNodeHost(previous) })
+	hash := strings.Repeat("ab", 32)
+
+	handleControlMessage([]string{"PONG"})
+	handleControlMessage([]string{"HOLDER_GONE", hash, "10.0.0.1"})
+	handleControlMessage([]string{"HOLDER_GONE", hash}) // Incompleto: ignorado
+	if !holderGone(hash, "10.0.0.1") {
+		t.Error("HOLDER_GONE não foi registrado")
+	}
+	if holderGone(hash, "10.0.0.2") {
+		t.Error("detentor não avisado foi dado como ausente")
+	}
+
+	setSuperNodeHost("10.0.0.10")
+	handleControlMessage([]string{"RECONNECT", "super.exemplo"})
+	if host := currentSuperNodeHost(); host != "10.0.0.10" {
+		t.Errorf("RECONNECT sem IP trocou o super nó para %q", host)
+	}
+	handleControlMessage([]string{"RECONNECT", "10.0.0.11"})
+	if host := currentSuperNodeHost(); host != "10.0.0.11" {
+		t.Errorf("super nó %q depois de RECONNECT, esperado 10.0.0.11", host)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		s     string
+		width int
+		want  string
+	}{
+		{"abc", 5, "abc"},
+		{"abcde", 5, "abcde"},
+		{"abcdef", 5, "abcd…"},
+		{"ação à vista", 6, "ação …"},
+		{"abc", 1, "a"},
+		{"abc", 0, ""},
+	}
+	for _, tt := range tests {
+		if got := truncate(tt.s, tt.width); got != tt.want {
+			t.Errorf("truncate(%q, %d) = %q, esperado %q", tt.s, tt.width, got, tt.want)
+		}
+	}
+}
+
+func TestFormatTransfer(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		transfer *transfer
+		width    int
+		want     []string // Trechos esperados na linha
+	}{
+		{"em andamento", &transfer{Kind: "down", Name: "a.txt", Peer: "10.0.0.1", Size: 2048, bytes: 1024, Started: now, sampleAt: now}, 200,
+			[]string{"↓ a.txt", "10.0.0.1", strings.Repeat("█", 10) + strings.Repeat("░", 10), " 50%", "1.0 KiB/2.0 KiB", "ETA --:--"}},
+		{"envio concluído", &transfer{Kind: "up", Name: "a.txt", Size: 10, bytes: 10, Started: now.Add(-3 * time.Second), finished: now}, 200,
+			[]string{"↑ a.txt", "100%", "\x1b[32mconcluído\x1b[0m em 3s"}},
+		{"falhou", &transfer{Kind: "down", Name: "a.txt", Size: 10, Started: now, err: "conexão perdida"}, 200,
+			[]string{"  0%", "\x1b[31mfalhou\x1b[0m"}},
+		{"nome longo", &transfer{Kind: "down", Name: strings.Repeat("n", 40), Size: 10, Started: now, sampleAt: now}, 200,
+			[]string{strings.Repeat("n", 29) + "…"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := formatTransfer(tt.transfer, tt.width)
+			for _, part := range tt.want {
+				if !strings.Contains(got, part) {
+					t.Errorf("linha %q sem %q", got, part)
+				}
+			}
+		})
+	}
+}
+
+// Num terminal estreito a linha cabe na largura e não leva cor cortada
+func TestFormatTransferNarrow(t *testing.T) {
+	now := time.Now()
+	line := formatTransfer(&transfer{Kind: "down", Name: "a.txt", Size: 10, Started: now, err: "erro"}, 40)
+	if n := len([]rune(line)); n != 40 {
+		t.Errorf("linha com %d colunas, esperado 40: %q", n, line)
+	}
+	if strings.Contains(line, "\x1b") {
+		t.Errorf("linha cortada com sequência de escape: %q", line)
+	}
+}
@@ -0,0 +1,3 @@
+module github.com/vinibalbino/trabalho-p2p-ppd
+
+go 1.22
@@ -0,0 +1,25 @@
+package p2p
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// Cria o handler do log estruturado (log/slog) com o nível (debug, info,
+// warn ou error) e o formato (text ou json) de -log-level e -log-format,
+// escrito em out. Cada programa acrescenta o seu papel e a sua identidade.
+func NewLogHandler(out io.Writer, level string, format string) (slog.Handler, error) {
+	var minLevel slog.Level
+	if err := minLevel.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("nível de log inválido '%s': use debug, info, warn ou error", level)
+	}
+	options := &slog.HandlerOptions{Level: minLevel}
+	switch format {
+	case "text":
+		return slog.NewTextHandler(out, options), nil
+	case "json":
+		return slog.NewJSONHandler(out, options), nil
+	}
+	return nil, fmt.Errorf("formato de log inválido '%s': use text ou json", format)
+}
@@ -0,0 +1,69 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestNewLogHandler(t *testing.T) {
+	tests := []struct {
+		level  string
+		format string
+		ok     bool
+	}{
+		{"debug", "text", true},
+		{"info", "json", true},
+		{"warn", "text", true},
+		{"error", "json", true},
+		{"WARN", "text", true},
+		{"verbose", "text", false},
+		{"", "text", false},
+		{"info", "xml", false},
+		{"info", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level+"/"+tt.format, func(t *testing.T) {
+			handler, err := NewLogHandler(&bytes.Buffer{}, tt.level, tt.format)
+			if (err == nil) != tt.ok || (handler != nil) != tt.ok {
+				t.Errorf("NewLogHandler(%q, %q) = %v, %v; esperado ok = %v", tt.level, tt.format, handler, err, tt.ok)
+			}
+		})
+	}
+}
+
+// Mensagens abaixo do nível não são escritas; em JSON cada linha é um objeto
+func TestNewLogHandlerOutput(t *testing.T) {
+	var out bytes.Buffer
+	handler, err := NewLogHandler(&out, "warn", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(handler)
+	logger.Info("ignorada")
+	logger.Warn("Detentor não respondeu", "peer", "10.0.0.1")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("%d linhas escritas, esperado 1: %q", len(lines), out.String())
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("linha não é JSON: %v", err)
+	}
+	if record["level"] != "WARN" || record["msg"] != "Detentor não respondeu" || record["peer"] != "10.0.0.1" {
+		t.Errorf("registro %v", record)
+	}
+
+	out.Reset()
+	handler, err = NewLogHandler(&out, "debug", "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	slog.New(handler).Debug("detalhe", "hash", "abc")
+	if got := out.String(); !strings.Contains(got, "level=DEBUG") || !strings.Contains(got, "hash=abc") {
+		t.Errorf("saída em texto %q", got)
+	}
+}
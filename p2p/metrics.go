@@ -0,0 +1,177 @@
+package p2p
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Métrica no formato de texto do Prometheus, com uma série por conjunto de
+// rótulos (ex.: `result="hit"`)
+type Metric struct {
+	Name    string
+	Help    string
+	Kind    string    // "counter", "gauge" ou "histogram"
+	Buckets []float64 // Limites dos histogramas
+	values  map[string]float64
+	hists   map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // Um contador por limite, acumulado na exposição
+	sum    float64
+	count  uint64
+}
+
+var (
+	metricsMu         sync.Mutex
+	registeredMetrics []*Metric
+)
+
+// Limites em segundos para latências de rede
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Registra uma métrica, exposta por WriteMetrics na ordem de registro
+func NewMetric(name string, kind string, help string) *Metric {
+	m := &Metric{Name: name, Help: help, Kind: kind, values: make(map[string]float64), hists: make(map[string]*histogram)}
+	if kind == "histogram" {
+		m.Buckets = latencyBuckets
+	}
+	metricsMu.Lock()
+	registeredMetrics = append(registeredMetrics, m)
+	metricsMu.Unlock()
+	return m
+}
+
+func (m *Metric) Add(labels string, delta float64) {
+	metricsMu.Lock()
+	m.values[labels] += delta
+	metricsMu.Unlock()
+}
+
+func (m *Metric) Inc(labels string) {
+	m.Add(labels, 1)
+}
+
+func (m *Metric) Set(labels string, value float64) {
+	metricsMu.Lock()
+	m.values[labels] = value
+	metricsMu.Unlock()
+}
+
+// Zera as séries de uma métrica calculada na hora da coleta
+func (m *Metric) Reset() {
+	metricsMu.Lock()
+	m.values = make(map[string]float64)
+	metricsMu.Unlock()
+}
+
+// Define uma série para cada um dos limit maiores valores, com o rótulo
+// name; os demais são somados na série name="other". Assim rótulos como o
+// IP de um cliente não criam uma série nova para cada cliente visto. extra
+// são rótulos acrescentados a todas as séries (ex.: `direction="up"`).
+func (m *Metric) SetTop(name string, values map[string]float64, limit int, extra string) {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if values[keys[i]] != values[keys[j]] {
+			return values[keys[i]] > values[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	other := 0.0
+	for i, key := range keys {
+		if i < limit {
+			m.Set(joinLabels(Label(name, key), extra), values[key])
+		} else {
+			other += values[key]
+		}
+	}
+	if len(keys) > limit {
+		m.Set(joinLabels(Label(name, "other"), extra), other)
+	}
+}
+
+func (m *Metric) Observe(labels string, value float64) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	h := m.hists[labels]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(m.Buckets))}
+		m.hists[labels] = h
+	}
+	for i, bound := range m.Buckets {
+		if value <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// Escreve todas as métricas no formato de exposição de texto
+func WriteMetrics(w io.Writer) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	for _, m := range registeredMetrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.Name, m.Help, m.Name, m.Kind)
+		if m.Kind == "histogram" {
+			var keys []string
+			for labels := range m.hists {
+				keys = append(keys, labels)
+			}
+			sort.Strings(keys)
+			for _, labels := range keys {
+				h := m.hists[labels]
+				var cumulative uint64
+				for i, bound := range m.Buckets {
+					cumulative += h.counts[i]
+					fmt.Fprintf(w, "%s_bucket{%s} %d\n", m.Name, joinLabels(labels, fmt.Sprintf(`le="%g"`, bound)), cumulative)
+				}
+				fmt.Fprintf(w, "%s_bucket{%s} %d\n", m.Name, joinLabels(labels, `le="+Inf"`), h.count)
+				fmt.Fprintf(w, "%s_sum%s %g\n%s_count%s %d\n", m.Name, braces(labels), h.sum, m.Name, braces(labels), h.count)
+			}
+			continue
+		}
+		for _, labels := range sortedKeys(m.values) {
+			fmt.Fprintf(w, "%s%s %g\n", m.Name, braces(labels), m.values[labels])
+		}
+	}
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func joinLabels(labels string, extra string) string {
+	if labels == "" {
+		return extra
+	}
+	if extra == "" {
+		return labels
+	}
+	return labels + "," + extra
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+// Rótulo com o valor escapado como o formato exige
+func Label(name string, value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+	return name + `="` + value + `"`
+}
@@ -0,0 +1,68 @@
+package p2p
+
+import (
+	"reflect"
+	"testing"
+)
+
+func newTestMetric() *Metric {
+	return &Metric{Name: "teste", Kind: "gauge", values: make(map[string]float64), hists: make(map[string]*histogram)}
+}
+
+// Só os limit maiores valores ganham série própria; empates seguem a ordem do
+// rótulo e o restante é somado em "other"
+func TestSetTop(t *testing.T) {
+	values := map[string]float64{"10.0.0.1": 5, "10.0.0.3": 3, "10.0.0.2": 3, "10.0.0.4": 1, "10.0.0.5": 0.5}
+	tests := []struct {
+		name  string
+		limit int
+		extra string
+		want  map[string]float64
+	}{
+		{"dois maiores", 2, "", map[string]float64{
+			`peer="10.0.0.1"`: 5, `peer="10.0.0.2"`: 3, `peer="other"`: 4.5}},
+		{"com rótulo extra", 1, `direction="up"`, map[string]float64{
+			`peer="10.0.0.1",direction="up"`: 5, `peer="other",direction="up"`: 7.5}},
+		{"todos cabem", 5, "", map[string]float64{
+			`peer="10.0.0.1"`: 5, `peer="10.0.0.2"`: 3, `peer="10.0.0.3"`: 3, `peer="10.0.0.4"`: 1, `peer="10.0.0.5"`: 0.5}},
+		{"limite zero", 0, "", map[string]float64{`peer="other"`: 12.5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestMetric()
+			m.SetTop("peer", values, tt.limit, tt.extra)
+			if !reflect.DeepEqual(m.values, tt.want) {
+				t.Errorf("séries %v, esperado %v", m.values, tt.want)
+			}
+		})
+	}
+}
+
+// Com Reset antes de cada coleta, um cliente que saiu do topo não deixa série antiga
+func TestSetTopAfterReset(t *testing.T) {
+	m := newTestMetric()
+	m.SetTop("peer", map[string]float64{"a": 2, "b": 1}, 1, "")
+	m.Reset()
+	m.SetTop("peer", map[string]float64{"a": 1, "b": 2}, 1, "")
+	want := map[string]float64{`peer="b"`: 2, `peer="other"`: 1}
+	if !reflect.DeepEqual(m.values, want) {
+		t.Errorf("séries %v, esperado %v", m.values, want)
+	}
+}
+
+func TestLabel(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"a.txt", `file="a.txt"`},
+		{`a"b`, `file="a\"b"`},
+		{`a\b`, `file="a\\b"`},
+		{"a\nb", `file="a\nb"`},
+	}
+	for _, tt := range tests {
+		if got := Label("file", tt.value); got != tt.want {
+			t.Errorf("Label(%q) = %s, esperado %s", tt.value, got, tt.want)
+		}
+	}
+}
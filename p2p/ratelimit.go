@@ -0,0 +1,99 @@
+package p2p
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Limita a taxa de bytes (balde de créditos com rajada de um segundo)
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes por segundo
+	tokens float64
+	last   time.Time
+}
+
+// Bytes transferidos de cada vez, para que os limites sejam aplicados de forma suave
+const throttleChunk = 8 * 1024
+
+// Retorna nil (sem limite) quando kibPerSecond <= 0
+func NewRateLimiter(kibPerSecond int) *RateLimiter {
+	if kibPerSecond <= 0 {
+		return nil
+	}
+	rate := float64(kibPerSecond) * 1024
+	return &RateLimiter{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// Reserva n bytes e espera até que eles possam passar
+func (l *RateLimiter) Wait(n int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	time.Sleep(delay)
+}
+
+// Escritor que respeita todos os limites indicados; limites nil são ignorados
+func ThrottledWriter(w io.Writer, limiters ...*RateLimiter) io.Writer {
+	return &throttledWriter{w: w, limiters: limiters}
+}
+
+// Leitor que respeita todos os limites indicados; limites nil são ignorados
+func ThrottledReader(r io.Reader, limiters ...*RateLimiter) io.Reader {
+	return &throttledReader{r: r, limiters: limiters}
+}
+
+type throttledWriter struct {
+	w        io.Writer
+	limiters []*RateLimiter
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > throttleChunk {
+			n = throttleChunk
+		}
+		for _, limiter := range t.limiters {
+			limiter.Wait(n)
+		}
+		m, err := t.w.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+type throttledReader struct {
+	r        io.Reader
+	limiters []*RateLimiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := t.r.Read(p)
+	for _, limiter := range t.limiters {
+		limiter.Wait(n)
+	}
+	return n, err
+}
@@ -0,0 +1,87 @@
+package p2p
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestNewRateLimiterDisabled(t *testing.T) {
+	for _, kib := range []int{0, -1} {
+		if limiter := NewRateLimiter(kib); limiter != nil {
+			t.Errorf("NewRateLimiter(%d) = %+v, esperado nil", kib, limiter)
+		}
+	}
+	var limiter *RateLimiter
+	limiter.Wait(1 << 30) // nil não limita
+}
+
+// A rajada de um segundo passa sem espera; o que excede espera excesso/taxa
+func TestRateLimiterWait(t *testing.T) {
+	limiter := NewRateLimiter(64)
+	start := time.Now()
+	limiter.Wait(64 * 1024)
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("rajada esperou %v", elapsed)
+	}
+
+	start = time.Now()
+	limiter.Wait(64 * 1024 / 10)
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond || elapsed > time.Second {
+		t.Errorf("excesso de 1/10 s esperou %v, esperado cerca de 100ms", elapsed)
+	}
+}
+
+// Os créditos acumulados ficam limitados a um segundo de taxa
+func TestRateLimiterBurstCap(t *testing.T) {
+	limiter := NewRateLimiter(1)
+	limiter.tokens = 0
+	limiter.last = time.Now().Add(-time.Hour)
+	limiter.Wait(0)
+	if limiter.tokens != limiter.rate {
+		t.Errorf("créditos = %.0f, esperado %.0f", limiter.tokens, limiter.rate)
+	}
+}
+
+type recordingWriter struct {
+	bytes.Buffer
+	writes []int
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, len(p))
+	return w.Buffer.Write(p)
+}
+
+// O escritor divide em blocos de throttleChunk e respeita o limite mais restrito
+func TestThrottledWriter(t *testing.T) {
+	slow, fast := NewRateLimiter(64), NewRateLimiter(1024)
+	slow.tokens, fast.tokens = 0, 0
+	data := make([]byte, 64*1024/10)
+	var out recordingWriter
+
+	start := time.Now()
+	n, err := ThrottledWriter(&out, slow, nil, fast).Write(data)
+	elapsed := time.Since(start)
+	if err != nil || n != len(data) || !bytes.Equal(out.Bytes(), data) {
+		t.Fatalf("escreveu %d de %d bytes, erro %v", n, len(data), err)
+	}
+	for _, size := range out.writes {
+		if size > throttleChunk {
+			t.Errorf("escrita de %d bytes, máximo %d", size, throttleChunk)
+		}
+	}
+	if elapsed < 90*time.Millisecond || elapsed > time.Second {
+		t.Errorf("escrita esperou %v, esperado cerca de 100ms", elapsed)
+	}
+}
+
+func TestThrottledReaderChunks(t *testing.T) {
+	data := make([]byte, 3*throttleChunk)
+	reader := ThrottledReader(bytes.NewReader(data))
+	buf := make([]byte, len(data))
+	n, err := reader.Read(buf)
+	if err != nil || n != throttleChunk {
+		t.Errorf("leu %d bytes, erro %v; esperado %d", n, err, throttleChunk)
+	}
+}
@@ -0,0 +1,421 @@
+// Pacote p2p reúne o que o super nó (unified) e o cliente compartilham: TLS
+// mútuo, limites de banda, métricas, log e rastreamento.
+package p2p
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Papéis gravados no campo OU dos certificados do cluster
+const (
+	RoleNode   = "node"   // coordenador e super nós
+	RoleClient = "client" // clientes
+)
+
+var (
+	TLSCAFile   = "" // Certificado da CA do cluster (PEM)
+	TLSCertFile = "" // Certificado deste nó, assinado pela CA (PEM)
+	TLSKeyFile  = "" // Chave privada do certificado (PEM)
+	TLSTestDir  = "" // Modo de teste: CA descartável gerada neste diretório
+
+	// Configuração TLS mútua; nil quando o TLS está desabilitado
+	TLSConfig *tls.Config
+)
+
+// Arquivos do modo de teste. A chave da CA raiz fica só com o coordenador e
+// os super nós; os clientes recebem a CA intermediária de clientes, que só
+// emite certificados com o papel "client".
+const (
+	testCAFile        = "ca.pem"
+	testCAKeyFile     = "ca-key.pem"
+	testClientCAFile  = "client-ca.pem"
+	testClientKeyFile = "client-ca-key.pem"
+)
+
+// Carrega (ou gera, no modo de teste) os certificados e habilita o TLS mútuo.
+// commonName identifica o nó no certificado de teste; vazio usa "<máquina>-<papel>".
+func SetupTLS(role string, commonName string) error {
+	if TLSTestDir == "" && TLSCertFile == "" {
+		return nil
+	}
+
+	pool := x509.NewCertPool()
+	var cert tls.Certificate
+	if TLSTestDir != "" {
+		var issuer *x509.Certificate
+		var issuerKey *ecdsa.PrivateKey
+		var err error
+		if role == RoleNode {
+			issuer, issuerKey, err = loadOrCreateTestCA(TLSTestDir)
+		} else {
+			issuer, issuerKey, err = loadTestClientCA(TLSTestDir)
+		}
+		if err != nil {
+			return fmt.Errorf("erro ao preparar a CA de teste: %v", err)
+		}
+		root, err := loadCertificate(filepath.Join(TLSTestDir, testCAFile))
+		if err != nil {
+			return fmt.Errorf("erro ao ler a CA de teste: %v", err)
+		}
+		pool.AddCert(root)
+		cert, err = issueTestCertificate(issuer, issuerKey, role, commonName)
+		if err != nil {
+			return fmt.Errorf("erro ao emitir certificado de teste: %v", err)
+		}
+		if role != RoleNode {
+			cert.Certificate = append(cert.Certificate, issuer.Raw)
+		}
+	} else {
+		var err error
+		cert, err = tls.LoadX509KeyPair(TLSCertFile, TLSKeyFile)
+		if err != nil {
+			return fmt.Errorf("erro ao carregar o certificado: %v", err)
+		}
+		caPEM, err := os.ReadFile(TLSCAFile)
+		if err != nil {
+			return fmt.Errorf("erro ao ler a CA do cluster: %v", err)
+		}
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return fmt.Errorf("nenhum certificado válido em '%s'", TLSCAFile)
+		}
+	}
+
+	TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}
+	return nil
+}
+
+// Lê a CA de teste do diretório ou cria uma nova, válida por 7 dias, junto
+// com a CA intermediária de clientes
+func loadOrCreateTestCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certPath, keyPath := filepath.Join(dir, testCAFile), filepath.Join(dir, testCAKeyFile)
+
+	if _, err := os.Stat(certPath); err == nil {
+		ca, key, err := loadCA(certPath, keyPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, err := os.Stat(filepath.Join(dir, testClientCAFile)); os.IsNotExist(err) {
+			if err := createTestClientCA(dir, ca, key); err != nil {
+				return nil, nil, err
+			}
+		}
+		return ca, key, nil
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: "CA de teste do P2P"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(7 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, nil, err
+	}
+	ca, key, err := createCA(template, nil, nil, certPath, keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := createTestClientCA(dir, ca, key); err != nil {
+		return nil, nil, err
+	}
+	slog.Info("CA de teste criada; copie o diretório para os outros super nós e, para os clientes, só "+
+		testCAFile+", "+testClientCAFile+" e "+testClientKeyFile, "dir", dir)
+	return ca, key, nil
+}
+
+// CA intermediária com OU "client": o que ela emite vale apenas como cliente
+func createTestClientCA(dir string, ca *x509.Certificate, caKey *ecdsa.PrivateKey) error {
+	template := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: "CA de clientes do P2P", OrganizationalUnit: []string{RoleClient}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              ca.NotAfter,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	_, _, err := createCA(template, ca, caKey, filepath.Join(dir, testClientCAFile), filepath.Join(dir, testClientKeyFile))
+	return err
+}
+
+// Gera a chave e o certificado de uma CA, assinado por parent (ou por ela
+// mesma, quando parent é nil), e grava os dois em PEM
+func createCA(template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, certPath string, keyPath string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return nil, nil, err
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return nil, nil, err
+	}
+	ca, err := x509.ParseCertificate(der)
+	return ca, key, err
+}
+
+// Os clientes só leem a CA intermediária de clientes; a chave da CA raiz
+// nunca sai das máquinas do coordenador e dos super nós
+func loadTestClientCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	ca, key, err := loadCA(filepath.Join(dir, testClientCAFile), filepath.Join(dir, testClientKeyFile))
+	if os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("'%s' não encontrado; inicie um super nó com -tls-test e copie %s, %s e %s para '%s'",
+			testClientCAFile, testCAFile, testClientCAFile, testClientKeyFile, dir)
+	}
+	return ca, key, err
+}
+
+func loadCA(certPath string, keyPath string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	ca, err := loadCertificate(certPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, nil, fmt.Errorf("chave de CA inválida em '%s'", keyPath)
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ca, key, nil
+}
+
+func loadCertificate(path string) (*x509.Certificate, error) {
+	certPEM, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return nil, fmt.Errorf("certificado inválido em '%s'", path)
+	}
+	return x509.ParseCertificate(certBlock.Bytes)
+}
+
+// Emite, em memória, um certificado para este nó com todos os IPs locais
+func issueTestCertificate(ca *x509.Certificate, caKey *ecdsa.PrivateKey, role string, commonName string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	hostname, _ := os.Hostname()
+	if commonName == "" {
+		commonName = hostname + "-" + role
+	}
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: commonName, OrganizationalUnit: []string{role}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost", hostname},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				template.IPAddresses = append(template.IPAddresses, ipNet.IP)
+			}
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+func randomSerial() *big.Int {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 62))
+	return serial
+}
+
+// Abre um listener TCP, com TLS mútuo quando habilitado
+func Listen(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil || TLSConfig == nil {
+		return ln, err
+	}
+	return tls.NewListener(ln, TLSConfig), nil
+}
+
+// Conecta a outro nó, com TLS mútuo quando habilitado
+func Dial(addr string) (net.Conn, error) {
+	return DialTimeout(addr, 0)
+}
+
+func DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	if TLSConfig == nil {
+		return net.DialTimeout("tcp", addr, timeout)
+	}
+	return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr, TLSConfig)
+}
+
+// Conclui o handshake e retorna o papel do certificado do outro lado (vazio
+// se ele não tem nenhum). Um certificado emitido por uma CA com OU "client"
+// vale apenas como cliente, qualquer que seja o seu próprio OU. Sem TLS não há
+// papel: a conexão só é aceita (ok) se o TLS está desabilitado.
+func PeerRole(conn net.Conn) (role string, ok bool) {
+	tlsConn, isTLS := conn.(*tls.Conn)
+	if !isTLS {
+		return "", TLSConfig == nil
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	err := tlsConn.Handshake()
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		slog.Warn("Erro no handshake TLS", "addr", conn.RemoteAddr().String(), "error", err)
+		return "", false
+	}
+	return certificateRole(tlsConn.ConnectionState()), true
+}
+
+func certificateRole(state tls.ConnectionState) string {
+	chain := state.PeerCertificates
+	if len(state.VerifiedChains) > 0 {
+		chain = state.VerifiedChains[0]
+	}
+	if len(chain) == 0 {
+		return ""
+	}
+	role := ""
+	for _, unit := range chain[0].Subject.OrganizationalUnit {
+		if unit == RoleNode || unit == RoleClient {
+			role = unit
+			break
+		}
+	}
+	for _, issuer := range chain[1:] {
+		if role != "" && hasRole(RoleClient, issuer.Subject.OrganizationalUnit) {
+			role = RoleClient
+		}
+	}
+	return role
+}
+
+// Confere se o certificado do outro lado tem um dos papéis aceitos.
+// Sem TLS não há identidade a verificar e a conexão é aceita.
+func PeerHasRole(conn net.Conn, roles ...string) bool {
+	role, ok := PeerRole(conn)
+	if !ok {
+		return false
+	}
+	if _, isTLS := conn.(*tls.Conn); !isTLS {
+		return true
+	}
+	return AcceptRole(conn, role, roles...)
+}
+
+// Confere um papel já obtido com PeerRole, registrando a recusa
+func AcceptRole(conn net.Conn, role string, roles ...string) bool {
+	if hasRole(role, roles) {
+		return true
+	}
+	slog.Warn("Conexão recusada: certificado sem o papel exigido", "addr", conn.RemoteAddr().String(), "roles", roles)
+	return false
+}
+
+func hasRole(role string, roles []string) bool {
+	for _, accepted := range roles {
+		if role == accepted {
+			return true
+		}
+	}
+	return false
+}
+
+// Usuário do certificado do outro lado; vazio sem TLS
+func PeerCommonName(conn net.Conn) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+	return certs[0].Subject.CommonName
+}
+
+// Usuário identificado pelo certificado do outro lado: o CN de um certificado
+// "client"; vazio sem TLS ou quando o certificado não identifica o usuário
+func PeerUser(conn net.Conn) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok || !identifiesUser(tlsConn.ConnectionState()) {
+		return ""
+	}
+	return PeerCommonName(conn)
+}
+
+// No modo de teste a chave da CA de clientes é copiada para todos os
+// clientes, que podem emitir um certificado com qualquer CN; aí o
+// certificado não identifica ninguém e o usuário precisa do AUTH
+func identifiesUser(state tls.ConnectionState) bool {
+	return TLSTestDir == "" && certificateRole(state) == RoleClient
+}
+
+// Verifica a cadeia do certificado do outro lado diretamente contra a CA do
+// cluster, sem conferir o nome do host; usado nas retransmissões, em que do
+// outro lado não há um endereço a conferir
+func VerifyClusterChain(rawCerts [][]byte, usage x509.ExtKeyUsage) error {
+	if len(rawCerts) == 0 {
+		return errors.New("certificado ausente")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{Roots: TLSConfig.RootCAs, Intermediates: intermediates, KeyUsages: []x509.ExtKeyUsage{usage}})
+	return err
+}
@@ -0,0 +1,134 @@
+package p2p
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Um certificado emitido pela CA de clientes não vale como "node", mesmo com esse OU
+func TestClientCACannotIssueNodes(t *testing.T) {
+	dir := t.TempDir()
+	root, _, err := loadOrCreateTestCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCA, clientKey, err := loadTestClientCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		issuer *x509.Certificate
+		role   string
+		want   string
+	}{
+		{"cliente pela CA de clientes", clientCA, RoleClient, RoleClient},
+		{"nó forjado pela CA de clientes", clientCA, RoleNode, RoleClient},
+		{"sem papel", clientCA, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert, err := issueTestCertificate(tt.issuer, clientKey, tt.role, "alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			leaf, err := x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			state := tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf, clientCA},
+				VerifiedChains: [][]*x509.Certificate{{leaf, clientCA, root}}}
+			if got := certificateRole(state); got != tt.want {
+				t.Errorf("papel = %q, esperado %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// O cliente emite o próprio certificado sem precisar da chave da CA raiz
+func TestClientSetupWithoutRootKey(t *testing.T) {
+	dir := t.TempDir()
+	if _, _, err := loadOrCreateTestCA(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, testCAKeyFile)); err != nil {
+		t.Fatal(err)
+	}
+
+	TLSTestDir = dir
+	defer func() { TLSTestDir, TLSConfig = "", nil }()
+	if err := SetupTLS(RoleClient, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	chain := TLSConfig.Certificates[0].Certificate
+	if len(chain) != 2 {
+		t.Fatalf("cadeia com %d certificados, esperado o do cliente e o da CA de clientes", len(chain))
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf.Subject.CommonName != "alice" {
+		t.Errorf("CN = %q, esperado alice", leaf.Subject.CommonName)
+	}
+	if err := VerifyClusterChain(chain, x509.ExtKeyUsageClientAuth); err != nil {
+		t.Errorf("cadeia do cliente não confere com a CA raiz: %v", err)
+	}
+}
+
+// O CN só identifica o usuário num certificado "client" fora do modo de teste
+func TestIdentifiesUser(t *testing.T) {
+	dir := t.TempDir()
+	root, rootKey, err := loadOrCreateTestCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCA, clientKey, err := loadTestClientCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		issuer   *x509.Certificate
+		key      *ecdsa.PrivateKey
+		role     string
+		testMode bool
+		want     bool
+	}{
+		{"cliente", clientCA, clientKey, RoleClient, false, true},
+		{"cliente no modo de teste", clientCA, clientKey, RoleClient, true, false},
+		{"super nó", root, rootKey, RoleNode, false, false},
+		{"sem papel", root, rootKey, "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert, err := issueTestCertificate(tt.issuer, tt.key, tt.role, "alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			leaf, err := x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			chain := []*x509.Certificate{leaf, root}
+			if tt.issuer == clientCA {
+				chain = []*x509.Certificate{leaf, clientCA, root}
+			}
+			TLSTestDir = ""
+			if tt.testMode {
+				TLSTestDir = dir
+			}
+			defer func() { TLSTestDir = "" }()
+			state := tls.ConnectionState{PeerCertificates: chain[:len(chain)-1], VerifiedChains: [][]*x509.Certificate{chain}}
+			if got := identifiesUser(state); got != tt.want {
+				t.Errorf("identifiesUser = %v, esperado %v", got, tt.want)
+			}
+		})
+	}
+}
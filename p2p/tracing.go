@@ -0,0 +1,258 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rastreamento distribuído: cada salto de uma busca ou download (cliente,
+// super nó, outros super nós e detentor) grava um span no formato do
+// OpenTelemetry. O contexto viaja no protocolo como traceparent do W3C
+// ("00-<trace>-<span>-01"), e o ID do trace é o ID da requisição nos logs.
+const (
+	SpanInternal = 1
+	SpanServer   = 2
+	SpanClient   = 3
+)
+
+var (
+	TraceFile       = ""              // Arquivo onde os spans são gravados em OTLP/JSON, um lote por linha
+	TraceEndpoint   = ""              // Coletor OTLP/HTTP (ex.: http://127.0.0.1:4318/v1/traces)
+	traceInterval   = 2 * time.Second // Intervalo entre as exportações
+	maxPendingSpans = 4096            // Spans guardados entre exportações; os excedentes são descartados
+	traceClient     = &http.Client{Timeout: 5 * time.Second}
+	traceMu         sync.Mutex
+	pendingSpans    []otlpSpan
+	droppedSpans    int
+	traceService    = "p2p" // service.name dos spans
+	traceInstance   = ""    // service.instance.id: ID do nó, usuário ou nome da máquina
+)
+
+// Define o service.name e o service.instance.id dos próximos spans exportados
+func SetTraceService(service string, instance string) {
+	traceMu.Lock()
+	traceService, traceInstance = service, instance
+	traceMu.Unlock()
+}
+
+// Contexto de rastreamento recebido ou enviado pela rede
+type SpanContext struct {
+	TraceID string // 32 dígitos hexadecimais
+	SpanID  string // 16 dígitos hexadecimais; vazio quando só o trace é conhecido
+}
+
+func (sc SpanContext) Traceparent() string {
+	return "00-" + sc.TraceID + "-" + sc.SpanID + "-01"
+}
+
+// Lê um traceparent ("00-<32 hex>-<16 hex>-<flags>")
+func ParseTraceparent(value string) (SpanContext, bool) {
+	parts := strings.Split(value, "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return SpanContext{}, false
+	}
+	for _, part := range parts {
+		if _, err := hex.DecodeString(part); err != nil {
+			return SpanContext{}, false
+		}
+	}
+	if parts[1] == strings.Repeat("0", 32) || parts[2] == strings.Repeat("0", 16) {
+		return SpanContext{}, false
+	}
+	return SpanContext{TraceID: parts[1], SpanID: parts[2]}, true
+}
+
+// Contexto no campo i do comando, quando quem pediu enviou um traceparent.
+// Qualquer outro valor, como o ID de requisição de versões anteriores, não é
+// um ID de trace válido, e a requisição começa um trace novo.
+func RequestContext(parts []string, i int) SpanContext {
+	if i < len(parts) {
+		if sc, ok := ParseTraceparent(parts[i]); ok {
+			return sc
+		}
+	}
+	return SpanContext{}
+}
+
+func randomHex(n int) string {
+	raw := make([]byte, n)
+	rand.Read(raw)
+	return hex.EncodeToString(raw)
+}
+
+// Span em andamento
+type Span struct {
+	Context SpanContext
+	mu      sync.Mutex
+	parent  string
+	name    string
+	kind    int
+	start   time.Time
+	attrs   []otlpAttribute
+	ended   bool
+}
+
+// Inicia um span filho de parent; sem trace em parent, começa um trace novo
+func StartSpan(name string, kind int, parent SpanContext) *Span {
+	sc := SpanContext{TraceID: parent.TraceID, SpanID: randomHex(8)}
+	if sc.TraceID == "" {
+		sc.TraceID = randomHex(16)
+	}
+	return &Span{Context: sc, parent: parent.SpanID, name: name, kind: kind, start: time.Now()}
+}
+
+func (s *Span) Set(key string, value interface{}) {
+	attr := otlpAttribute{Key: key, Value: make(map[string]string)}
+	switch v := value.(type) {
+	case int:
+		attr.Value["intValue"] = strconv.Itoa(v)
+	case int64:
+		attr.Value["intValue"] = strconv.FormatInt(v, 10)
+	default:
+		attr.Value["stringValue"] = fmt.Sprint(v)
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, attr)
+	s.mu.Unlock()
+}
+
+// Encerra o span, com status de erro se err != nil, e o põe na fila de exportação
+func (s *Span) End(err error) {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	exported := otlpSpan{TraceID: s.Context.TraceID, SpanID: s.Context.SpanID, ParentSpanID: s.parent, Name: s.name, Kind: s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10), EndTimeUnixNano: strconv.FormatInt(time.Now().UnixNano(), 10),
+		Attributes: s.attrs}
+	s.mu.Unlock()
+	if err != nil {
+		exported.Status = otlpStatus{Code: 2, Message: err.Error()}
+	}
+	if TraceFile == "" && TraceEndpoint == "" {
+		return
+	}
+
+	traceMu.Lock()
+	if len(pendingSpans) < maxPendingSpans {
+		pendingSpans = append(pendingSpans, exported)
+	} else {
+		droppedSpans++
+	}
+	traceMu.Unlock()
+}
+
+// Corpo de uma exportação OTLP/HTTP em JSON (ExportTraceServiceRequest)
+type otlpExport struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"` // {"stringValue": ...} ou {"intValue": ...}
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"` // 2 = erro
+	Message string `json:"message,omitempty"`
+}
+
+// Exporta os spans acumulados a cada traceInterval
+func ExportSpans() {
+	for {
+		time.Sleep(traceInterval)
+		FlushSpans()
+	}
+}
+
+// Grava os spans pendentes no arquivo e/ou os envia ao coletor
+func FlushSpans() {
+	traceMu.Lock()
+	spans, dropped := pendingSpans, droppedSpans
+	pendingSpans, droppedSpans = nil, 0
+	resource := []otlpAttribute{{Key: "service.name", Value: map[string]string{"stringValue": traceService}}}
+	if traceInstance != "" {
+		resource = append(resource, otlpAttribute{Key: "service.instance.id", Value: map[string]string{"stringValue": traceInstance}})
+	}
+	traceMu.Unlock()
+
+	if dropped > 0 {
+		slog.Warn("Spans descartados: fila de exportação cheia", "dropped", dropped)
+	}
+	if len(spans) == 0 {
+		return
+	}
+	body, err := json.Marshal(otlpExport{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: resource},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "p2p"}, Spans: spans}},
+	}}})
+	if err != nil {
+		slog.Error("Erro ao codificar os spans", "error", err)
+		return
+	}
+
+	if TraceFile != "" {
+		file, err := os.OpenFile(TraceFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err == nil {
+			_, err = file.Write(append(body, '\n'))
+			file.Close()
+		}
+		if err != nil {
+			slog.Error("Erro ao gravar os spans", "path", TraceFile, "error", err)
+		}
+	}
+	if TraceEndpoint != "" {
+		response, err := traceClient.Post(TraceEndpoint, "application/json", bytes.NewReader(body))
+		if err == nil {
+			response.Body.Close()
+			if response.StatusCode/100 != 2 {
+				err = fmt.Errorf("resposta %s", response.Status)
+			}
+		}
+		if err != nil {
+			slog.Error("Erro ao exportar os spans", "endpoint", TraceEndpoint, "spans", len(spans), "error", err)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package p2p
+
+import "testing"
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  SpanContext
+		ok    bool
+	}{
+		{"válido", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			SpanContext{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7"}, true},
+		{"vazio", "", SpanContext{}, false},
+		{"ID de requisição antigo", "a1b2c3d4e5f60708", SpanContext{}, false},
+		{"trace curto", "00-4bf92f3577b34da6-00f067aa0ba902b7-01", SpanContext{}, false},
+		{"span curto", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa-01", SpanContext{}, false},
+		{"não hexadecimal", "00-4bf92f3577b34da6a3ce929d0e0e473z-00f067aa0ba902b7-01", SpanContext{}, false},
+		{"trace zerado", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", SpanContext{}, false},
+		{"span zerado", "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", SpanContext{}, false},
+		{"campos a mais", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-00", SpanContext{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := ParseTraceparent(tt.value)
+			if ok != tt.ok || got != tt.want {
+				t.Errorf("ParseTraceparent(%q) = %+v, %v; esperado %+v, %v", tt.value, got, ok, tt.want, tt.ok)
+			}
+			if ok && got.Traceparent() != tt.value {
+				t.Errorf("Traceparent() = %q, esperado %q", got.Traceparent(), tt.value)
+			}
+		})
+	}
+}
+
+// Um ID de requisição que não é traceparent (cliente antigo) inicia um trace novo
+func TestRequestContext(t *testing.T) {
+	traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	tests := []struct {
+		name  string
+		parts []string
+		i     int
+		want  SpanContext
+	}{
+		{"traceparent", []string{"DOWNLOAD", "a.txt", traceparent}, 2,
+			SpanContext{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7"}},
+		{"ID de requisição antigo", []string{"DOWNLOAD", "a.txt", "a1b2c3d4e5f60708"}, 2, SpanContext{}},
+		{"campo ausente", []string{"DOWNLOAD", "a.txt"}, 2, SpanContext{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RequestContext(tt.parts, tt.i); got != tt.want {
+				t.Errorf("RequestContext = %+v, esperado %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,4241 @@
+// master_node.go
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/vinibalbino/trabalho-p2p-ppd/p2p"
+)
+
+type SuperNode struct {
+	ID        int
+	Addr      string
+	PublicKey ed25519.PublicKey // Chave com que o super nó assina anúncios de coordenador
+}
+
+const (
+	registerPort  = ":8080"
+	releasePort   = ":8081"
+	clientPort    = ":8082"
+	broadcastPort = ":8084"
+	electionPort  = ":8085"
+	dhtPort       = ":8086"
+	relayPort     = ":8087"
+	peerPort      = ":8081" // Porta do servidor de arquivos dos clientes
+)
+
+var (
+	isMaster = false
+	mu       sync.Mutex
+
+	superNodes     = make(map[int]SuperNode)
+	contSuperNodes = 0
+	contToSucess   = 0
+
+	files              = make(map[string]*FileEntry)                 // hash do conteúdo -> entrada
+	fileNames          = make(map[string]map[string]bool)            // nome -> hashes publicados com esse nome
+	pendingDownloads   = make(map[string]map[string]pendingDownload) // IP do cliente -> hash -> resultado indicado, aguardando CONFIRM
+	pendingTimeout     = 30 * time.Minute                            // Downloads não confirmados depois disso são esquecidos
+	superNodeID        = ""
+	coordinatorIP      = "172.27.3.241" // IP do master_node
+	coordinatorID      = "Master"
+	knownSuperNodes    = []string{} // IPs dos SuperNodes
+	electionInProgress = false
+	superNodeAddr      = "" // IP deste super nó, visto pelo coordenador
+
+	// Anúncios de controle (lista de super nós e novo coordenador) são assinados
+	// com Ed25519 e trazem o mandato (term) e a época da lista, para que
+	// mensagens forjadas ou antigas sejam descartadas
+	nodePrivateKey  ed25519.PrivateKey
+	nodePublicKey   ed25519.PublicKey
+	coordinatorKey  ed25519.PublicKey                    // Chave do coordenador atual
+	knownKeys       = make(map[string]ed25519.PublicKey) // IP do super nó -> chave pública
+	currentTerm     = 0                                  // Mandato do coordenador atual
+	membershipEpoch = 0                                  // Época da última lista de super nós
+
+	usersFile = ""                           // Arquivo de usuários; vazio desativa a autenticação
+	users     = make(map[string]userAccount) // Usuário -> conta
+
+	// Limites da porta de clientes; super nós conhecidos ficam de fora
+	rateLimit            = 10.0          // Requisições por segundo por IP (0 desativa)
+	rateBurst            = 20.0          // Rajada máxima de requisições por IP
+	maxSessionsPerIP     = 4             // Sessões simultâneas por IP (0 desativa)
+	maxFederatedSearches = 8             // Buscas simultâneas em outros super nós (0 desativa)
+	limitAction          = limitThrottle // O que fazer com quem excede o limite de requisições
+	banDuration          = 5 * time.Minute
+	limitsMu             sync.Mutex
+	clientLimits         = make(map[string]*clientLimit) // IP -> estado dos limites
+	federatedSearches    chan struct{}                   // Semáforo das buscas federadas
+	limitStats           enforcementStats
+
+	// Contabilidade de envios e recebimentos por cliente, replicada entre os super nós
+	creditGrace    = int64(64 << 20) // Bytes somados aos dois lados da razão; clientes novos começam com razão 1
+	leecherRatio   = 0.5             // Abaixo desta razão o cliente recebe menos detentores
+	leecherHolders = 1               // Detentores indicados a quem está abaixo de leecherRatio
+	claimTimeout   = 10 * time.Minute
+	credits        = make(map[string]*creditAccount)  // IP do cliente -> contabilidade
+	sentClaims     = make(map[string]transferClaim)   // transferência -> envio informado só pelo detentor
+	seenTransfers  = make(map[string]time.Time)       // transferências já contabilizadas
+	issuedTransfer = make(map[string]pendingDownload) // transferência -> download indicado por este super nó
+
+	// Travessia de NAT: conexões reversas e retransmissão pelo super nó
+	relayLimit      = 256 // Banda de cada transferência retransmitida, em KiB/s (0 = sem limite)
+	relayTotalLimit = 0   // Banda total das retransmissões, em KiB/s (0 = sem limite)
+	maxRelays       = 4   // Retransmissões simultâneas
+	relayTimeout    = 30 * time.Second
+	relayLimiter    *p2p.RateLimiter
+	relaySlots      chan struct{}
+	relayMu         sync.Mutex
+	relays          = make(map[string]*relaySession)   // token -> retransmissão aguardando as duas pontas
+	reachability    = make(map[string]reachState)      // Porta de arquivos do cliente (IP:porta) -> resultado da última sondagem
+	controlChannels = make(map[string]*controlChannel) // Endereço (IP:porta) da conexão -> canal de controle
+
+	sessionTimeout = 45 * time.Second // Sessão sem nenhuma mensagem (nem PING) por este tempo é encerrada
+
+	subscriptions = make(map[string][]*subscription) // IP do cliente -> assinaturas
+
+	// Clientes desconectados ficam "suspeitos" por gracePeriod antes de perderem os arquivos
+	gracePeriod        = 60 * time.Second
+	suspectClients     = make(map[string]time.Time)    // IP do cliente -> quando caiu a última sessão
+	sessionTokens      = make(map[string]sessionToken) // token -> sessão que ele retoma
+	clientTokens       = make(map[string]string)       // IP do cliente -> token
+	nextSubscriptionID = 0
+
+	// Saúde dos detentores: sondagens periódicas e relatos de downloads que falharam
+	probeInterval      = 2 * time.Minute // Intervalo entre as sondagens dos detentores (0 desativa)
+	probeBatch         = 50              // Hashes conferidos por detentor em cada sondagem
+	maxHolderFailures  = 3               // Falhas seguidas que tiram o detentor do índice
+	probeRound         = 0
+	holderReportWindow = 10 * time.Minute           // Janela em que cada cliente conta uma falha por detentor e conteúdo
+	holderReports      = make(map[string]time.Time) // hash|detentor|quem relatou -> último relato contado
+
+	// Administração do coordenador: API HTTP e painel
+	adminAddr       = "127.0.0.1:8088" // Endereço da API de administração (vazio desativa)
+	adminToken      = ""               // Token exigido pela API (Authorization: Bearer); vazio dispensa
+	adminOnce       sync.Once
+	statsInterval   = 10 * time.Second         // Intervalo entre as consultas de estado aos super nós
+	nodeStatuses    = make(map[int]nodeStatus) // ID do super nó -> último estado consultado
+	electionHistory []electionEvent            // Eleições e trocas de coordenador vistas por este nó
+
+	// Sessões de clientes e buscas federadas, listadas pela API de administração do super nó
+	sessionsMu       sync.Mutex
+	clientSessions   = make(map[string]map[*clientSession]bool) // IP do cliente -> sessões abertas
+	inflightSearches = make(map[int]*federatedSearch)           // Buscas em outros super nós em andamento
+	nextSearchID     = 0
+
+	useDHT      = false // Localiza arquivos pela DHT em vez de broadcast
+	dhtFallback = false // Com a DHT, faz broadcast quando ela não encontra o arquivo
+	dhtReplicas = 2     // Quantidade de super nós responsáveis por cada chave
+	dhtRing     []dhtNode
+	dhtIndex    = make(map[string]map[string]bool) // Chaves sob responsabilidade deste nó
+)
+
+func handleSuperNodeRegistration(conn net.Conn, nodeId int) {
+	defer conn.Close()
+
+	if !p2p.PeerHasRole(conn, p2p.RoleNode) {
+		return
+	}
+
+	// Extrai o endereço IP do SuperNode
+	superNodeAddress := strings.Split(conn.RemoteAddr().String(), ":")[0]
+	slog.Info("Registro de super nó recebido", "id", nodeId, "addr", superNodeAddress)
+
+	// Envia o ID do SuperNode e a chave pública do coordenador
+	_, err := fmt.Fprintf(conn, "%d %s", nodeId, base64.StdEncoding.EncodeToString(nodePublicKey))
+	if err != nil {
+		slog.Error("Erro ao enviar o ID ao super nó", "id", nodeId, "error", err)
+		registrationsTotal.Inc(`result="error"`)
+		return
+	}
+
+	// Guarda o endereço do SuperNode
+	mu.Lock()
+	mu.Unlock()
+
+	// Recebe confirmação do SuperNode
+	buf := make([]byte, 1024)
+	n, responseError := conn.Read(buf)
+	if responseError != nil {
+		slog.Error("Erro ao ler a confirmação do super nó", "id", nodeId, "error", responseError)
+		registrationsTotal.Inc(`result="error"`)
+		return
+	}
+
+	message := strings.TrimSpace(string(buf[:n]))
+
+	// Verifica se o SuperNode enviou "ACK <chave pública>"
+	parts := strings.Split(message, " ")
+	if parts[0] == "ACK" && len(parts) == 2 {
+		publicKey, err := decodePublicKey(parts[1])
+		if err != nil {
+			slog.Warn("Chave pública do super nó inválida", "id", nodeId, "error", err)
+			registrationsTotal.Inc(`result="error"`)
+			return
+		}
+		mu.Lock()
+		contToSucess++
+		superNodes[nodeId] = SuperNode{ID: nodeId, Addr: superNodeAddress, PublicKey: publicKey}
+		slog.Info("Super nó registrado", "id", nodeId, "addr", superNodeAddress)
+		registrationsTotal.Inc(`result="ok"`)
+		// Se todos os SuperNodes confirmaram, libera a comunicação
+		mu.Unlock()
+	}
+}
+
+func freeNode(superNode SuperNode) {
+	conn, err := p2p.Dial(superNode.Addr + releasePort)
+	if err != nil {
+		slog.Error("Erro ao conectar ao super nó para liberá-lo", "id", superNode.ID, "error", err)
+		releasesTotal.Inc(`result="error"`)
+		return
+	}
+
+	_, err = conn.Write([]byte("FINALIZED"))
+	if err != nil {
+		slog.Error("Erro ao enviar a liberação ao super nó", "id", superNode.ID, "error", err)
+		releasesTotal.Inc(`result="error"`)
+	} else {
+		slog.Info("Super nó liberado", "id", superNode.ID)
+		releasesTotal.Inc(`result="ok"`)
+	}
+	_ = conn.Close()
+}
+
+func freeSuperNodes() {
+	time.Sleep(5 * time.Second)
+
+	slog.Info("Todos os super nós registrados; liberando para comunicação")
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, superNode := range superNodes {
+		freeNode(superNode)
+	}
+}
+
+func addressAlreadyExist(address string) bool {
+	for _, node := range superNodes {
+		if node.Addr == address {
+			return true
+		}
+	}
+	return false
+}
+
+func broadcastSuperNodes() {
+	time.Sleep(2 * time.Second)
+	mu.Lock()
+
+	// Cria a lista "ip|chave" de todos os super nós, separada por vírgulas, e a assina
+	var nodeList []string
+	for _, node := range superNodes {
+		nodeList = append(nodeList, node.Addr+"|"+base64.StdEncoding.EncodeToString(node.PublicKey))
+	}
+	membershipEpoch++
+	message := signMessage(fmt.Sprintf("MEMBERS %d %d %s", currentTerm, membershipEpoch, strings.Join(nodeList, ",")))
+
+	for _, superNode := range superNodes {
+		conn, err := p2p.Dial(superNode.Addr + broadcastPort)
+
+		if err != nil {
+			slog.Error("Erro ao conectar ao super nó para enviar a lista", "id", superNode.ID, "error", err)
+			continue
+		}
+
+		// Envia a lista de super nós para o super nó atual
+		_, err = fmt.Fprintf(conn, "%s\n", message)
+		if err != nil {
+			slog.Error("Erro ao enviar a lista ao super nó", "id", superNode.ID, "error", err)
+		}
+
+		_ = conn.Close()
+	}
+	mu.Unlock()
+}
+
+// Arquivo identificado pelo hash SHA-256 do conteúdo; os nomes são apenas metadados
+type FileEntry struct {
+	Hash      string
+	Size      int64
+	Encrypted bool                  // Conteúdo cifrado pelo dono; o hash é o do texto cifrado
+	Holders   map[string]holderInfo // IP do cliente -> metadados com que ele publicou o arquivo
+}
+
+// Metadados de um detentor: nome publicado, dono do conteúdo e visibilidade
+type holderInfo struct {
+	Name       string
+	Owner      string // Usuário que publicou o conteúdo originalmente
+	Visibility string // "public", "group:<grupo>" ou "private"
+	KeyHolder  bool   // Guarda a chave de um conteúdo cifrado e a entrega a quem tem permissão
+	Failures   int    // Falhas seguidas: downloads que falharam ou sondagens sem resposta
+}
+
+// Resultado de uma busca: um conteúdo e os clientes que o possuem
+type fileMatch struct {
+	Hash       string
+	Size       int64
+	Holders    []string // IPs dos detentores
+	Name       string
+	Owner      string
+	Visibility string
+	Encrypted  bool
+	KeyHolders []string // IPs dos detentores que entregam a chave de conteúdo cifrado
+}
+
+// Detentores indicados a quem pediu o download, até que ele confirme
+type pendingDownload struct {
+	fileMatch
+	At time.Time
+}
+
+// Conta de usuário carregada do arquivo de usuários
+type userAccount struct {
+	TokenHash string // SHA-256 do token, em hexadecimal
+	Groups    []string
+}
+
+// Identidade de quem faz a requisição
+type clientIdentity struct {
+	User   string
+	Groups []string
+}
+
+const (
+	visibilityPublic  = "public"
+	visibilityPrivate = "private"
+	visibilityGroup   = "group:"
+)
+
+// Verifica se a identidade pode ver o conteúdo publicado pelo detentor
+func (id clientIdentity) canSee(holder holderInfo) bool {
+	if holder.Visibility == visibilityPublic || holder.Owner == id.User {
+		return true
+	}
+	if strings.HasPrefix(holder.Visibility, visibilityGroup) {
+		return id.inGroup(strings.TrimPrefix(holder.Visibility, visibilityGroup))
+	}
+	return false
+}
+
+func (id clientIdentity) inGroup(group string) bool {
+	for _, g := range id.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// Identidade de clientes sem autenticação: o IP distingue os "donos" anônimos
+func anonymousIdentity(clientIP string) clientIdentity {
+	return clientIdentity{User: "anon@" + clientIP}
+}
+
+// Valida a visibilidade pedida por quem publica o arquivo
+func validVisibility(id clientIdentity, visibility string) bool {
+	if visibility == visibilityPublic || visibility == visibilityPrivate {
+		return true
+	}
+	group := strings.TrimPrefix(visibility, visibilityGroup)
+	return strings.HasPrefix(visibility, visibilityGroup) && id.inGroup(group)
+}
+
+// Verifica se a visibilidade tem um dos formatos conhecidos, sem conferir a
+// identidade de quem publicou; usado nos anúncios de outros super nós
+func knownVisibility(visibility string) bool {
+	if visibility == visibilityPublic || visibility == visibilityPrivate {
+		return true
+	}
+	return strings.HasPrefix(visibility, visibilityGroup) && len(visibility) > len(visibilityGroup)
+}
+
+// Carrega o arquivo de usuários: uma conta por linha, no formato
+// "<usuário> <sha256 do token em hex> [grupo1,grupo2]"; linhas com # são ignoradas
+func loadUsers(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	loaded := make(map[string]userAccount)
+	for i, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 || len(fields[1]) != 64 {
+			return fmt.Errorf("linha %d de '%s' inválida", i+1, path)
+		}
+		account := userAccount{TokenHash: strings.ToLower(fields[1])}
+		if len(fields) > 2 {
+			account.Groups = strings.Split(fields[2], ",")
+		}
+		loaded[fields[0]] = account
+	}
+
+	mu.Lock()
+	users = loaded
+	mu.Unlock()
+	slog.Info("Usuários carregados", "count", len(loaded), "path", path)
+	return nil
+}
+
+// Confere o token do usuário com o hash guardado no arquivo de usuários
+func authenticate(user string, token string) (clientIdentity, bool) {
+	mu.Lock()
+	account, ok := users[user]
+	mu.Unlock()
+	if !ok {
+		return clientIdentity{}, false
+	}
+	sum := sha256.Sum256([]byte(token))
+	if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(account.TokenHash)) != 1 {
+		return clientIdentity{}, false
+	}
+	return clientIdentity{User: user, Groups: account.Groups}, true
+}
+
+// Com TLS mútuo, o certificado "client" (CN = usuário) dispensa o token,
+// exceto no modo de teste (ver p2p.PeerUser)
+func certificateIdentity(conn net.Conn) (clientIdentity, bool) {
+	user := p2p.PeerUser(conn)
+	if user == "" {
+		return clientIdentity{}, false
+	}
+	mu.Lock()
+	account, ok := users[user]
+	mu.Unlock()
+	if !ok {
+		return clientIdentity{}, false
+	}
+	return clientIdentity{User: user, Groups: account.Groups}, true
+}
+
+// Verifica se a chave de busca é um hash de conteúdo (SHA-256 em hexadecimal)
+func isContentHash(key string) bool {
+	if len(key) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(key)
+	return err == nil
+}
+
+// Os nomes trafegam escapados para não quebrar os campos separados por espaço
+func encodeName(name string) string {
+	return url.QueryEscape(name)
+}
+
+func decodeName(name string) (string, error) {
+	return url.QueryUnescape(name)
+}
+
+// O último campo de FOUND é "plain" ou, para conteúdo cifrado, "enc:<ips com a chave>"
+func formatMatch(match fileMatch) string {
+	encryption := "plain"
+	if match.Encrypted {
+		encryption = "enc:-"
+		if len(match.KeyHolders) > 0 {
+			encryption = "enc:" + strings.Join(match.KeyHolders, ",")
+		}
+	}
+	return fmt.Sprintf("FOUND %s %d %s %s %s %s %s", match.Hash, match.Size, strings.Join(match.Holders, ","),
+		encodeName(match.Name), encodeName(match.Owner), match.Visibility, encryption)
+}
+
+// Interpreta uma linha "FOUND <hash> <tamanho> <ip>[,<ip>...] <nome> <dono> <visibilidade> <cifragem>"
+func parseMatch(line string) (fileMatch, error) {
+	parts := strings.Split(strings.TrimSpace(line), " ")
+	if len(parts) != 8 || parts[0] != "FOUND" || !isContentHash(parts[1]) {
+		return fileMatch{}, fmt.Errorf("resposta de formato inesperado: %s", line)
+	}
+	size, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return fileMatch{}, fmt.Errorf("tamanho inválido: %s", parts[2])
+	}
+	name, err := decodeName(parts[4])
+	if err != nil {
+		return fileMatch{}, fmt.Errorf("nome inválido: %s", parts[4])
+	}
+	owner, err := decodeName(parts[5])
+	if err != nil {
+		return fileMatch{}, fmt.Errorf("dono inválido: %s", parts[5])
+	}
+	match := fileMatch{Hash: parts[1], Size: size, Holders: strings.Split(parts[3], ","), Name: name, Owner: owner, Visibility: parts[6]}
+	if strings.HasPrefix(parts[7], "enc:") {
+		match.Encrypted = true
+		if keyHolders := strings.TrimPrefix(parts[7], "enc:"); keyHolders != "-" {
+			match.KeyHolders = strings.Split(keyHolders, ",")
+		}
+	}
+	return match, nil
+}
+
+// Adiciona um cliente como detentor do conteúdo. Exige mu travado.
+func addHolder(hash string, size int64, encrypted bool, clientIP string, holder holderInfo) {
+	entry := files[hash]
+	if entry == nil {
+		entry = &FileEntry{Hash: hash, Size: size, Encrypted: encrypted, Holders: make(map[string]holderInfo)}
+		files[hash] = entry
+	}
+	entry.Holders[clientIP] = holder
+	if fileNames[holder.Name] == nil {
+		fileNames[holder.Name] = make(map[string]bool)
+	}
+	fileNames[holder.Name][hash] = true
+}
+
+// Remove o cliente dos detentores do conteúdo, apagando a entrada quando
+// ninguém mais o possui. Exige mu travado.
+func removeHolder(hash string, clientIP string) {
+	entry := files[hash]
+	if entry == nil {
+		return
+	}
+	holder, ok := entry.Holders[clientIP]
+	if !ok {
+		return
+	}
+	delete(entry.Holders, clientIP)
+	if useDHT {
+		go dhtUnpublishHolder(entry.Hash, entry.Size, entry.Encrypted, clientIP, holder)
+	}
+
+	// Avisa quem está baixando o conteúdo de que este detentor saiu
+	for requester, pending := range pendingDownloads {
+		if match, ok := pending[hash]; ok && containsString(match.Holders, clientIP) {
+			go deliverLocalControl(requester, fmt.Sprintf("HOLDER_GONE %s %s", hash, clientIP))
+		}
+	}
+
+	// O nome só deixa de apontar para o hash se nenhum outro detentor o usa
+	nameInUse := false
+	for _, other := range entry.Holders {
+		if other.Name == holder.Name {
+			nameInUse = true
+			break
+		}
+	}
+	if !nameInUse {
+		delete(fileNames[holder.Name], hash)
+		if len(fileNames[holder.Name]) == 0 {
+			delete(fileNames, holder.Name)
+		}
+	}
+	if len(entry.Holders) == 0 {
+		delete(files, hash)
+	}
+}
+
+// Procura no índice local por hash ou por nome, um resultado por conteúdo com
+// os detentores que a identidade tem permissão de ver. Exige mu travado.
+func localMatches(key string, id clientIdentity) []fileMatch {
+	var hashes []string
+	if isContentHash(key) {
+		hashes = []string{key}
+	} else {
+		for hash := range fileNames[key] {
+			hashes = append(hashes, hash)
+		}
+	}
+
+	var matches []fileMatch
+	for _, hash := range hashes {
+		entry := files[hash]
+		if entry == nil {
+			continue
+		}
+		match := fileMatch{Hash: hash, Size: entry.Size, Encrypted: entry.Encrypted}
+		for clientIP, holder := range entry.Holders {
+			if !id.canSee(holder) {
+				continue
+			}
+			match.Holders = append(match.Holders, clientIP)
+			if entry.Encrypted && holder.KeyHolder {
+				match.KeyHolders = append(match.KeyHolders, clientIP)
+			}
+			if match.Name == "" || holder.Name == key {
+				match.Name, match.Owner, match.Visibility = holder.Name, holder.Owner, holder.Visibility
+			}
+		}
+		if len(match.Holders) == 0 {
+			continue
+		}
+		// Detentores suspeitos (desconectados, dentro do período de tolerância) vão para o
+		// fim, e entre os demais os que falharam por último ficam depois dos saudáveis
+		sort.Strings(match.Holders)
+		sort.SliceStable(match.Holders, func(i, j int) bool {
+			_, suspectI := suspectClients[match.Holders[i]]
+			_, suspectJ := suspectClients[match.Holders[j]]
+			if suspectI != suspectJ {
+				return suspectJ
+			}
+			return entry.Holders[match.Holders[i]].Failures < entry.Holders[match.Holders[j]].Failures
+		})
+		matches = append(matches, match)
+	}
+	return matches
+}
+
+// Sessão que pode ser retomada com RESUME
+type sessionToken struct {
+	IP   string
+	User string
+}
+
+// A última sessão do cliente caiu: os arquivos ficam no índice, como
+// suspeitos, até o fim do período de tolerância
+func suspendClient(clientIP string) {
+	if gracePeriod <= 0 {
+		dropClient(clientIP)
+		return
+	}
+	since := time.Now()
+	mu.Lock()
+	suspectClients[clientIP] = since
+	mu.Unlock()
+	slog.Info("Cliente desconectado; arquivos suspeitos", "client", clientIP, "grace", gracePeriod)
+
+	time.AfterFunc(gracePeriod, func() {
+		mu.Lock()
+		expired := suspectClients[clientIP] == since
+		if expired {
+			delete(suspectClients, clientIP)
+		}
+		mu.Unlock()
+		if expired {
+			dropClient(clientIP)
+		}
+	})
+}
+
+// Tira do super nó tudo o que pertence a um cliente que não voltou
+func dropClient(clientIP string) {
+	slog.Info("Cliente não voltou; removendo seus arquivos", "client", clientIP)
+	removeClientFiles(clientIP)
+	mu.Lock()
+	delete(subscriptions, clientIP)
+	if token, ok := clientTokens[clientIP]; ok {
+		delete(sessionTokens, token)
+		delete(clientTokens, clientIP)
+	}
+	mu.Unlock()
+}
+
+// Entrega ao cliente o token da sua sessão, criando-o na primeira vez
+func handleSessionToken(conn net.Conn, id clientIdentity) {
+	clientIP := strings.Split(conn.RemoteAddr().String(), ":")[0]
+	mu.Lock()
+	token, ok := clientTokens[clientIP]
+	if !ok {
+		raw := make([]byte, 16)
+		rand.Read(raw)
+		token = hex.EncodeToString(raw)
+		clientTokens[clientIP] = token
+		sessionTokens[token] = sessionToken{IP: clientIP, User: id.User}
+	}
+	mu.Unlock()
+	fmt.Fprintf(conn, "OK %s\n", token)
+}
+
+// Retoma a sessão do token. Se o cliente voltou por outro IP, os arquivos,
+// assinaturas e downloads pendentes passam para o novo IP. Sem arquivo de
+// usuários a identidade é o próprio IP ("anon@<ip>"), então só o token vale,
+// e os arquivos publicados pelo cliente passam a ser do novo "anon@<ip>".
+func handleResume(conn net.Conn, id clientIdentity, token string) {
+	newIP := strings.Split(conn.RemoteAddr().String(), ":")[0]
+
+	mu.Lock()
+	session, ok := sessionTokens[token]
+	if !ok || (usersFile != "" && session.User != id.User) {
+		mu.Unlock()
+		fmt.Fprintf(conn, "ERROR: Sessão desconhecida ou expirada\n")
+		return
+	}
+	oldIP := session.IP
+	if _, suspect := suspectClients[oldIP]; oldIP != newIP && !suspect {
+		mu.Unlock()
+		fmt.Fprintf(conn, "ERROR: Sessão ainda ativa em %s\n", oldIP)
+		return
+	}
+	delete(suspectClients, oldIP)
+
+	restored := 0
+	type movedHolder struct {
+		entry    *FileEntry
+		previous holderInfo
+		holder   holderInfo
+	}
+	var moved []movedHolder
+	for _, entry := range files {
+		if previous, ok := entry.Holders[oldIP]; ok {
+			restored++
+			if oldIP != newIP {
+				// Cópias baixadas de outros mantêm o dono original
+				holder := previous
+				if holder.Owner == session.User {
+					holder.Owner = id.User
+				}
+				delete(entry.Holders, oldIP)
+				entry.Holders[newIP] = holder
+				moved = append(moved, movedHolder{entry, previous, holder})
+			}
+		}
+	}
+	if oldIP != newIP {
+		subscriptions[newIP] = append(subscriptions[newIP], subscriptions[oldIP]...)
+		delete(subscriptions, oldIP)
+		if pending, ok := pendingDownloads[oldIP]; ok {
+			pendingDownloads[newIP] = pending
+			delete(pendingDownloads, oldIP)
+		}
+		delete(clientTokens, oldIP)
+		clientTokens[newIP] = token
+		sessionTokens[token] = sessionToken{IP: newIP, User: id.User}
+	}
+	mu.Unlock()
+
+	if useDHT {
+		for _, m := range moved {
+			go dhtUnpublishHolder(m.entry.Hash, m.entry.Size, m.entry.Encrypted, oldIP, m.previous)
+			go dhtPublishHolder(m.entry.Hash, m.entry.Size, m.entry.Encrypted, newIP, m.holder)
+		}
+	}
+	slog.Info("Sessão retomada", "client", newIP, "previous", oldIP, "files", restored)
+	fmt.Fprintf(conn, "OK %d\n", restored)
+}
+
+// Remove todos os arquivos pertencentes a um cliente desconectado
+func removeClientFiles(clientIP string) {
+	mu.Lock()
+	defer mu.Unlock()
+	delete(pendingDownloads, clientIP)
+	for hash, entry := range files {
+		if holder, ok := entry.Holders[clientIP]; ok {
+			removeHolder(hash, clientIP)
+			slog.Debug("Detentor removido do índice", "client", clientIP, "file", holder.Name, "hash", hash)
+		}
+	}
+}
+
+func handleUpload(conn net.Conn, id clientIdentity, hash string, size int64, fileName string, visibility string, encrypted bool, keyHolder bool) {
+	baseFileName := filepath.Base(fileName)
+	ipClient := strings.Split(conn.RemoteAddr().String(), ":")[0]
+
+	slog.Debug("Iniciando upload", "client", ipClient, "file", baseFileName, "hash", hash)
+
+	if !validVisibility(id, visibility) {
+		fmt.Fprintf(conn, "ERROR: Visibilidade '%s' inválida; use public, private ou group:<grupo> de um grupo do usuário\n", visibility)
+		return
+	}
+
+	// Quem cifrou o conteúdo guarda a chave e a entrega a quem tiver permissão
+	holder := holderInfo{Name: baseFileName, Owner: id.User, Visibility: visibility, KeyHolder: keyHolder}
+	mu.Lock()
+	if entry := files[hash]; entry != nil && (entry.Size != size || entry.Encrypted != encrypted) {
+		mu.Unlock()
+		fmt.Fprintf(conn, "ERROR: Tamanho ou cifragem divergem do já registrado para o hash %s\n", hash)
+		return
+	}
+	addHolder(hash, size, encrypted, ipClient, holder)
+	holders := len(files[hash].Holders)
+	mu.Unlock()
+
+	if useDHT {
+		go dhtPublishHolder(hash, size, encrypted, ipClient, holder)
+	}
+	go announceUpload(hash, holder, holders == 1)
+
+	slog.Info("Arquivo registrado", "client", ipClient, "file", baseFileName, "hash", hash, "owner", id.User, "visibility", visibility, "holders", holders)
+
+	if _, err := fmt.Fprintf(conn, "OK Upload registrado no super nó.\n"); err != nil {
+		slog.Error("Erro ao confirmar o upload ao cliente", "client", ipClient, "error", err)
+		return
+	}
+
+	slog.Debug("Upload concluído", "client", ipClient, "file", baseFileName)
+}
+
+// Retira o cliente dos detentores de um conteúdo que ele deixou de compartilhar
+func handleRemove(conn net.Conn, hash string) {
+	ipClient := strings.Split(conn.RemoteAddr().String(), ":")[0]
+
+	mu.Lock()
+	entry := files[hash]
+	if entry == nil {
+		mu.Unlock()
+		fmt.Fprintf(conn, "ERROR: Arquivo %s não registrado\n", hash)
+		return
+	}
+	holder, ok := entry.Holders[ipClient]
+	if ok {
+		removeHolder(hash, ipClient)
+	}
+	mu.Unlock()
+
+	if !ok {
+		fmt.Fprintf(conn, "ERROR: Cliente não possui o arquivo %s\n", hash)
+		return
+	}
+	slog.Info("Cliente deixou de compartilhar o arquivo", "client", ipClient, "file", holder.Name, "hash", hash)
+	fmt.Fprintf(conn, "OK Arquivo removido do super nó.\n")
+}
+
+// Função para fazer broadcast aos demais super nós em busca do arquivo (por hash ou nome);
+// todos respondem, e os detentores de um mesmo conteúdo são somados
+func broadcastRequest(key string, id clientIdentity, parent p2p.SpanContext) []fileMatch {
+	mu.Lock()
+	nodes := append([]string(nil), knownSuperNodes...)
+	mu.Unlock()
+
+	sp := p2p.StartSpan("broadcast", p2p.SpanInternal, parent)
+	sp.Set("file", key)
+	queries := 0
+	start := time.Now()
+	defer func() {
+		broadcastDuration.Observe("", time.Since(start).Seconds())
+		sp.Set("queries", queries)
+		sp.End(nil)
+	}()
+	var matches []fileMatch
+	for _, addr := range nodes {
+		if addr == "" || addr == superNodeAddr {
+			continue
+		}
+		broadcastQueries.Inc("")
+		queries++
+		matches = mergeMatches(matches, searchSuperNode(addr, key, id, sp.Context))
+	}
+	return matches
+}
+
+// Junta resultados de super nós diferentes, somando os detentores de um mesmo conteúdo
+func mergeMatches(matches []fileMatch, more []fileMatch) []fileMatch {
+	for _, match := range more {
+		i := 0
+		for i < len(matches) && matches[i].Hash != match.Hash {
+			i++
+		}
+		if i == len(matches) {
+			matches = append(matches, match)
+			continue
+		}
+		for _, holder := range match.Holders {
+			if !containsString(matches[i].Holders, holder) {
+				matches[i].Holders = append(matches[i].Holders, holder)
+			}
+		}
+		for _, holder := range match.KeyHolders {
+			if !containsString(matches[i].KeyHolders, holder) {
+				matches[i].KeyHolders = append(matches[i].KeyHolders, holder)
+			}
+		}
+	}
+	return matches
+}
+
+// Pergunta a um super nó quais conteúdos locais correspondem à chave e são
+// visíveis para a identidade de quem pediu
+func searchSuperNode(addr string, key string, id clientIdentity, parent p2p.SpanContext) []fileMatch {
+	return querySuperNode(addr, "SEARCH", key, id, parent)
+}
+
+// Envia uma busca (SEARCH por nome ou hash, FIND por padrão de nome) a um
+// super nó e lê os resultados até END
+func querySuperNode(addr string, command string, key string, id clientIdentity, parent p2p.SpanContext) []fileMatch {
+	sp := p2p.StartSpan(command, p2p.SpanClient, parent)
+	sp.Set("addr", addr)
+	sp.Set("key", key)
+	var failure error
+	var matches []fileMatch
+	defer func() {
+		sp.Set("results", len(matches))
+		sp.End(failure)
+	}()
+
+	reqLog := slog.With("request", sp.Context.TraceID, "addr", addr)
+	conn, err := p2p.Dial(addr + clientPort)
+	if err != nil {
+		reqLog.Error("Erro ao conectar ao super nó para a busca", "error", err)
+		failure = err
+		return nil
+	}
+	defer conn.Close()
+
+	reqLog.Debug("Consultando super nó", "command", command, "key", key)
+
+	// Envia a requisição de busca: SEARCH|FIND <chave> <usuário> <grupos> <traceparent>;
+	// o contexto de rastreamento segue para os spans e logs do outro super nó
+	groups := "-"
+	if len(id.Groups) > 0 {
+		groups = strings.Join(id.Groups, ",")
+	}
+	if _, err := fmt.Fprintf(conn, "%s %s %s %s %s\n", command, encodeName(key), encodeName(id.User), groups, sp.Context.Traceparent()); err != nil {
+		reqLog.Error("Erro ao enviar a busca ao super nó", "error", err)
+		failure = err
+		return nil
+	}
+
+	// Lê as respostas até END (ou NOTFOUND)
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			reqLog.Error("Erro ao ler a resposta do super nó", "error", err)
+			failure = err
+			return matches
+		}
+		resp := strings.TrimSpace(line)
+		if resp == "END" || resp == "NOTFOUND" {
+			break
+		}
+		match, err := parseMatch(resp)
+		if err != nil {
+			reqLog.Warn("Resposta de formato inesperado do super nó", "response", resp)
+			continue
+		}
+		matches = append(matches, match)
+	}
+
+	if len(matches) > 0 {
+		reqLog.Info("Encontrado em outro super nó", "key", key, "holders", matches[0].Holders)
+	} else {
+		reqLog.Debug("Não encontrado no super nó", "key", key)
+	}
+	return matches
+}
+
+func handleDownload(conn net.Conn, id clientIdentity, key string, parent p2p.SpanContext) {
+	if !isContentHash(key) {
+		key = filepath.Base(key)
+	}
+	requestingIP := strings.Split(conn.RemoteAddr().String(), ":")[0]
+	sp := p2p.StartSpan("DOWNLOAD", p2p.SpanServer, parent)
+	sp.Set("client", requestingIP)
+	sp.Set("file", key)
+	var failure error
+	defer func() { sp.End(failure) }()
+	reqLog := slog.With("request", sp.Context.TraceID, "client", requestingIP, "file", key)
+
+	mu.Lock()
+	matches := localMatches(key, id)
+	local := len(matches) > 0
+	mu.Unlock()
+	reqLog.Debug("Índice local consultado", "found", local)
+
+	if !local {
+		if !acquireSearchSlot() {
+			reqLog.Warn("Busca remota recusada: limite de buscas simultâneas atingido")
+			downloadLookups.Inc(`result="busy"`)
+			failure = fmt.Errorf("limite de buscas simultâneas atingido")
+			fmt.Fprintf(conn, "ERROR: Super nó ocupado com outras buscas, tente novamente mais tarde\n")
+			return
+		}
+
+		// Com a DHT, a resposta dela é definitiva, a menos que -dht-fallback
+		// permita o broadcast; sem a DHT, pergunta a todos os super nós
+		searchID := beginSearch("download", key, requestingIP, id, sp.Context.TraceID)
+		if useDHT {
+			matches = dhtLookup(key, id, sp.Context)
+		}
+		if len(matches) == 0 && (!useDHT || dhtFallback) {
+			reqLog.Debug("Iniciando busca nos outros super nós")
+			matches = broadcastRequest(key, id, sp.Context)
+		}
+		endSearch(searchID)
+		releaseSearchSlot()
+		if len(matches) == 0 {
+			downloadLookups.Inc(`result="miss"`)
+			reqLog.Info("Arquivo não encontrado em nenhum super nó")
+			failure = fmt.Errorf("arquivo não encontrado em nenhum super nó")
+			fmt.Fprintf(conn, "NOTFOUND Arquivo '%s' não encontrado em nenhum super nó\n", key)
+			return
+		}
+		downloadLookups.Inc(`result="remote"`)
+		sp.Set("lookup", "remote")
+	} else {
+		downloadLookups.Inc(`result="local"`)
+		sp.Set("lookup", "local")
+	}
+
+	// Um nome pode corresponder a conteúdos diferentes; nesse caso o cliente escolhe pelo hash
+	if len(matches) > 1 {
+		var options []string
+		for _, match := range matches {
+			options = append(options, fmt.Sprintf("%s (%d bytes)", match.Hash, match.Size))
+		}
+		reqLog.Info("Nome com vários conteúdos; o cliente deve baixar pelo hash", "contents", len(matches))
+		failure = fmt.Errorf("%d conteúdos com o mesmo nome", len(matches))
+		fmt.Fprintf(conn, "ERROR: Há %d arquivos diferentes chamados '%s'; baixe pelo hash: %s\n", len(matches), key, strings.Join(options, ", "))
+		return
+	}
+
+	// Verifica e sanitiza os IPs dos detentores antes de enviar a resposta
+	match := matches[0]
+	var holders []string
+	for _, holderIP := range match.Holders {
+		holderIP = strings.TrimSpace(holderIP) // Sanitiza o IP removendo espaços extras
+		if net.ParseIP(holderIP) == nil {
+			reqLog.Warn("IP de detentor inválido", "holder", holderIP)
+			continue
+		}
+		if holderIP != requestingIP {
+			holders = append(holders, holderIP)
+		}
+	}
+	if len(holders) == 0 {
+		failure = fmt.Errorf("nenhum detentor válido")
+		fmt.Fprintf(conn, "ERROR: Nenhum cliente válido possui o arquivo '%s'\n", key)
+		return
+	}
+	match.Holders = holders
+	var keyHolders []string
+	for _, holderIP := range match.KeyHolders {
+		if net.ParseIP(holderIP) != nil && holderIP != requestingIP {
+			keyHolders = append(keyHolders, holderIP)
+		}
+	}
+	match.KeyHolders = keyHolders
+
+	// Quem baixa muito mais do que envia recebe menos detentores
+	mu.Lock()
+	ratio := shareRatio(requestingIP)
+	mu.Unlock()
+	if ratio < leecherRatio && len(holders) > leecherHolders {
+		reqLog.Info("Cliente com razão baixa recebe menos detentores", "ratio", ratio, "holders", leecherHolders)
+		holders = holders[:leecherHolders]
+		match.Holders = holders
+	}
+
+	// O solicitante só vira detentor depois de confirmar o download (CONFIRM);
+	// a cópia mantém o dono e a visibilidade do original
+	mu.Lock()
+	if pendingDownloads[requestingIP] == nil {
+		pendingDownloads[requestingIP] = make(map[string]pendingDownload)
+	}
+	pendingDownloads[requestingIP][match.Hash] = pendingDownload{fileMatch: match, At: time.Now()}
+	for _, holder := range match.Holders {
+		issuedTransfer[transferKey(match.Hash, holder, requestingIP)] = pendingDownload{fileMatch: match, At: time.Now()}
+	}
+	mu.Unlock()
+
+	// Envia resposta ao cliente solicitante
+	reqLog.Info("Detentores indicados ao cliente", "hash", match.Hash, "holders", holders)
+	sp.Set("hash", match.Hash)
+	sp.Set("holders", len(holders))
+	if _, err := fmt.Fprintf(conn, "%s\n", formatMatch(match)); err != nil {
+		reqLog.Error("Erro ao enviar a resposta ao cliente", "error", err)
+		failure = err
+	}
+}
+
+// Registra o cliente como detentor de um conteúdo que ele baixou e verificou.
+// Só são aceitas confirmações de downloads indicados por este super nó.
+func handleConfirm(conn net.Conn, hash string, size int64, fileName string, parent p2p.SpanContext) {
+	baseFileName := filepath.Base(fileName)
+	ipClient := strings.Split(conn.RemoteAddr().String(), ":")[0]
+	sp := p2p.StartSpan("CONFIRM", p2p.SpanServer, parent)
+	sp.Set("client", ipClient)
+	sp.Set("hash", hash)
+	var failure error
+	defer func() { sp.End(failure) }()
+
+	mu.Lock()
+	match, pending := pendingDownloads[ipClient][hash]
+	if !pending || match.Size != size || time.Since(match.At) > pendingTimeout {
+		mu.Unlock()
+		slog.Warn("Confirmação recusada: download não solicitado", "client", ipClient, "hash", hash)
+		failure = fmt.Errorf("download não solicitado")
+		fmt.Fprintf(conn, "ERROR: Nenhum download pendente do arquivo %s com %d bytes\n", hash, size)
+		return
+	}
+	delete(pendingDownloads[ipClient], hash)
+	if len(pendingDownloads[ipClient]) == 0 {
+		delete(pendingDownloads, ipClient)
+	}
+	holder := holderInfo{Name: baseFileName, Owner: match.Owner, Visibility: match.Visibility}
+	addHolder(hash, size, match.Encrypted, ipClient, holder)
+	mu.Unlock()
+
+	if useDHT {
+		go dhtPublishHolder(hash, size, match.Encrypted, ipClient, holder)
+	}
+
+	slog.Info("Download confirmado; cliente passou a ser detentor", "client", ipClient, "file", baseFileName, "hash", hash)
+	fmt.Fprintf(conn, "OK Download confirmado no super nó.\n")
+}
+
+func handleClient(conn net.Conn) {
+	clientIP := strings.Split(conn.RemoteAddr().String(), ":")[0]
+
+	// Clientes e outros super nós (buscas federadas) usam esta porta; o
+	// papel é conferido uma vez só, no handshake
+	role, ok := p2p.PeerRole(conn)
+	if !ok || (p2p.TLSConfig != nil && !p2p.AcceptRole(conn, role, p2p.RoleClient, p2p.RoleNode)) {
+		conn.Close()
+		return
+	}
+
+	// Só um certificado "node" ou, sem TLS, um IP da lista assinada de super
+	// nós libera os comandos trocados entre super nós
+	exempt := isKnownSuperNode(clientIP)
+	fromNode := role == p2p.RoleNode || (p2p.TLSConfig == nil && exempt)
+	if err := openSession(clientIP, exempt); err != nil {
+		slog.Warn("Conexão recusada", "client", clientIP, "error", err)
+		fmt.Fprintf(conn, "ERROR: %v\n", err)
+		conn.Close()
+		return
+	}
+	if !exempt {
+		go probeClient(clientIP, p2p.PeerCommonName(conn))
+	}
+
+	// Sem arquivo de usuários as sessões são anônimas; com ele, o cliente se
+	// identifica pelo certificado TLS ou pelo comando AUTH
+	identity := anonymousIdentity(clientIP)
+	authenticated := usersFile == ""
+	if !authenticated {
+		identity, authenticated = certificateIdentity(conn)
+		if authenticated {
+			slog.Info("Cliente autenticado pelo certificado", "client", clientIP, "user", identity.User)
+		}
+	}
+
+	// Quando a última sessão do IP termina, os arquivos do cliente ficam suspeitos durante o período de tolerância
+	var control *controlChannel
+	var session *clientSession
+	if !exempt {
+		session = registerSession(clientIP, conn)
+	}
+	defer func() {
+		if control != nil {
+			mu.Lock()
+			if controlChannels[control.addr] == control {
+				delete(controlChannels, control.addr)
+			}
+			mu.Unlock()
+		}
+		kicked := session != nil && unregisterSession(clientIP, session)
+		if closeSession(clientIP) == 0 && !exempt {
+			if kicked {
+				dropClient(clientIP)
+			} else {
+				suspendClient(clientIP)
+			}
+		}
+		conn.Close()
+	}()
+	if !exempt {
+		mu.Lock()
+		if _, suspect := suspectClients[clientIP]; suspect {
+			delete(suspectClients, clientIP)
+			slog.Info("Cliente voltou dentro do período de tolerância", "client", clientIP)
+		}
+		mu.Unlock()
+	}
+
+	reader := bufio.NewReader(conn)
+	for conn != nil {
+		if masterNode() {
+			conn.Close()
+			return
+		}
+
+		// Clientes enviam PING periodicamente; uma sessão calada por sessionTimeout é dada como morta
+		conn.SetReadDeadline(time.Now().Add(sessionTimeout))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				slog.Info("Sessão sem atividade encerrada", "client", clientIP, "timeout", sessionTimeout)
+			} else if err == io.EOF {
+				slog.Info("Conexão encerrada pelo cliente", "client", clientIP)
+			} else {
+				slog.Error("Erro ao ler do cliente", "client", clientIP, "error", err)
+			}
+			return
+		}
+
+		parts := strings.Split(strings.TrimSpace(line), " ")
+		command := parts[0]
+
+		if !exempt {
+			touchSession(session, command, identity.User)
+			wait, err := allowRequest(clientIP)
+			if err != nil {
+				slog.Warn("Requisição recusada", "client", clientIP, "command", command, "error", err)
+				fmt.Fprintf(conn, "ERROR: %v\n", err)
+				if limitAction == limitBan {
+					return
+				}
+				continue
+			}
+			time.Sleep(wait)
+		}
+
+		if command == "PING" {
+			fmt.Fprintf(conn, "PONG\n")
+			continue
+		}
+
+		// Comandos entre super nós; de clientes, caem em "Comando inválido"
+		if fromNode && handleNodeCommand(conn, clientIP, parts) {
+			continue
+		}
+
+		if command == "AUTH" && len(parts) == 3 {
+			// AUTH <usuário> <token>
+			if id, ok := authenticate(parts[1], parts[2]); ok {
+				identity, authenticated = id, true
+				slog.Info("Cliente autenticado", "client", clientIP, "user", id.User)
+				fmt.Fprintf(conn, "OK Autenticado como %s.\n", id.User)
+			} else {
+				slog.Warn("Falha de autenticação", "client", clientIP, "user", parts[1])
+				fmt.Fprintf(conn, "ERROR: Usuário ou token inválido\n")
+			}
+			continue
+		}
+		if !authenticated && command != "CLOSE" {
+			fmt.Fprintf(conn, "ERROR: Autenticação necessária (AUTH <usuário> <token>)\n")
+			continue
+		}
+
+		switch {
+		case command == "UPLOAD" && len(parts) >= 4 && len(parts) <= 6:
+			// UPLOAD <hash> <tamanho> <nome> [visibilidade] [enc]
+			size, sizeErr := strconv.ParseInt(parts[2], 10, 64)
+			name, nameErr := decodeName(parts[3])
+			// "enc": conteúdo cifrado por este cliente, que entrega a chave;
+			// "enccopy": cópia cifrada baixada de outro, que não entrega a chave
+			if !isContentHash(parts[1]) || sizeErr != nil || size < 0 || nameErr != nil || (len(parts) == 6 && parts[5] != "enc" && parts[5] != "enccopy") {
+				fmt.Fprintf(conn, "ERROR: Upload inválido, esperado UPLOAD <hash> <tamanho> <nome> [visibilidade] [enc|enccopy]\n")
+				continue
+			}
+			visibility := visibilityPublic
+			if len(parts) >= 5 {
+				visibility = parts[4]
+			}
+			handleUpload(conn, identity, parts[1], size, name, visibility, len(parts) == 6, len(parts) == 6 && parts[5] == "enc")
+		case command == "REPORT" && len(parts) == 5:
+			// REPORT SENT|RECV <hash> <bytes> <ip do outro cliente>
+			handleReport(conn, parts[1], parts[2], parts[3], parts[4])
+		case command == "RATIO" && len(parts) == 2:
+			// RATIO <ip>: usado pelos clientes para ordenar a fila de envio
+			handleRatio(conn, clientIP, parts[1])
+		case command == "GROUPS" && len(parts) == 2:
+			// GROUPS <usuário>: usado pelo detentor de um arquivo de grupo para autorizar o envio ou a entrega da chave
+			handleGroups(conn, clientIP, parts[1])
+		case command == "CONFIRM" && (len(parts) == 4 || len(parts) == 5):
+			// CONFIRM <hash> <tamanho> <nome> [traceparent]: download concluído e verificado pelo cliente
+			size, sizeErr := strconv.ParseInt(parts[2], 10, 64)
+			name, nameErr := decodeName(parts[3])
+			if sizeErr != nil || nameErr != nil {
+				fmt.Fprintf(conn, "ERROR: Confirmação inválida, esperado CONFIRM <hash> <tamanho> <nome>\n")
+				continue
+			}
+			handleConfirm(conn, parts[1], size, name, p2p.RequestContext(parts, 4))
+		case command == "FAILED" && len(parts) == 3:
+			// FAILED <hash> <ip>: o download a partir deste detentor falhou
+			handleFailedReport(conn, parts[1], parts[2])
+		case command == "FIND" && (len(parts) == 2 || len(parts) == 3):
+			// FIND <padrão> [requisição]: lista os conteúdos cujo nome corresponde ao padrão, em todos os super nós
+			pattern, err := decodeName(parts[1])
+			if err != nil || pattern == "" {
+				fmt.Fprintf(conn, "ERROR: Busca inválida, esperado FIND <padrão> [requisição]\n")
+				continue
+			}
+			handleFind(conn, identity, pattern, p2p.RequestContext(parts, 2))
+		case command == "REMOVE" && len(parts) == 2:
+			// REMOVE <hash>: o cliente deixou de compartilhar o conteúdo
+			handleRemove(conn, parts[1])
+		case command == "DOWNLOAD" && (len(parts) == 2 || len(parts) == 3):
+			// DOWNLOAD <nome ou hash> [requisição]
+			key, err := decodeName(parts[1])
+			if err != nil {
+				fmt.Fprintf(conn, "Comando inválido\n")
+				continue
+			}
+			handleDownload(conn, identity, key, p2p.RequestContext(parts, 2))
+		case command == "CONTROL" && len(parts) == 1:
+			// Conexão dedicada aos pedidos que o super nó envia ao cliente
+			control = &controlChannel{conn: conn, addr: conn.RemoteAddr().String()}
+			mu.Lock()
+			controlChannels[control.addr] = control
+			mu.Unlock()
+			slog.Info("Canal de controle registrado", "client", clientIP)
+			fmt.Fprintf(conn, "OK Canal de controle registrado.\n")
+		case command == "SESSION" && len(parts) == 1:
+			// SESSION: token para retomar a sessão (RESUME) depois de uma queda
+			handleSessionToken(conn, identity)
+		case command == "RESUME" && len(parts) == 2:
+			// RESUME <token>: retoma os arquivos e assinaturas de uma sessão caída, mesmo de outro IP
+			handleResume(conn, identity, parts[1])
+		case command == "SUBSCRIBE" && len(parts) == 3:
+			// SUBSCRIBE <name|pattern|hash> <valor>: avisos chegam pelo canal de controle
+			handleSubscribe(conn, identity, parts[1], parts[2])
+		case command == "UNSUBSCRIBE" && len(parts) == 2:
+			handleUnsubscribe(conn, parts[1])
+		case command == "CONNECT" && (len(parts) == 4 || len(parts) == 5):
+			// CONNECT <ip do detentor> <hash> <token> [traceparent]: a conexão direta com o detentor falhou
+			handleConnect(conn, identity, parts[1], parts[2], parts[3], p2p.RequestContext(parts, 4))
+		case command == "CLOSE":
+			conn.Close()
+			return
+		default:
+			fmt.Fprintf(conn, "Comando inválido\n")
+		}
+	}
+}
+
+// Atende os comandos trocados entre super nós (e os pedidos do coordenador);
+// retorna false se a linha não é um deles. Quem chama já conferiu que a
+// conexão vem de um super nó.
+func handleNodeCommand(conn net.Conn, addr string, parts []string) bool {
+	command := parts[0]
+	switch {
+	case command == "DELIVER" && len(parts) == 3:
+		// Mensagens de controle repassadas por outros super nós para um cliente daqui
+		message, err := decodeName(parts[2])
+		if err == nil && deliverLocalControl(parts[1], message) {
+			fmt.Fprintf(conn, "OK\n")
+		} else {
+			fmt.Fprintf(conn, "NOTFOUND\n")
+		}
+	case command == "ANNOUNCE" && len(parts) == 5:
+		// Registros de arquivos em outros super nós, para avisar os assinantes
+		// daqui. Só aceitos de super nós (handleClient) e com uma visibilidade
+		// conhecida, para que um anúncio malformado não chegue a quem não pode ver
+		name, nameErr := decodeName(parts[2])
+		owner, ownerErr := decodeName(parts[3])
+		if !isContentHash(parts[1]) || nameErr != nil || ownerErr != nil || name == "" || owner == "" || !knownVisibility(parts[4]) {
+			slog.Warn("Anúncio inválido de outro super nó", "addr", addr, "hash", parts[1])
+			fmt.Fprintf(conn, "ERROR: Anúncio inválido, esperado ANNOUNCE <hash> <nome> <dono> <visibilidade>\n")
+			return true
+		}
+		go notifySubscribers(parts[1], holderInfo{Name: name, Owner: owner, Visibility: parts[4]})
+		fmt.Fprintf(conn, "OK\n")
+	case command == "STATS" && len(parts) == 1:
+		// Contagens do índice pedidas pelo coordenador
+		handleStats(conn)
+	case command == "TRANSFER" && len(parts) == 6:
+		// Relatos de transferência repassados por outros super nós, já
+		// conferidos pelo super nó que os recebeu do cliente
+		bytes, err := strconv.ParseInt(parts[3], 10, 64)
+		if err == nil && bytes > 0 {
+			mu.Lock()
+			applyTransferReport(parts[1], parts[2], bytes, parts[4], parts[5])
+			mu.Unlock()
+		}
+		fmt.Fprintf(conn, "OK\n")
+	case command == "HOLDERFAIL" && len(parts) == 4:
+		// HOLDERFAIL <hash> <detentor> <quem relatou>: falhas de download
+		// relatadas a outros super nós sobre detentores daqui
+		checkReportedHolder(parts[1], parts[2], parts[3])
+		fmt.Fprintf(conn, "OK\n")
+	case (command == "SEARCH" || command == "FIND") && (len(parts) == 4 || len(parts) == 5):
+		// Buscas federadas carregam a identidade do solicitante, autenticado
+		// pelo super nó de origem, e, opcionalmente, o contexto do trace
+		key, keyErr := decodeName(parts[1])
+		user, userErr := decodeName(parts[2])
+		if keyErr != nil || userErr != nil {
+			fmt.Fprintf(conn, "NOTFOUND\n")
+			return true
+		}
+		requester := clientIdentity{User: user}
+		if parts[3] != "-" {
+			requester.Groups = strings.Split(parts[3], ",")
+		}
+		parent := p2p.RequestContext(parts, 4)
+		if command == "FIND" {
+			sp := p2p.StartSpan("FIND", p2p.SpanServer, parent)
+			sp.Set("addr", addr)
+			sp.Set("pattern", key)
+			mu.Lock()
+			matches := patternMatches(key, requester)
+			mu.Unlock()
+			slog.Debug("Busca por padrão atendida", "request", sp.Context.TraceID, "addr", addr, "pattern", key, "results", len(matches))
+			writeMatches(conn, matches)
+			sp.Set("results", len(matches))
+			sp.End(nil)
+		} else {
+			handleSearch(conn, requester, key, parent)
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// Informa a razão de envio de um cliente. Quem pergunta só vê a própria razão
+// ou a de quem recebeu dele, por este super nó, a indicação de um download
+// ainda não confirmado: é quem pode estar na sua fila de envio. As razões dos
+// demais clientes só aparecem na API de administração.
+func handleRatio(conn net.Conn, askerIP string, ip string) {
+	mu.Lock()
+	visible := askerIP == ip || indicatedHolder(ip, askerIP)
+	ratio := shareRatio(ip)
+	mu.Unlock()
+	if !visible {
+		fmt.Fprintf(conn, "ERROR: Razão disponível apenas para o próprio IP ou para quem baixa deste cliente\n")
+		return
+	}
+	fmt.Fprintf(conn, "OK %.2f\n", ratio)
+}
+
+// Verifica se algum download pendente do cliente indicou o detentor. Requer mu.
+func indicatedHolder(clientIP string, holderIP string) bool {
+	for _, pending := range pendingDownloads[clientIP] {
+		if containsString(pending.Holders, holderIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Informa, dos grupos de um usuário, só aqueles em que quem pergunta publicou
+// algum arquivo: é o que o detentor precisa para decidir se entrega o arquivo
+// ou a chave, sem revelar os demais grupos do usuário. Usuários desconhecidos
+// não têm grupos.
+func handleGroups(conn net.Conn, askerIP string, user string) {
+	mu.Lock()
+	var groups []string
+	for _, group := range users[user].Groups {
+		if holdsGroupFile(askerIP, group) {
+			groups = append(groups, group)
+		}
+	}
+	mu.Unlock()
+	if len(groups) == 0 {
+		fmt.Fprintf(conn, "OK -\n")
+		return
+	}
+	fmt.Fprintf(conn, "OK %s\n", strings.Join(groups, ","))
+}
+
+// Verifica se o cliente publica algum arquivo visível ao grupo. Requer mu.
+func holdsGroupFile(clientIP string, group string) bool {
+	for _, entry := range files {
+		if holder, ok := entry.Holders[clientIP]; ok && holder.Visibility == visibilityGroup+group {
+			return true
+		}
+	}
+	return false
+}
+
+func handleSearch(conn net.Conn, id clientIdentity, key string, parent p2p.SpanContext) {
+	addr := strings.Split(conn.RemoteAddr().String(), ":")[0]
+	sp := p2p.StartSpan("SEARCH", p2p.SpanServer, parent)
+	sp.Set("addr", addr)
+	sp.Set("file", key)
+	defer sp.End(nil)
+	reqLog := slog.With("request", sp.Context.TraceID, "addr", addr, "file", key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	// Verifica se o arquivo existe localmente e retorna os detentores visíveis ao solicitante
+	matches := localMatches(key, id)
+	if len(matches) == 0 {
+		searchRequests.Inc(`result="miss"`)
+		sp.Set("result", "miss")
+		fmt.Fprintf(conn, "NOTFOUND\n")
+		reqLog.Debug("Busca de outro super nó sem resultado")
+		return
+	}
+	searchRequests.Inc(`result="hit"`)
+	sp.Set("result", "hit")
+	for _, match := range matches {
+		fmt.Fprintf(conn, "%s\n", formatMatch(match))
+		reqLog.Info("Busca de outro super nó respondida", "hash", match.Hash, "holders", match.Holders)
+	}
+	fmt.Fprintf(conn, "END\n")
+}
+
+// Conteúdos do índice local cujo nome corresponde ao padrão (como em
+// filepath.Match), um resultado por hash. Exige mu travado.
+func patternMatches(pattern string, id clientIdentity) []fileMatch {
+	var names []string
+	for name := range fileNames {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var matches []fileMatch
+	seen := make(map[string]bool)
+	for _, name := range names {
+		for _, match := range localMatches(name, id) {
+			if !seen[match.Hash] {
+				seen[match.Hash] = true
+				matches = append(matches, match)
+			}
+		}
+	}
+	return matches
+}
+
+// Escreve os resultados de uma busca, um FOUND por linha, terminados por END
+func writeMatches(conn net.Conn, matches []fileMatch) {
+	for _, match := range matches {
+		fmt.Fprintf(conn, "%s\n", formatMatch(match))
+	}
+	fmt.Fprintf(conn, "END\n")
+}
+
+// Busca por padrão pedida por um cliente: junta o índice local e o de todos os
+// outros super nós, somando os detentores de um mesmo conteúdo
+func handleFind(conn net.Conn, id clientIdentity, pattern string, parent p2p.SpanContext) {
+	clientIP := strings.Split(conn.RemoteAddr().String(), ":")[0]
+	sp := p2p.StartSpan("FIND", p2p.SpanServer, parent)
+	sp.Set("client", clientIP)
+	sp.Set("pattern", pattern)
+
+	mu.Lock()
+	matches := patternMatches(pattern, id)
+	nodes := append([]string(nil), knownSuperNodes...)
+	mu.Unlock()
+
+	if !acquireSearchSlot() {
+		sp.End(fmt.Errorf("limite de buscas simultâneas atingido"))
+		fmt.Fprintf(conn, "ERROR: Super nó ocupado com outras buscas, tente novamente mais tarde\n")
+		return
+	}
+	searchID := beginSearch("find", pattern, clientIP, id, sp.Context.TraceID)
+	for _, addr := range nodes {
+		if addr == "" || addr == superNodeAddr {
+			continue
+		}
+		matches = mergeMatches(matches, querySuperNode(addr, "FIND", pattern, id, sp.Context))
+	}
+	endSearch(searchID)
+	releaseSearchSlot()
+	writeMatches(conn, matches)
+	sp.Set("results", len(matches))
+	sp.End(nil)
+}
+
+// Ações aplicadas a quem excede o limite de requisições
+const (
+	limitThrottle = "throttle" // Atrasa a requisição até haver crédito
+	limitReject   = "reject"   // Recusa a requisição com ERROR
+	limitBan      = "ban"      // Recusa, encerra a sessão e bloqueia o IP por banDuration
+)
+
+// Estado dos limites de um IP: balde de requisições, sessões abertas e bloqueio
+type clientLimit struct {
+	tokens      float64
+	lastRefill  time.Time
+	sessions    int
+	bannedUntil time.Time
+}
+
+// Contadores de aplicação dos limites
+type enforcementStats struct {
+	Throttled       int // Requisições atrasadas
+	Rejected        int // Requisições recusadas
+	Bans            int // Bloqueios de IP
+	SessionsRefused int // Conexões recusadas (IP bloqueado ou sessões demais)
+	SearchesRefused int // Buscas federadas recusadas por falta de vaga
+}
+
+// Requer limitsMu
+func limitFor(ip string) *clientLimit {
+	limit := clientLimits[ip]
+	if limit == nil {
+		limit = &clientLimit{tokens: rateBurst, lastRefill: time.Now()}
+		clientLimits[ip] = limit
+	}
+	return limit
+}
+
+// Super nós e coordenador não estão sujeitos aos limites de clientes
+func isKnownSuperNode(ip string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	if ip == coordinatorIP {
+		return true
+	}
+	for _, addr := range knownSuperNodes {
+		if addr == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// Registra uma nova sessão do IP, recusando IPs bloqueados e sessões além do limite
+func openSession(ip string, exempt bool) error {
+	limitsMu.Lock()
+	defer limitsMu.Unlock()
+	limit := limitFor(ip)
+	if remaining := time.Until(limit.bannedUntil); remaining > 0 {
+		limitStats.SessionsRefused++
+		return fmt.Errorf("IP bloqueado por mais %s", remaining.Round(time.Second))
+	}
+	if !exempt && maxSessionsPerIP > 0 && limit.sessions >= maxSessionsPerIP {
+		limitStats.SessionsRefused++
+		return fmt.Errorf("Limite de %d sessões simultâneas por IP atingido", maxSessionsPerIP)
+	}
+	limit.sessions++
+	return nil
+}
+
+// Encerra uma sessão e retorna quantas continuam abertas para o IP
+func closeSession(ip string) int {
+	limitsMu.Lock()
+	defer limitsMu.Unlock()
+	limit := limitFor(ip)
+	limit.sessions--
+	return limit.sessions
+}
+
+// Consome uma requisição do balde do IP. No modo throttle retorna quanto a
+// requisição deve esperar; nos demais, um erro quando o limite foi excedido.
+func allowRequest(ip string) (time.Duration, error) {
+	limitsMu.Lock()
+	defer limitsMu.Unlock()
+	limit := limitFor(ip)
+	now := time.Now()
+	if remaining := limit.bannedUntil.Sub(now); remaining > 0 {
+		limitStats.Rejected++
+		return 0, fmt.Errorf("IP bloqueado por mais %s", remaining.Round(time.Second))
+	}
+	if rateLimit <= 0 {
+		return 0, nil
+	}
+
+	limit.tokens += now.Sub(limit.lastRefill).Seconds() * rateLimit
+	if limit.tokens > rateBurst {
+		limit.tokens = rateBurst
+	}
+	limit.lastRefill = now
+	if limit.tokens >= 1 {
+		limit.tokens--
+		return 0, nil
+	}
+
+	switch limitAction {
+	case limitThrottle:
+		// O crédito é reservado agora; a requisição espera até que ele exista
+		wait := time.Duration((1 - limit.tokens) / rateLimit * float64(time.Second))
+		limit.tokens--
+		limitStats.Throttled++
+		return wait, nil
+	case limitBan:
+		limit.bannedUntil = now.Add(banDuration)
+		limitStats.Bans++
+		slog.Warn("IP bloqueado: limite de requisições excedido", "client", ip, "duration", banDuration)
+		return 0, fmt.Errorf("Limite de requisições excedido; IP bloqueado por %s", banDuration)
+	default:
+		limitStats.Rejected++
+		return 0, fmt.Errorf("Limite de %g requisições por segundo excedido", rateLimit)
+	}
+}
+
+// Reserva uma vaga para buscar em outros super nós. No modo throttle espera
+// alguns segundos por uma vaga; nos demais recusa na hora.
+func acquireSearchSlot() bool {
+	if federatedSearches == nil {
+		return true
+	}
+	select {
+	case federatedSearches <- struct{}{}:
+		return true
+	default:
+	}
+	if limitAction == limitThrottle {
+		select {
+		case federatedSearches <- struct{}{}:
+			return true
+		case <-time.After(5 * time.Second):
+		}
+	}
+	limitsMu.Lock()
+	limitStats.SearchesRefused++
+	limitsMu.Unlock()
+	return false
+}
+
+func releaseSearchSlot() {
+	if federatedSearches != nil {
+		<-federatedSearches
+	}
+}
+
+// Mostra os contadores de aplicação dos limites quando mudam e descarta o
+// estado de IPs ociosos (sem sessões, sem bloqueio e com o balde cheio)
+func reportLimitStats() {
+	var last enforcementStats
+	for {
+		time.Sleep(time.Minute)
+
+		limitsMu.Lock()
+		stats := limitStats
+		now := time.Now()
+		for ip, limit := range clientLimits {
+			refilled := limit.tokens + now.Sub(limit.lastRefill).Seconds()*rateLimit
+			if limit.sessions == 0 && now.After(limit.bannedUntil) && refilled >= rateBurst {
+				delete(clientLimits, ip)
+			}
+		}
+		limitsMu.Unlock()
+
+		if stats != last {
+			slog.Info("Limites aplicados", "throttled", stats.Throttled, "rejected", stats.Rejected, "bans", stats.Bans,
+				"sessions_refused", stats.SessionsRefused, "searches_refused", stats.SearchesRefused)
+			last = stats
+		}
+	}
+}
+
+// Bytes enviados e recebidos por um cliente
+type creditAccount struct {
+	Uploaded   int64
+	Downloaded int64
+}
+
+// Envio informado pelo detentor e ainda não confirmado por quem baixou
+type transferClaim struct {
+	Hash       string
+	Bytes      int64
+	Uploader   string
+	Downloader string
+	At         time.Time
+}
+
+// Requer mu
+func creditAccountOf(ip string) *creditAccount {
+	account := credits[ip]
+	if account == nil {
+		account = &creditAccount{}
+		credits[ip] = account
+	}
+	return account
+}
+
+// Razão entre o que o cliente enviou e o que recebeu. Requer mu.
+func shareRatio(ip string) float64 {
+	account := credits[ip]
+	if account == nil {
+		return 1
+	}
+	return float64(account.Uploaded+creditGrace) / float64(account.Downloaded+creditGrace)
+}
+
+func transferKey(hash string, uploader string, downloader string) string {
+	return hash + "|" + uploader + "|" + downloader
+}
+
+// Confere o relato de um cliente antes de aplicá-lo e limita os bytes ao
+// tamanho do conteúdo. Quem baixou só relata (RECV) downloads que este super
+// nó lhe indicou com aquele detentor; o detentor só relata envios (SENT) de
+// conteúdo que publicou aqui. Retorna os bytes aceitos e false se o relato
+// deve ser descartado. Requer mu.
+func checkTransferReport(kind string, hash string, bytes int64, uploader string, downloader string) (int64, bool) {
+	var size int64
+	switch kind {
+	case "RECV":
+		match, issued := issuedTransfer[transferKey(hash, uploader, downloader)]
+		if !issued {
+			return 0, false
+		}
+		size = match.Size
+	case "SENT":
+		entry := files[hash]
+		if entry == nil {
+			return 0, false
+		}
+		if _, listed := entry.Holders[uploader]; !listed {
+			return 0, false
+		}
+		size = entry.Size
+	default:
+		return 0, false
+	}
+	if bytes > size {
+		bytes = size
+	}
+	return bytes, true
+}
+
+// Aplica um relato de transferência. O detentor só ganha crédito com a
+// confirmação de quem baixou (RECV); um envio (SENT) sem confirmação conta
+// apenas contra quem baixou, depois de claimTimeout, e só é cobrado (CHARGE)
+// pelo super nó que indicou o download. Cada transferência é contabilizada
+// uma vez. Retorna false se o relato foi descartado. Requer mu.
+func applyTransferReport(kind string, hash string, bytes int64, uploader string, downloader string) bool {
+	if (kind != "SENT" && kind != "RECV" && kind != "CHARGE") || uploader == downloader {
+		return false
+	}
+	if entry := files[hash]; entry != nil && bytes > entry.Size {
+		bytes = entry.Size
+	}
+	key := transferKey(hash, uploader, downloader)
+	if _, seen := seenTransfers[key]; seen {
+		return false
+	}
+	if kind == "SENT" {
+		if _, ok := sentClaims[key]; ok {
+			return false
+		}
+		sentClaims[key] = transferClaim{Hash: hash, Bytes: bytes, Uploader: uploader, Downloader: downloader, At: time.Now()}
+		return true
+	}
+	delete(sentClaims, key)
+	seenTransfers[key] = time.Now()
+	creditAccountOf(downloader).Downloaded += bytes
+	if kind == "RECV" {
+		creditAccountOf(uploader).Uploaded += bytes
+		recordHolderSuccess(hash, uploader)
+	}
+	return true
+}
+
+// Registra o relato de um cliente e o repassa aos demais super nós
+func handleReport(conn net.Conn, kind string, hash string, bytesStr string, peerIP string) {
+	clientIP := strings.Split(conn.RemoteAddr().String(), ":")[0]
+	bytes, err := strconv.ParseInt(bytesStr, 10, 64)
+	if (kind != "SENT" && kind != "RECV") || !isContentHash(hash) || err != nil || bytes <= 0 || net.ParseIP(peerIP) == nil {
+		fmt.Fprintf(conn, "ERROR: Relato inválido, esperado REPORT SENT|RECV <hash> <bytes> <ip>\n")
+		return
+	}
+	uploader, downloader := clientIP, peerIP
+	if kind == "RECV" {
+		uploader, downloader = peerIP, clientIP
+	}
+
+	mu.Lock()
+	bytes, valid := checkTransferReport(kind, hash, bytes, uploader, downloader)
+	applied := valid && applyTransferReport(kind, hash, bytes, uploader, downloader)
+	mu.Unlock()
+	if !valid {
+		fmt.Fprintf(conn, "ERROR: Transferência não indicada por este super nó\n")
+		return
+	}
+	if applied {
+		go forwardTransferReport(kind, hash, bytes, uploader, downloader)
+	}
+	fmt.Fprintf(conn, "OK Transferência registrada.\n")
+}
+
+// Repassa um relato a todos os outros super nós, para que a contabilidade valha em qualquer um deles
+func forwardTransferReport(kind string, hash string, bytes int64, uploader string, downloader string) {
+	sendToSuperNodes(fmt.Sprintf("TRANSFER %s %s %d %s %s", kind, hash, bytes, uploader, downloader))
+}
+
+// Envia uma mensagem de uma linha a cada um dos outros super nós e espera a resposta
+func sendToSuperNodes(message string) {
+	mu.Lock()
+	nodes := append([]string(nil), knownSuperNodes...)
+	mu.Unlock()
+
+	for _, addr := range nodes {
+		if addr == "" || addr == superNodeAddr {
+			continue
+		}
+		conn, err := p2p.DialTimeout(addr+clientPort, 3*time.Second)
+		if err != nil {
+			slog.Error("Erro ao repassar mensagem ao super nó", "command", strings.SplitN(message, " ", 2)[0], "addr", addr, "error", err)
+			continue
+		}
+		fmt.Fprintf(conn, "%s\n", message)
+		bufio.NewReader(conn).ReadString('\n')
+		conn.Close()
+	}
+}
+
+// Assinatura de um cliente: avisa quando um arquivo com o nome, o padrão de
+// nome ou o hash indicado for registrado em qualquer super nó
+type subscription struct {
+	ID       int
+	Kind     string // "name", "pattern" ou "hash"
+	Value    string
+	Identity clientIdentity  // Só são avisados arquivos visíveis para o assinante
+	Notified map[string]bool // Hashes já avisados
+}
+
+func (sub *subscription) matches(hash string, name string) bool {
+	switch sub.Kind {
+	case "hash":
+		return sub.Value == hash
+	case "name":
+		return sub.Value == name
+	case "pattern":
+		ok, _ := filepath.Match(sub.Value, name)
+		return ok
+	}
+	return false
+}
+
+// SUBSCRIBE <name|pattern|hash> <valor>; a resposta traz o número da assinatura
+func handleSubscribe(conn net.Conn, id clientIdentity, kind string, encodedValue string) {
+	clientIP := strings.Split(conn.RemoteAddr().String(), ":")[0]
+	value, err := decodeName(encodedValue)
+	valid := err == nil && value != ""
+	switch kind {
+	case "hash":
+		valid = valid && isContentHash(value)
+	case "pattern":
+		_, patternErr := filepath.Match(value, "")
+		valid = valid && patternErr == nil
+	case "name":
+	default:
+		valid = false
+	}
+	if !valid {
+		fmt.Fprintf(conn, "ERROR: Assinatura inválida, esperado SUBSCRIBE <name|pattern|hash> <valor>\n")
+		return
+	}
+
+	mu.Lock()
+	nextSubscriptionID++
+	sub := &subscription{ID: nextSubscriptionID, Kind: kind, Value: value, Identity: id, Notified: make(map[string]bool)}
+	subscriptions[clientIP] = append(subscriptions[clientIP], sub)
+	mu.Unlock()
+
+	slog.Info("Assinatura registrada", "client", clientIP, "kind", kind, "value", value, "subscription", sub.ID)
+	fmt.Fprintf(conn, "OK %d\n", sub.ID)
+}
+
+// UNSUBSCRIBE <número>
+func handleUnsubscribe(conn net.Conn, idStr string) {
+	clientIP := strings.Split(conn.RemoteAddr().String(), ":")[0]
+	id, _ := strconv.Atoi(idStr)
+
+	mu.Lock()
+	defer mu.Unlock()
+	subs := subscriptions[clientIP]
+	for i, sub := range subs {
+		if sub.ID == id {
+			subscriptions[clientIP] = append(subs[:i], subs[i+1:]...)
+			fmt.Fprintf(conn, "OK Assinatura %d cancelada.\n", id)
+			return
+		}
+	}
+	fmt.Fprintf(conn, "ERROR: Assinatura %s não encontrada\n", idStr)
+}
+
+// Avisa, pelo canal de controle, os assinantes deste super nó que podem ver o
+// arquivo recém-registrado ("MATCH <assinatura> <hash> <nome>")
+func notifySubscribers(hash string, holder holderInfo) {
+	type notification struct {
+		ip      string
+		message string
+	}
+	var pending []notification
+
+	mu.Lock()
+	for clientIP, subs := range subscriptions {
+		for _, sub := range subs {
+			if sub.Notified[hash] || !sub.Identity.canSee(holder) || !sub.matches(hash, holder.Name) {
+				continue
+			}
+			sub.Notified[hash] = true
+			pending = append(pending, notification{clientIP, fmt.Sprintf("MATCH %d %s %s", sub.ID, hash, encodeName(holder.Name))})
+		}
+	}
+	mu.Unlock()
+
+	for _, n := range pending {
+		if deliverLocalControl(n.ip, n.message) {
+			slog.Info("Assinante avisado", "client", n.ip, "file", holder.Name, "hash", hash)
+		}
+	}
+}
+
+// Avisa os assinantes locais e, se o conteúdo é novo neste super nó, repassa
+// o registro aos outros super nós, que avisam os seus
+func announceUpload(hash string, holder holderInfo, forward bool) {
+	notifySubscribers(hash, holder)
+	if !forward {
+		return
+	}
+	sendToSuperNodes(fmt.Sprintf("ANNOUNCE %s %s %s %s", hash, encodeName(holder.Name), encodeName(holder.Owner), holder.Visibility))
+}
+
+// Cobra de quem baixou os envios não confirmados após claimTimeout, se foi
+// este super nó que indicou o download, e repassa a cobrança aos demais.
+// Esquece as transferências contabilizadas ou indicadas há mais de um dia.
+func expireTransferClaims() {
+	for {
+		time.Sleep(time.Minute)
+		now := time.Now()
+		var charges []transferClaim
+		mu.Lock()
+		for key, claim := range sentClaims {
+			if now.Sub(claim.At) <= claimTimeout {
+				continue
+			}
+			delete(sentClaims, key)
+			if match, issued := issuedTransfer[key]; issued {
+				if claim.Bytes > match.Size {
+					claim.Bytes = match.Size
+				}
+				if applyTransferReport("CHARGE", claim.Hash, claim.Bytes, claim.Uploader, claim.Downloader) {
+					charges = append(charges, claim)
+				}
+			}
+		}
+		for key, at := range seenTransfers {
+			if now.Sub(at) > 24*time.Hour {
+				delete(seenTransfers, key)
+			}
+		}
+		for key, issued := range issuedTransfer {
+			if now.Sub(issued.At) > 24*time.Hour {
+				delete(issuedTransfer, key)
+			}
+		}
+		mu.Unlock()
+		for _, claim := range charges {
+			forwardTransferReport("CHARGE", claim.Hash, claim.Bytes, claim.Uploader, claim.Downloader)
+		}
+	}
+}
+
+// Esquece os downloads indicados e não confirmados há mais de pendingTimeout
+func expirePendingDownloads() {
+	for {
+		time.Sleep(time.Minute)
+		now := time.Now()
+		mu.Lock()
+		for requester, pending := range pendingDownloads {
+			for hash, match := range pending {
+				if now.Sub(match.At) > pendingTimeout {
+					delete(pending, hash)
+				}
+			}
+			if len(pending) == 0 {
+				delete(pendingDownloads, requester)
+			}
+		}
+		mu.Unlock()
+	}
+}
+
+// Tamanho máximo, em bytes, de uma resposta da DHT
+const dhtMaxReply = 64 * 1024
+
+// Nó do anel da DHT (estilo Chord): posição no anel e endereço do super nó
+type dhtNode struct {
+	ID   uint32
+	Addr string
+}
+
+// Posição de uma chave (nome do arquivo ou endereço) no anel de 32 bits
+func dhtHash(key string) uint32 {
+	sum := sha1.Sum([]byte(key))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// Reconstrói o anel a partir da lista de super nós recebida do coordenador,
+// descarta chaves que deixaram de ser responsabilidade deste nó e republica
+// os arquivos locais para os novos responsáveis
+func rebuildDHTRing() {
+	mu.Lock()
+	var ring []dhtNode
+	for _, addr := range knownSuperNodes {
+		if addr != "" {
+			ring = append(ring, dhtNode{ID: dhtHash(addr), Addr: addr})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].ID < ring[j].ID })
+	dhtRing = ring
+
+	for key := range dhtIndex {
+		responsible := false
+		for _, node := range dhtReplicaSet(dhtHash(key)) {
+			if node.Addr == superNodeAddr {
+				responsible = true
+				break
+			}
+		}
+		if !responsible {
+			delete(dhtIndex, key)
+		}
+	}
+
+	var local []fileMatch
+	for hash, entry := range files {
+		for clientIP, holder := range entry.Holders {
+			match := fileMatch{Hash: hash, Size: entry.Size, Holders: []string{clientIP},
+				Name: holder.Name, Owner: holder.Owner, Visibility: holder.Visibility, Encrypted: entry.Encrypted}
+			if holder.KeyHolder {
+				match.KeyHolders = match.Holders
+			}
+			local = append(local, match)
+		}
+	}
+	mu.Unlock()
+
+	slog.Info("Anel da DHT atualizado", "supernodes", len(ring))
+	for _, match := range local {
+		holder := holderInfo{Name: match.Name, Owner: match.Owner, Visibility: match.Visibility, KeyHolder: len(match.KeyHolders) > 0}
+		dhtPublishHolder(match.Hash, match.Size, match.Encrypted, match.Holders[0], holder)
+	}
+}
+
+// Índice no anel do primeiro nó com ID >= id (sucessor de id). Exige mu travado.
+func dhtSuccessorIndex(id uint32) int {
+	i := sort.Search(len(dhtRing), func(i int) bool { return dhtRing[i].ID >= id })
+	if i == len(dhtRing) {
+		i = 0
+	}
+	return i
+}
+
+// Sucessor de id seguido das réplicas seguintes no anel. Exige mu travado.
+func dhtReplicaSet(id uint32) []dhtNode {
+	if len(dhtRing) == 0 {
+		return nil
+	}
+	start := dhtSuccessorIndex(id)
+	var nodes []dhtNode
+	for i := 0; i < dhtReplicas && i < len(dhtRing); i++ {
+		nodes = append(nodes, dhtRing[(start+i)%len(dhtRing)])
+	}
+	return nodes
+}
+
+// Envia um comando da DHT a outro super nó e retorna a linha de resposta
+func dhtCall(addr string, command string) (string, error) {
+	conn, err := p2p.DialTimeout(addr+dhtPort, 3*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if _, err := fmt.Fprintf(conn, "%s\n", command); err != nil {
+		return "", err
+	}
+	response, err := bufio.NewReader(io.LimitReader(conn, dhtMaxReply)).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(response), nil
+}
+
+// Nós responsáveis pela chave: o sucessor da chave no anel e as réplicas
+// seguintes. Todo super nó conhece o anel inteiro (a lista de super nós do
+// coordenador), então o sucessor é calculado aqui, sem saltos pela rede
+func dhtResponsibleNodes(key string) ([]string, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	var nodes []string
+	for _, node := range dhtReplicaSet(dhtHash(key)) {
+		nodes = append(nodes, node.Addr)
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("anel da DHT vazio")
+	}
+	return nodes, nil
+}
+
+// Cada detentor é publicado sob duas chaves, "hash:<hash>" e "name:<nome>", com o
+// valor "<hash>/<tamanho>/<ip>/<nome>/<dono>/<visibilidade>/<cifragem>", onde a
+// cifragem é "plain", "enc" ou "enckey" (cifrado e o detentor guarda a chave)
+func dhtHolderValue(hash string, size int64, encrypted bool, clientIP string, holder holderInfo) string {
+	encryption := "plain"
+	if encrypted && holder.KeyHolder {
+		encryption = "enckey"
+	} else if encrypted {
+		encryption = "enc"
+	}
+	return fmt.Sprintf("%s/%d/%s/%s/%s/%s/%s", hash, size, clientIP, encodeName(holder.Name),
+		encodeName(holder.Owner), encodeName(holder.Visibility), encryption)
+}
+
+func dhtKey(key string) string {
+	if isContentHash(key) {
+		return "hash:" + key
+	}
+	return "name:" + encodeName(key)
+}
+
+// Registra na DHT que o cliente possui o conteúdo
+func dhtPublishHolder(hash string, size int64, encrypted bool, clientIP string, holder holderInfo) {
+	value := dhtHolderValue(hash, size, encrypted, clientIP, holder)
+	dhtUpdate("DHT_PUT", dhtKey(hash), value)
+	dhtUpdate("DHT_PUT", dhtKey(holder.Name), value)
+}
+
+// Remove da DHT o registro do cliente para o conteúdo
+func dhtUnpublishHolder(hash string, size int64, encrypted bool, clientIP string, holder holderInfo) {
+	value := dhtHolderValue(hash, size, encrypted, clientIP, holder)
+	dhtUpdate("DHT_DEL", dhtKey(hash), value)
+	dhtUpdate("DHT_DEL", dhtKey(holder.Name), value)
+}
+
+func dhtUpdate(command string, key string, value string) {
+	nodes, err := dhtResponsibleNodes(key)
+	if err != nil {
+		slog.Error("Erro ao localizar os responsáveis pela chave na DHT", "key", key, "error", err)
+		return
+	}
+	for _, addr := range nodes {
+		if _, err := dhtCall(addr, fmt.Sprintf("%s %s %s", command, key, value)); err != nil {
+			slog.Error("Erro ao atualizar a DHT", "command", command, "key", key, "addr", addr, "error", err)
+		}
+	}
+}
+
+// Busca na DHT os conteúdos que correspondem ao hash ou nome, com os detentores
+// que a identidade tem permissão de ver
+func dhtLookup(key string, id clientIdentity, parent p2p.SpanContext) []fileMatch {
+	sp := p2p.StartSpan("dht lookup", p2p.SpanClient, parent)
+	sp.Set("file", key)
+	reqLog := slog.With("request", sp.Context.TraceID, "file", key)
+	dk := dhtKey(key)
+	nodes, err := dhtResponsibleNodes(dk)
+	if err != nil {
+		reqLog.Error("Erro ao localizar o arquivo na DHT", "error", err)
+		sp.End(err)
+		return nil
+	}
+	defer sp.End(nil)
+	for _, addr := range nodes {
+		response, err := dhtCall(addr, "DHT_GET "+dk+" "+sp.Context.Traceparent())
+		if err != nil {
+			reqLog.Error("Erro ao consultar a DHT", "addr", addr, "error", err)
+			continue
+		}
+		parts := strings.Split(response, " ")
+		if len(parts) != 2 || parts[0] != "VALUES" {
+			continue
+		}
+
+		var matches []fileMatch
+		byHash := make(map[string]int) // hash -> posição em matches
+		for _, value := range strings.Split(parts[1], ",") {
+			fields := strings.Split(value, "/")
+			if len(fields) != 7 {
+				continue
+			}
+			size, sizeErr := strconv.ParseInt(fields[1], 10, 64)
+			name, nameErr := decodeName(fields[3])
+			owner, ownerErr := decodeName(fields[4])
+			visibility, visibilityErr := decodeName(fields[5])
+			if sizeErr != nil || nameErr != nil || ownerErr != nil || visibilityErr != nil {
+				continue
+			}
+			if !id.canSee(holderInfo{Name: name, Owner: owner, Visibility: visibility}) {
+				continue
+			}
+			i, ok := byHash[fields[0]]
+			if !ok {
+				i = len(matches)
+				byHash[fields[0]] = i
+				matches = append(matches, fileMatch{Hash: fields[0], Size: size, Name: name, Owner: owner,
+					Visibility: visibility, Encrypted: fields[6] != "plain"})
+			}
+			matches[i].Holders = append(matches[i].Holders, fields[2])
+			if fields[6] == "enckey" {
+				matches[i].KeyHolders = append(matches[i].KeyHolders, fields[2])
+			}
+		}
+		if len(matches) > 0 {
+			reqLog.Info("Arquivo localizado pela DHT", "addr", addr, "holders", matches[0].Holders)
+			sp.Set("addr", addr)
+			return matches
+		}
+	}
+	return nil
+}
+
+// Valores guardados sob a chave que cabem numa resposta VALUES de até
+// dhtMaxReply bytes; true se algum ficou de fora
+func dhtValues(key string) ([]string, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	var values []string
+	size := len("VALUES \n")
+	for value := range dhtIndex[key] {
+		if size+len(value)+1 > dhtMaxReply {
+			return values, true
+		}
+		values = append(values, value)
+		size += len(value) + 1
+	}
+	return values, false
+}
+
+// Atende as requisições da DHT vindas de outros super nós
+func handleDHTRequest(conn net.Conn) {
+	defer conn.Close()
+
+	if !p2p.PeerHasRole(conn, p2p.RoleNode) {
+		return
+	}
+
+	request, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		slog.Error("Erro ao ler requisição da DHT", "error", err)
+		return
+	}
+	parts := strings.Split(strings.TrimSpace(request), " ")
+
+	switch {
+	case parts[0] == "DHT_PUT" && len(parts) == 3:
+		mu.Lock()
+		if dhtIndex[parts[1]] == nil {
+			dhtIndex[parts[1]] = make(map[string]bool)
+		}
+		dhtIndex[parts[1]][parts[2]] = true
+		mu.Unlock()
+		fmt.Fprintf(conn, "OK\n")
+	case parts[0] == "DHT_DEL" && len(parts) == 3:
+		mu.Lock()
+		if clients, ok := dhtIndex[parts[1]]; ok {
+			delete(clients, parts[2])
+			if len(clients) == 0 {
+				delete(dhtIndex, parts[1])
+			}
+		}
+		mu.Unlock()
+		fmt.Fprintf(conn, "OK\n")
+	case parts[0] == "DHT_GET" && (len(parts) == 2 || len(parts) == 3):
+		// DHT_GET <chave> [traceparent]
+		if len(parts) == 3 {
+			sp := p2p.StartSpan("DHT_GET", p2p.SpanServer, p2p.RequestContext(parts, 2))
+			sp.Set("key", parts[1])
+			defer sp.End(nil)
+			slog.Debug("Consulta da DHT recebida", "request", sp.Context.TraceID, "addr", conn.RemoteAddr().String(), "key", parts[1])
+		}
+		values, truncated := dhtValues(parts[1])
+		if truncated {
+			slog.Warn("Resposta da DHT truncada", "key", parts[1], "values", len(values))
+		}
+		if len(values) == 0 {
+			fmt.Fprintf(conn, "NOTFOUND\n")
+		} else {
+			fmt.Fprintf(conn, "VALUES %s\n", strings.Join(values, ","))
+		}
+	default:
+		fmt.Fprintf(conn, "ERROR comando da DHT inválido\n")
+	}
+}
+
+func startDHTServer() {
+	ln, err := p2p.Listen(dhtPort)
+	if err != nil {
+		slog.Error("Erro ao iniciar o servidor da DHT", "error", err)
+		return
+	}
+	defer ln.Close()
+	slog.Info("Super nó atendendo a DHT", "port", dhtPort)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			slog.Error("Erro ao aceitar conexão da DHT", "error", err)
+			continue
+		}
+		go handleDHTRequest(conn)
+	}
+}
+
+// Resultado da sondagem da porta de arquivos de um cliente
+type reachState struct {
+	Reachable bool
+	At        time.Time
+}
+
+// Canal de controle de um cliente; as escritas são serializadas
+type controlChannel struct {
+	mu   sync.Mutex
+	conn net.Conn
+	addr string // Endereço (IP:porta) da conexão
+}
+
+func (c *controlChannel) send(message string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	defer c.conn.SetWriteDeadline(time.Time{})
+	_, err := fmt.Fprintf(c.conn, "%s\n", message)
+	return err
+}
+
+// Verifica se a porta de arquivos do cliente aceita conexões de fora (não
+// está atrás de NAT ou firewall). Com TLS, a porta só conta como do cliente
+// se o certificado de quem atende tem o mesmo nome (user) do da sessão; atrás
+// do mesmo IP pode haver outro cliente. O resultado vale por um minuto.
+func probeClient(ip string, user string) {
+	addr := ip + peerPort
+	mu.Lock()
+	state, ok := reachability[addr]
+	mu.Unlock()
+	if ok && time.Since(state.At) < time.Minute {
+		return
+	}
+
+	reachable := false
+	if conn, err := p2p.DialTimeout(addr, 3*time.Second); err == nil {
+		conn.SetDeadline(time.Now().Add(3 * time.Second))
+		fmt.Fprintf(conn, "PING\n")
+		response, err := bufio.NewReader(conn).ReadString('\n')
+		reachable = err == nil && strings.TrimSpace(response) == "PONG" && p2p.PeerCommonName(conn) == user
+		conn.Close()
+	}
+
+	mu.Lock()
+	if state, ok := reachability[addr]; !ok || state.Reachable != reachable {
+		slog.Info("Alcançabilidade do cliente verificada", "client", addr, "reachable", reachable)
+	}
+	reachability[addr] = reachState{Reachable: reachable, At: time.Now()}
+	mu.Unlock()
+}
+
+// Registra uma falha do detentor; depois de maxHolderFailures seguidas ele
+// sai do índice. Requer mu.
+func recordHolderFailure(hash string, clientIP string) {
+	entry := files[hash]
+	if entry == nil {
+		return
+	}
+	holder, ok := entry.Holders[clientIP]
+	if !ok {
+		return
+	}
+	holder.Failures++
+	if holder.Failures >= maxHolderFailures {
+		slog.Warn("Detentor removido após falhas seguidas", "client", clientIP, "hash", hash, "failures", holder.Failures)
+		removeHolder(hash, clientIP)
+		return
+	}
+	entry.Holders[clientIP] = holder
+}
+
+// Zera as falhas do detentor depois de uma entrega ou sondagem bem-sucedida. Requer mu.
+func recordHolderSuccess(hash string, clientIP string) {
+	entry := files[hash]
+	if entry == nil {
+		return
+	}
+	if holder, ok := entry.Holders[clientIP]; ok && holder.Failures > 0 {
+		holder.Failures = 0
+		entry.Holders[clientIP] = holder
+	}
+}
+
+// Trata o relato de um download que falhou. Só vale o relato de um download
+// que este super nó indicou a quem relata com aquele detentor (DOWNLOAD). O
+// detentor é sondado na hora e a sondagem decide se ele falhou; detentores
+// atrás de NAT, que não podem ser sondados, têm o relato contado como falha.
+// Cada cliente conta uma vez por detentor e conteúdo a cada
+// holderReportWindow, então um cliente sozinho soma no máximo uma falha por
+// janela e não derruba um detentor. Relatos sobre detentores de outros super
+// nós são repassados (HOLDERFAIL) uma vez por janela, dentro do limite de
+// buscas simultâneas em outros super nós.
+func handleFailedReport(conn net.Conn, hash string, holderIP string) {
+	if !isContentHash(hash) || net.ParseIP(holderIP) == nil {
+		fmt.Fprintf(conn, "ERROR: Relato inválido, esperado FAILED <hash> <ip>\n")
+		return
+	}
+	reporter := strings.Split(conn.RemoteAddr().String(), ":")[0]
+	mu.Lock()
+	_, issued := issuedTransfer[transferKey(hash, holderIP, reporter)]
+	mu.Unlock()
+	if !issued {
+		fmt.Fprintf(conn, "ERROR: Download não indicado por este super nó\n")
+		return
+	}
+	if local, counted := checkReportedHolder(hash, holderIP, reporter); !local && counted {
+		go func() {
+			if !acquireSearchSlot() {
+				slog.Warn("Relato de falha não repassado: limite de buscas simultâneas", "hash", hash, "holder", holderIP)
+				return
+			}
+			defer releaseSearchSlot()
+			sendToSuperNodes(fmt.Sprintf("HOLDERFAIL %s %s %s", hash, holderIP, reporter))
+		}()
+	}
+	fmt.Fprintf(conn, "OK Falha registrada.\n")
+}
+
+// Conta o relato de quem relata contra o detentor, uma vez por janela, e
+// sonda o detentor se ele é detentor do conteúdo neste super nó (local).
+// counted é false se o relato já foi contado na janela atual.
+func checkReportedHolder(hash string, holderIP string, reporter string) (local bool, counted bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	now := time.Now()
+	for key, at := range holderReports {
+		if now.Sub(at) > holderReportWindow {
+			delete(holderReports, key)
+		}
+	}
+	key := hash + "|" + holderIP + "|" + reporter
+	if _, reported := holderReports[key]; reported {
+		return false, false
+	}
+	holderReports[key] = now
+
+	entry := files[hash]
+	if entry == nil {
+		return false, true
+	}
+	if _, ok := entry.Holders[holderIP]; !ok {
+		return false, true
+	}
+	if state, ok := reachability[holderIP+peerPort]; ok && !state.Reachable {
+		recordHolderFailure(hash, holderIP)
+		return true, true
+	}
+	go probeHolder(holderIP, []string{hash})
+	return true, true
+}
+
+// Pergunta ao cliente, na porta de arquivos, se ele ainda tem os conteúdos
+// ("HAS <hash>,<hash>..."); a resposta "HAVE <bits>" traz 1 ou 0 para cada
+// hash. Conteúdos que o cliente não tem mais saem do índice na hora; sem
+// resposta, todos contam uma falha.
+func probeHolder(ip string, hashes []string) {
+	var bits string
+	conn, err := p2p.DialTimeout(ip+peerPort, 3*time.Second)
+	if err == nil {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(conn, "HAS %s\n", strings.Join(hashes, ","))
+		response, readErr := bufio.NewReader(conn).ReadString('\n')
+		conn.Close()
+		response = strings.TrimSpace(response)
+		if readErr == nil && strings.HasPrefix(response, "HAVE ") && len(response)-len("HAVE ") == len(hashes) {
+			bits = strings.TrimPrefix(response, "HAVE ")
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i, hash := range hashes {
+		switch {
+		case bits == "":
+			recordHolderFailure(hash, ip)
+		case bits[i] == '1':
+			recordHolderSuccess(hash, ip)
+		default:
+			if entry := files[hash]; entry != nil {
+				if _, ok := entry.Holders[ip]; ok {
+					slog.Info("Cliente não tem mais o conteúdo; removido do índice", "client", ip, "hash", hash)
+					removeHolder(hash, ip)
+				}
+			}
+		}
+	}
+}
+
+// Sonda periodicamente os detentores alcançáveis e fora do período de
+// tolerância, até probeBatch conteúdos por cliente em cada rodada, em rodízio
+func probeHolders() {
+	if probeInterval <= 0 {
+		return
+	}
+	for {
+		time.Sleep(probeInterval)
+
+		mu.Lock()
+		byHolder := make(map[string][]string)
+		for hash, entry := range files {
+			for ip := range entry.Holders {
+				if _, suspect := suspectClients[ip]; suspect {
+					continue
+				}
+				if state, ok := reachability[ip+peerPort]; ok && !state.Reachable {
+					continue
+				}
+				byHolder[ip] = append(byHolder[ip], hash)
+			}
+		}
+		round := probeRound
+		probeRound++
+		mu.Unlock()
+
+		for ip, hashes := range byHolder {
+			sort.Strings(hashes)
+			if len(hashes) > probeBatch {
+				start := (round * probeBatch) % len(hashes)
+				hashes = append(hashes[start:], hashes[:start]...)[:probeBatch]
+			}
+			probeHolder(ip, hashes)
+		}
+	}
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Ao receber SIGINT ou SIGTERM, avisa os clientes pelo canal de controle,
+// indicando outro super nó para reconectar, e encerra o processo
+func handleShutdownSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+
+	mu.Lock()
+	var alternatives []string
+	for _, addr := range knownSuperNodes {
+		if addr != "" && addr != superNodeAddr {
+			alternatives = append(alternatives, addr)
+		}
+	}
+	channels := make([]*controlChannel, 0, len(controlChannels))
+	for _, channel := range controlChannels {
+		channels = append(channels, channel)
+	}
+	mu.Unlock()
+
+	slog.Info("Encerrando; avisando os clientes", "clients", len(channels))
+	for i, channel := range channels {
+		// Os clientes são distribuídos entre os demais super nós
+		if len(alternatives) > 0 {
+			channel.send("RECONNECT " + alternatives[i%len(alternatives)])
+		}
+		channel.send("SHUTDOWN")
+	}
+	p2p.FlushSpans()
+	os.Exit(0)
+}
+
+// Entrega uma mensagem aos canais de controle que os clientes do IP abriram
+// com este super nó; atrás do mesmo IP pode haver mais de um cliente, e cada
+// um ignora os pedidos sobre conteúdo que não compartilha
+func deliverLocalControl(ip string, message string) bool {
+	mu.Lock()
+	var channels []*controlChannel
+	for addr, channel := range controlChannels {
+		if host, _, err := net.SplitHostPort(addr); err == nil && host == ip {
+			channels = append(channels, channel)
+		}
+	}
+	mu.Unlock()
+	delivered := false
+	for _, channel := range channels {
+		if channel.send(message) == nil {
+			delivered = true
+		}
+	}
+	return delivered
+}
+
+// Entrega uma mensagem ao canal de controle de um cliente, repassando-a aos
+// outros super nós quando ele não está conectado a este
+func deliverControl(ip string, message string) bool {
+	if deliverLocalControl(ip, message) {
+		return true
+	}
+
+	mu.Lock()
+	nodes := append([]string(nil), knownSuperNodes...)
+	mu.Unlock()
+	for _, addr := range nodes {
+		if addr == "" || addr == superNodeAddr {
+			continue
+		}
+		conn, err := p2p.DialTimeout(addr+clientPort, 3*time.Second)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(conn, "DELIVER %s %s\n", ip, encodeName(message))
+		response, _ := bufio.NewReader(conn).ReadString('\n')
+		conn.Close()
+		if strings.HasPrefix(response, "OK") {
+			return true
+		}
+	}
+	return false
+}
+
+// Intermedeia a conexão com um detentor inalcançável. Se quem pede aceita
+// conexões, o detentor é chamado a se conectar a ele (REVERSE); senão, as duas
+// pontas se encontram na porta de retransmissão deste super nó (RELAY).
+func handleConnect(conn net.Conn, identity clientIdentity, holderIP string, hash string, token string, parent p2p.SpanContext) {
+	requesterIP := strings.Split(conn.RemoteAddr().String(), ":")[0]
+	if _, err := hex.DecodeString(token); err != nil || len(token) != 32 || net.ParseIP(holderIP) == nil || !isContentHash(hash) {
+		fmt.Fprintf(conn, "ERROR: Pedido inválido, esperado CONNECT <ip> <hash> <token> [traceparent]\n")
+		return
+	}
+	mu.Lock()
+	allowed := connectAllowed(identity, requesterIP, holderIP, hash)
+	mu.Unlock()
+	if !allowed {
+		fmt.Fprintf(conn, "ERROR: Cliente %s não é detentor de %s visível para você\n", holderIP, hash)
+		return
+	}
+	sp := p2p.StartSpan("CONNECT", p2p.SpanServer, parent)
+	sp.Set("client", requesterIP)
+	sp.Set("holder", holderIP)
+	sp.Set("hash", hash)
+	var failure error
+	defer func() { sp.End(failure) }()
+
+	mu.Lock()
+	reachable := reachability[requesterIP+peerPort].Reachable
+	mu.Unlock()
+
+	// O detentor recebe o contexto para que o envio apareça no mesmo trace
+	mode, message := "REVERSE", fmt.Sprintf("REVERSE %s %s %s %s", token, requesterIP, hash, sp.Context.Traceparent())
+	var relay *relaySession
+	if !reachable {
+		var err error
+		if relay, err = registerRelay(token); err == errRelayTokenInUse {
+			failure = err
+			fmt.Fprintf(conn, "ERROR: %v\n", err)
+			return
+		} else if err != nil {
+			// BUSY: falta de vaga no super nó, que o cliente não conta como falha do detentor
+			failure = err
+			fmt.Fprintf(conn, "BUSY %v\n", err)
+			return
+		}
+		mode, message = "RELAY", fmt.Sprintf("RELAY %s %s %s %s", token, superNodeAddr, requesterIP, hash)
+	}
+	sp.Set("mode", mode)
+
+	if !deliverControl(holderIP, message) {
+		if relay != nil {
+			expireRelay(token, relay)
+		}
+		failure = fmt.Errorf("detentor sem canal de controle")
+		fmt.Fprintf(conn, "ERROR: Cliente %s não tem canal de controle com nenhum super nó\n", holderIP)
+		return
+	}
+	slog.Info("Conexão entre clientes coordenada", "mode", mode, "client", requesterIP, "holder", holderIP, "hash", hash)
+	fmt.Fprintf(conn, "OK %s\n", mode)
+}
+
+// O super nó só intermedeia a conexão com um detentor que ele mesmo indicou
+// ao solicitante (DOWNLOAD) ou que publicou aqui um conteúdo que o
+// solicitante pode ver. Requer mu.
+func connectAllowed(identity clientIdentity, requesterIP string, holderIP string, hash string) bool {
+	if _, issued := issuedTransfer[transferKey(hash, holderIP, requesterIP)]; issued {
+		return true
+	}
+	entry := files[hash]
+	if entry == nil {
+		return false
+	}
+	holder, ok := entry.Holders[holderIP]
+	return ok && identity.canSee(holder)
+}
+
+// Retransmissão aguardando as duas pontas
+type relaySession struct {
+	first  chan relayEnd // Primeira ponta a chegar
+	paired bool
+}
+
+type relayEnd struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// O token vem do CONNECT do cliente; um token já reservado é recusado para
+// que uma reserva não tome o lugar de outra e perca a sua vaga
+var errRelayTokenInUse = errors.New("Token de retransmissão já em uso")
+
+// Reserva uma vaga de retransmissão para o token; sem a segunda ponta em
+// relayTimeout, a reserva expira
+func registerRelay(token string) (*relaySession, error) {
+	relayMu.Lock()
+	defer relayMu.Unlock()
+	if relays[token] != nil {
+		return nil, errRelayTokenInUse
+	}
+	select {
+	case relaySlots <- struct{}{}:
+	default:
+		return nil, fmt.Errorf("Super nó sem vaga para retransmissão, tente novamente mais tarde")
+	}
+	session := &relaySession{first: make(chan relayEnd, 1)}
+	relays[token] = session
+	time.AfterFunc(relayTimeout, func() { expireRelay(token, session) })
+	return session, nil
+}
+
+// Descarta uma retransmissão que não foi pareada. A sessão é conferida para
+// que o prazo de uma reserva antiga não derrube outra com o mesmo token.
+func expireRelay(token string, session *relaySession) {
+	relayMu.Lock()
+	defer relayMu.Unlock()
+	if relays[token] != session || session.paired {
+		return
+	}
+	delete(relays, token)
+	select {
+	case end := <-session.first:
+		end.conn.Close()
+	default:
+	}
+	<-relaySlots
+}
+
+// Pareia as duas pontas de uma retransmissão ("RELAY <token>") e copia os
+// dados entre elas com limite de banda. O conteúdo continua protegido pelo
+// TLS de ponta a ponta entre os clientes, quando habilitado.
+func handleRelay(conn net.Conn) {
+	if !p2p.PeerHasRole(conn, p2p.RoleClient) {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	conn.SetReadDeadline(time.Time{})
+	parts := strings.Split(strings.TrimSpace(line), " ")
+	if err != nil || len(parts) != 2 || parts[0] != "RELAY" {
+		conn.Close()
+		return
+	}
+
+	relayMu.Lock()
+	session := relays[parts[1]]
+	if session == nil {
+		relayMu.Unlock()
+		fmt.Fprintf(conn, "ERROR: Retransmissão desconhecida ou expirada\n")
+		conn.Close()
+		return
+	}
+	end := relayEnd{conn: conn, reader: reader}
+	select {
+	case other := <-session.first:
+		session.paired = true
+		delete(relays, parts[1])
+		relayMu.Unlock()
+		pipeRelay(other, end)
+		<-relaySlots
+	default:
+		// A primeira ponta espera a segunda; a conexão passa a pertencer à retransmissão
+		session.first <- end
+		relayMu.Unlock()
+	}
+}
+
+// Copia os dados nos dois sentidos até que uma das pontas encerre
+func pipeRelay(a relayEnd, b relayEnd) {
+	limiter := p2p.NewRateLimiter(relayLimit)
+	done := make(chan struct{}, 2)
+	copyHalf := func(dst net.Conn, src *bufio.Reader) {
+		io.Copy(p2p.ThrottledWriter(dst, limiter, relayLimiter), src)
+		done <- struct{}{}
+	}
+	go copyHalf(a.conn, b.reader)
+	go copyHalf(b.conn, a.reader)
+	<-done
+	a.conn.Close()
+	b.conn.Close()
+	<-done
+}
+
+func startRelayServer() {
+	ln, err := p2p.Listen(relayPort)
+	if err != nil {
+		slog.Error("Erro ao iniciar o servidor de retransmissão", "error", err)
+		return
+	}
+	defer ln.Close()
+	slog.Info("Super nó retransmitindo transferências", "port", relayPort)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			slog.Error("Erro ao aceitar conexão de retransmissão", "error", err)
+			continue
+		}
+		go handleRelay(conn)
+	}
+}
+
+func registerWithMaster() {
+	conn, err := p2p.Dial(coordinatorIP + registerPort)
+	if err != nil {
+		slog.Error("Erro ao conectar ao coordenador", "addr", coordinatorIP, "error", err)
+		return
+	}
+
+	defer conn.Close()
+
+	// Recebe o identificador do super nó do coordenador
+	buf := make([]byte, 1024)
+	n, responseError := conn.Read(buf)
+	if responseError != nil {
+		slog.Error("Erro ao receber o ID do coordenador", "error", responseError)
+		fmt.Fprint(conn, "NACK")
+		return
+	}
+
+	// Resposta: "<id> <chave pública do coordenador>"
+	parts := strings.Split(strings.TrimSpace(string(buf[:n])), " ")
+	if len(parts) != 2 {
+		slog.Error("Resposta de registro inesperada do coordenador", "response", string(buf[:n]))
+		fmt.Fprint(conn, "NACK")
+		return
+	}
+	key, err := decodePublicKey(parts[1])
+	if err != nil {
+		slog.Error("Chave pública do coordenador inválida", "error", err)
+		fmt.Fprint(conn, "NACK")
+		return
+	}
+
+	mu.Lock()
+	superNodeID = parts[0]
+	superNodeAddr = strings.Split(conn.LocalAddr().String(), ":")[0]
+	coordinatorKey = key
+	mu.Unlock()
+	setLogIdentity(logRoleSuperNode, superNodeID)
+	slog.Info("Super nó registrado no coordenador", "addr", superNodeAddr)
+
+	// Envia confirmação de registro ao coordenador, com a chave pública deste nó
+	fmt.Fprintf(conn, "ACK %s", base64.StdEncoding.EncodeToString(nodePublicKey))
+	return
+}
+
+func handleElection() {
+	ln, _ := p2p.Listen(electionPort)
+	defer ln.Close()
+	for electionInProgress {
+		conn, err := ln.Accept()
+		if err != nil {
+			slog.Error("Erro ao receber mensagem de eleição", "error", err)
+			continue
+		}
+		if !p2p.PeerHasRole(conn, p2p.RoleNode) {
+			conn.Close()
+			continue
+		}
+
+		response := make([]byte, 1024)
+		n, err := conn.Read(response)
+		if err != nil {
+			slog.Error("Erro ao ler mensagem de eleição", "error", err)
+			continue
+		}
+		// Tratamento da mensagem de eleição
+		myId, _ := strconv.Atoi(superNodeID)
+		slog.Debug("Mensagem de eleição recebida", "message", string(response[:n]))
+		idNode, _ := strconv.Atoi(strings.Split(string(response[:n]), " ")[1])
+		slog.Info("Eleição recebida de outro super nó", "id", idNode, "addr", conn.RemoteAddr().String())
+
+		if idNode > myId {
+			fmt.Fprint(conn, "OUT")
+
+		} else {
+			fmt.Fprint(conn, "OK")
+		}
+
+		_ = conn.Close()
+	}
+}
+
+func startElection() {
+	mu.Lock()
+	if electionInProgress {
+		mu.Unlock()
+		return
+	}
+	electionInProgress = true
+	recordElection("started", coordinatorIP)
+	mu.Unlock()
+	electionsStarted.Inc("")
+
+	go handleElection()
+
+	slog.Info("Iniciando eleição")
+	electionDone := false
+
+	// Envia mensagem de eleição para nós com IDs maiores
+	nodeID, _ := strconv.Atoi(superNodeID)
+
+	for id := nodeID + 1; id < len(knownSuperNodes); id++ {
+		nodeAddr := knownSuperNodes[id]
+		if nodeAddr == "" {
+			continue
+		}
+
+		// Conecta ao nó de ID maior
+		conn, err := p2p.Dial(nodeAddr + electionPort)
+		if err != nil {
+			slog.Info("Super nó não respondeu à eleição", "id", id, "addr", nodeAddr)
+			continue
+		}
+		defer conn.Close()
+
+		// Envia mensagem de eleição
+		_, err = fmt.Fprintf(conn, "ELECTION %d\n", nodeID)
+		if err != nil {
+			slog.Error("Erro ao enviar mensagem de eleição", "addr", nodeAddr, "error", err)
+			continue
+		}
+
+		// Lê resposta do nó de ID maior
+		response := make([]byte, 1024)
+		n, err := conn.Read(response)
+		if err != nil {
+			slog.Error("Erro ao ler resposta de eleição", "addr", nodeAddr, "error", err)
+			continue
+		}
+
+		// Se resposta for "OK", outro nó participará da eleição
+		resp := strings.TrimSpace(string(response[:n]))
+		if resp == "OK" {
+			slog.Info("Super nó de ID maior assumiu a eleição", "id", id, "addr", nodeAddr)
+			electionDone = true
+		}
+	}
+	time.Sleep(10 * time.Second)
+	// Se nenhum nó respondeu, o nó assume a posição de coordenador
+	if !electionDone {
+		declareAsCoordinator()
+	}
+}
+
+func declareAsCoordinator() {
+	mu.Lock()
+	coordinatorIP = superNodeAddr
+	coordinatorKey = nodePublicKey
+	currentTerm++
+	membershipEpoch = 0
+	electionInProgress = false
+	isMaster = true
+	recordElection("won", coordinatorIP)
+	electionsWon.Inc("")
+	announcement := signMessage(fmt.Sprintf("COORDINATOR %d %s", currentTerm, coordinatorIP))
+	term, coordinator := currentTerm, coordinatorIP
+	nodes := append([]string(nil), knownSuperNodes...)
+	mu.Unlock()
+
+	setLogIdentity(logRoleCoordinator, superNodeID)
+	slog.Info("Este nó é o novo coordenador", "term", term)
+	for _, superNodeAddr := range nodes {
+		if superNodeAddr == coordinator {
+			continue
+		} else {
+			conn, err := p2p.Dial(superNodeAddr + broadcastPort)
+			if err != nil {
+				slog.Error("Erro ao conectar ao super nó para anunciar o coordenador", "addr", superNodeAddr, "error", err)
+				continue
+			}
+
+			_, err = fmt.Fprintf(conn, "%s\n", announcement)
+			if err != nil {
+				slog.Error("Erro ao anunciar o coordenador ao super nó", "addr", superNodeAddr, "error", err)
+			}
+			_ = conn.Close()
+		}
+
+	}
+
+	initializeNode()
+}
+
+// Indica se este nó é o coordenador; isMaster muda na eleição, sob mu
+func masterNode() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return isMaster
+}
+
+// Enquanto este nó não é o coordenador, confere a cada 5s se o coordenador
+// responde; se não responde, inicia uma eleição
+func checkCoordinator() {
+	for !masterNode() {
+		time.Sleep(5 * time.Second)
+
+		mu.Lock()
+		coordinator := coordinatorIP
+		mu.Unlock()
+		conn, err := p2p.Dial(coordinator + registerPort)
+		if err != nil {
+			slog.Warn("Coordenador não está respondendo", "addr", coordinator)
+			heartbeatMisses.Inc("")
+			startElection()
+		} else {
+			conn.Close()
+		}
+	}
+	return
+}
+
+func awaitMasterRelease() bool {
+	ln, err := p2p.Listen(releasePort)
+	if err != nil {
+		slog.Error("Erro ao aguardar a liberação do coordenador", "error", err)
+		return false
+	}
+	defer ln.Close()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			slog.Error("Erro ao aceitar conexão de liberação", "error", err)
+			time.Sleep(5 * time.Second)
+			continue // Tenta novamente se houver um erro de aceitação
+		}
+		if !p2p.PeerHasRole(conn, p2p.RoleNode) {
+			conn.Close()
+			continue
+		}
+		// Aguarda pela mensagem de liberação do coordenador
+		newBuffer := make([]byte, 1024)
+		n, messageError := conn.Read(newBuffer)
+		if messageError != nil {
+			slog.Error("Erro ao ler mensagem do coordenador", "error", messageError)
+			time.Sleep(5 * time.Second)
+			continue // Tenta novamente se ocorrer erro de leitura
+		}
+
+		// Verifica se a mensagem recebida é "FINALIZED"
+		if strings.TrimSpace(string(newBuffer[:n])) == "FINALIZED" {
+			slog.Info("Super nó liberado pelo coordenador")
+			go receiveBroadcast()
+			return true
+		}
+		slog.Warn("Mensagem de liberação inesperada; aguardando")
+		time.Sleep(5 * time.Second) // Aguardar antes de tentar novamente
+	}
+}
+
+func receiveBroadcast() {
+	ln, err := p2p.Listen(broadcastPort)
+	if err != nil {
+		slog.Error("Erro ao iniciar o servidor de anúncios", "error", err)
+		return
+	}
+	defer ln.Close()
+
+	for {
+		if masterNode() {
+			return
+		}
+
+		conn, err := ln.Accept()
+		if err != nil {
+			slog.Error("Erro ao aceitar conexão de anúncio", "error", err)
+			return
+		}
+		if !p2p.PeerHasRole(conn, p2p.RoleNode) {
+			conn.Close()
+			continue
+		}
+
+		// Lê o anúncio (lista de super nós ou novo coordenador) até o fim da conexão
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		data, err := io.ReadAll(io.LimitReader(conn, 64*1024))
+		conn.Close()
+		if err != nil {
+			slog.Error("Erro ao ler anúncio", "error", err)
+			continue
+		}
+
+		message := strings.TrimSpace(string(data))
+		if strings.HasPrefix(message, "COORDINATOR ") {
+			handleCoordinatorAnnouncement(message)
+		} else if strings.HasPrefix(message, "MEMBERS ") {
+			handleMembershipAnnouncement(message)
+		} else {
+			slog.Warn("Anúncio desconhecido descartado")
+		}
+	}
+}
+
+// Assina a mensagem com a chave deste nó, acrescentando a assinatura como último campo
+func signMessage(payload string) string {
+	signature := ed25519.Sign(nodePrivateKey, []byte(payload))
+	return payload + " " + base64.StdEncoding.EncodeToString(signature)
+}
+
+// Separa a assinatura do último campo e a confere com a chave informada
+func verifyMessage(message string, key ed25519.PublicKey) (string, bool) {
+	i := strings.LastIndex(message, " ")
+	if i < 0 || len(key) != ed25519.PublicKeySize {
+		return "", false
+	}
+	payload := message[:i]
+	signature, err := base64.StdEncoding.DecodeString(message[i+1:])
+	if err != nil {
+		return "", false
+	}
+	return payload, ed25519.Verify(key, []byte(payload), signature)
+}
+
+func decodePublicKey(encoded string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("tamanho de chave inválido: %d", len(key))
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// Trata "MEMBERS <mandato> <época> <ip|chave>,... <assinatura>", assinado pelo coordenador
+func handleMembershipAnnouncement(message string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	payload, ok := verifyMessage(message, coordinatorKey)
+	if !ok {
+		slog.Warn("Lista de super nós com assinatura inválida descartada")
+		return
+	}
+	parts := strings.Split(payload, " ")
+	if len(parts) != 4 {
+		slog.Warn("Lista de super nós mal formada descartada")
+		return
+	}
+	term, termErr := strconv.Atoi(parts[1])
+	epoch, epochErr := strconv.Atoi(parts[2])
+	if termErr != nil || epochErr != nil {
+		slog.Warn("Lista de super nós mal formada descartada")
+		return
+	}
+	if term < currentTerm || (term == currentTerm && epoch <= membershipEpoch) {
+		slog.Warn("Lista de super nós antiga descartada", "term", term, "epoch", epoch)
+		return
+	}
+
+	var nodes []string
+	keys := make(map[string]ed25519.PublicKey)
+	for _, entry := range strings.Split(parts[3], ",") {
+		fields := strings.Split(entry, "|")
+		if len(fields) != 2 {
+			continue
+		}
+		key, err := decodePublicKey(fields[1])
+		if err != nil {
+			continue
+		}
+		nodes = append(nodes, fields[0])
+		keys[fields[0]] = key
+	}
+
+	// Armazena a lista de super nós conhecidos
+	currentTerm, membershipEpoch = term, epoch
+	knownSuperNodes = nodes
+	knownKeys = keys
+	slog.Info("Lista de super nós recebida", "term", term, "epoch", epoch, "supernodes", knownSuperNodes)
+	if useDHT {
+		go rebuildDHTRing()
+	}
+}
+
+// Trata "COORDINATOR <mandato> <ip> <assinatura>", assinado pelo próprio novo coordenador
+func handleCoordinatorAnnouncement(message string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	fields := strings.Split(message, " ")
+	if len(fields) != 4 {
+		slog.Warn("Anúncio de coordenador mal formado descartado")
+		return
+	}
+	key, known := knownKeys[fields[2]]
+	if !known {
+		slog.Warn("Anúncio de coordenador de nó desconhecido descartado", "addr", fields[2])
+		return
+	}
+	if _, ok := verifyMessage(message, key); !ok {
+		slog.Warn("Anúncio de coordenador com assinatura inválida descartado", "addr", fields[2])
+		return
+	}
+	term, err := strconv.Atoi(fields[1])
+	if err != nil || term <= currentTerm {
+		slog.Warn("Anúncio de coordenador antigo descartado", "term", fields[1], "current", currentTerm)
+		return
+	}
+
+	coordinatorIP = fields[2]
+	coordinatorKey = key
+	currentTerm = term
+	membershipEpoch = 0
+	recordElection("accepted", coordinatorIP)
+	slog.Info("Novo coordenador aceito", "addr", coordinatorIP, "term", currentTerm)
+}
+
+// Estado de um super nó visto pelo coordenador, atualizado pelo STATS periódico
+type nodeStatus struct {
+	ID        int       `json:"id"`
+	Addr      string    `json:"addr"`
+	Alive     bool      `json:"alive"`
+	LastSeen  time.Time `json:"last_seen"`
+	LatencyMs float64   `json:"latency_ms"`
+	Error     string    `json:"error,omitempty"`
+	Files     int       `json:"files"`   // Conteúdos no índice do super nó
+	Holders   int       `json:"holders"` // Pares (conteúdo, detentor)
+	Clients   int       `json:"clients"` // Clientes com arquivos publicados
+	Suspects  int       `json:"suspects"`
+}
+
+// Evento de eleição ou troca de coordenador
+type electionEvent struct {
+	At          time.Time `json:"at"`
+	Event       string    `json:"event"` // "started", "won" ou "accepted"
+	Term        int       `json:"term"`
+	Coordinator string    `json:"coordinator"`
+	Node        string    `json:"node"` // Nó que registrou o evento
+}
+
+// Registra um evento no histórico de eleições. Requer mu.
+func recordElection(event string, coordinator string) {
+	electionHistory = append(electionHistory, electionEvent{At: time.Now(), Event: event, Term: currentTerm, Coordinator: coordinator, Node: superNodeAddr})
+	if len(electionHistory) > 100 {
+		electionHistory = electionHistory[len(electionHistory)-100:]
+	}
+}
+
+// Super nós conhecidos pelo coordenador. Um super nó que virou coordenador
+// numa eleição não tem os registros; usa a lista recebida, cuja posição é o ID.
+// Requer mu.
+func clusterMembers() []SuperNode {
+	var members []SuperNode
+	for _, node := range superNodes {
+		members = append(members, node)
+	}
+	if len(members) == 0 {
+		for id, addr := range knownSuperNodes {
+			if addr != "" && addr != superNodeAddr {
+				members = append(members, SuperNode{ID: id, Addr: addr})
+			}
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+	return members
+}
+
+// STATS: contagens do índice deste super nó, pedidas pelo coordenador
+func handleStats(conn net.Conn) {
+	mu.Lock()
+	holders := 0
+	clients := make(map[string]bool)
+	for _, entry := range files {
+		holders += len(entry.Holders)
+		for ip := range entry.Holders {
+			clients[ip] = true
+		}
+	}
+	fmt.Fprintf(conn, "STATS %d %d %d %d\n", len(files), holders, len(clients), len(suspectClients))
+	mu.Unlock()
+}
+
+// Consulta cada super nó a cada statsInterval, marcando-o como fora do ar se não responder
+func monitorSuperNodes() {
+	for masterNode() {
+		mu.Lock()
+		members := clusterMembers()
+		mu.Unlock()
+
+		for _, node := range members {
+			status := queryNodeStatus(node)
+			if !status.Alive {
+				statsMisses.Inc(p2p.Label("supernode", node.Addr))
+			}
+			mu.Lock()
+			if previous, ok := nodeStatuses[node.ID]; ok && !status.Alive {
+				status.LastSeen = previous.LastSeen
+				status.Files, status.Holders, status.Clients, status.Suspects = previous.Files, previous.Holders, previous.Clients, previous.Suspects
+			}
+			if previous, ok := nodeStatuses[node.ID]; ok && previous.Alive && !status.Alive {
+				slog.Warn("Super nó não responde", "id", node.ID, "addr", node.Addr, "error", status.Error)
+			} else if ok && !previous.Alive && status.Alive {
+				slog.Info("Super nó voltou a responder", "id", node.ID, "addr", node.Addr)
+			}
+			nodeStatuses[node.ID] = status
+			mu.Unlock()
+		}
+		time.Sleep(statsInterval)
+	}
+}
+
+func queryNodeStatus(node SuperNode) nodeStatus {
+	status := nodeStatus{ID: node.ID, Addr: node.Addr}
+	start := time.Now()
+	conn, err := p2p.DialTimeout(node.Addr+clientPort, 3*time.Second)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	fmt.Fprintf(conn, "STATS\n")
+	response, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	parts := strings.Fields(response)
+	if len(parts) != 5 || parts[0] != "STATS" {
+		status.Error = "resposta inesperada: " + strings.TrimSpace(response)
+		return status
+	}
+	status.Files, _ = strconv.Atoi(parts[1])
+	status.Holders, _ = strconv.Atoi(parts[2])
+	status.Clients, _ = strconv.Atoi(parts[3])
+	status.Suspects, _ = strconv.Atoi(parts[4])
+	status.Alive, status.LastSeen = true, time.Now()
+	status.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+	return status
+}
+
+// Visão do cluster servida pela API do coordenador
+type clusterView struct {
+	Coordinator string          `json:"coordinator"`
+	Term        int             `json:"term"`
+	Epoch       int             `json:"epoch"`
+	SuperNodes  []nodeStatus    `json:"supernodes"`
+	Totals      clusterTotals   `json:"totals"`
+	Elections   []electionEvent `json:"elections"`
+}
+
+// Somas dos super nós que responderam; um conteúdo em vários super nós conta uma vez em cada
+type clusterTotals struct {
+	Alive    int `json:"alive"`
+	Files    int `json:"files"`
+	Holders  int `json:"holders"`
+	Clients  int `json:"clients"`
+	Suspects int `json:"suspects"`
+}
+
+func currentClusterView() clusterView {
+	mu.Lock()
+	defer mu.Unlock()
+	view := clusterView{Coordinator: coordinatorIP, Term: currentTerm, Epoch: membershipEpoch, SuperNodes: []nodeStatus{},
+		Elections: append([]electionEvent{}, electionHistory...)}
+	for _, node := range clusterMembers() {
+		status, ok := nodeStatuses[node.ID]
+		if !ok {
+			status = nodeStatus{ID: node.ID, Addr: node.Addr, Error: "ainda não consultado"}
+		}
+		view.SuperNodes = append(view.SuperNodes, status)
+		if status.Alive {
+			view.Totals.Alive++
+			view.Totals.Files += status.Files
+			view.Totals.Holders += status.Holders
+			view.Totals.Clients += status.Clients
+			view.Totals.Suspects += status.Suspects
+		}
+	}
+	return view
+}
+
+// Servidor HTTP de administração: no coordenador, a visão do cluster e o
+// painel; nos super nós, o índice, as sessões e as ações sobre eles
+func startAdminServer() {
+	if adminAddr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/cluster", adminHandler(http.MethodGet, clusterEndpoint(func(view clusterView) interface{} { return view })))
+	mux.HandleFunc("/api/supernodes", adminHandler(http.MethodGet, clusterEndpoint(func(view clusterView) interface{} { return view.SuperNodes })))
+	mux.HandleFunc("/api/elections", adminHandler(http.MethodGet, clusterEndpoint(func(view clusterView) interface{} { return view.Elections })))
+	mux.HandleFunc("/api/node", adminHandler(http.MethodGet, viewEndpoint(func() interface{} { return currentNodeView() })))
+	mux.HandleFunc("/api/clients", adminHandler(http.MethodGet, viewEndpoint(func() interface{} { return currentClientViews() })))
+	mux.HandleFunc("/api/files", adminHandler(http.MethodGet, viewEndpoint(func() interface{} { return currentFileViews() })))
+	mux.HandleFunc("/api/searches", adminHandler(http.MethodGet, viewEndpoint(func() interface{} { return currentSearches() })))
+	mux.HandleFunc("/api/clients/kick", adminHandler(http.MethodPost, handleKickRequest))
+	mux.HandleFunc("/api/files/drop", adminHandler(http.MethodPost, handleDropRequest))
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, dashboardHTML)
+	})
+
+	slog.Info("API de administração no ar", "url", "http://"+adminAddr)
+	if err := http.ListenAndServe(adminAddr, mux); err != nil {
+		slog.Error("Erro no servidor de administração", "error", err)
+	}
+}
+
+// Rota da API: retorna o resultado, o status HTTP e o erro a informar
+type adminEndpoint func(r *http.Request) (interface{}, int, error)
+
+// Consultas sem parâmetros
+func viewEndpoint(view func() interface{}) adminEndpoint {
+	return func(r *http.Request) (interface{}, int, error) {
+		return view(), http.StatusOK, nil
+	}
+}
+
+// Consultas que só o coordenador atende
+func clusterEndpoint(part func(clusterView) interface{}) adminEndpoint {
+	return func(r *http.Request) (interface{}, int, error) {
+		mu.Lock()
+		master, coordinator := isMaster, coordinatorIP
+		mu.Unlock()
+		if !master {
+			return nil, http.StatusConflict, fmt.Errorf("Este nó não é o coordenador; o coordenador atual é %s", coordinator)
+		}
+		return part(currentClusterView()), http.StatusOK, nil
+	}
+}
+
+// Responde em JSON ({"error": ...} nas falhas); com -admin-token exige "Authorization: Bearer <token>".
+// Sem token, só as consultas (GET) são atendidas: qualquer página aberta no
+// navegador do administrador poderia enviar um POST à API local (CSRF).
+func adminHandler(method string, endpoint adminEndpoint) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body interface{}
+		var status int
+		var err error
+		switch {
+		case !adminAuthorized(r):
+			status, err = http.StatusUnauthorized, fmt.Errorf("Token de administração inválido")
+		case r.Method != http.MethodGet && adminToken == "":
+			status, err = http.StatusForbidden, fmt.Errorf("Rotas que alteram o estado exigem -admin-token")
+		case r.Method != method:
+			status, err = http.StatusMethodNotAllowed, fmt.Errorf("Método não permitido; use %s", method)
+		default:
+			body, status, err = endpoint(r)
+		}
+		if err != nil {
+			body = map[string]string{"error": err.Error()}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(body)
+	}
+}
+
+func adminAuthorized(r *http.Request) bool {
+	if adminToken == "" {
+		return true
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// Painel do coordenador; consulta /api/cluster a cada 5 segundos. Com
+// -admin-token, o token vai na URL do painel (#token=...) e é enviado no cabeçalho.
+const dashboardHTML = `<!DOCTYPE html>
+<html lang="pt-br">
+<head>
+<meta charset="utf-8">
+<title>Coordenador P2P</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+h1 { font-size: 1.4em; }
+h2 { font-size: 1.1em; margin-top: 1.5em; }
+table { border-collapse: collapse; min-width: 40em; }
+th, td { border-bottom: 1px solid #ddd; padding: 4px 10px; text-align: left; }
+th { background: #f4f4f4; }
+.up { color: #1a7f37; font-weight: bold; }
+.down { color: #cf222e; font-weight: bold; }
+.cards span { display: inline-block; margin-right: 2em; }
+.cards b { font-size: 1.3em; }
+#error { color: #cf222e; }
+</style>
+</head>
+<body>
+<h1>Coordenador <span id="coordinator"></span></h1>
+<div id="error"></div>
+<div class="cards">
+<span>Super nós no ar: <b id="alive"></b></span>
+<span>Conteúdos indexados: <b id="files"></b></span>
+<span>Detentores: <b id="holders"></b></span>
+<span>Clientes: <b id="clients"></b></span>
+<span>Suspeitos: <b id="suspects"></b></span>
+</div>
+<h2>Super nós</h2>
+<table>
+<thead><tr><th>ID</th><th>Endereço</th><th>Estado</th><th>Latência</th><th>Visto em</th><th>Conteúdos</th><th>Detentores</th><th>Clientes</th><th>Erro</th></tr></thead>
+<tbody id="nodes"></tbody>
+</table>
+<h2>Eleições</h2>
+<table>
+<thead><tr><th>Quando</th><th>Evento</th><th>Mandato</th><th>Coordenador</th><th>Registrado por</th></tr></thead>
+<tbody id="elections"></tbody>
+</table>
+<script>
+const token = new URLSearchParams(location.hash.slice(1)).get("token");
+const events = { started: "eleição iniciada", won: "assumiu como coordenador", accepted: "novo coordenador aceito", initial: "coordenador inicial" };
+function cell(row, text, cls) {
+  const td = row.insertCell();
+  td.textContent = text;
+  if (cls) td.className = cls;
+}
+function time(t) { return t && !t.startsWith("0001") ? new Date(t).toLocaleString() : "-"; }
+async function refresh() {
+  try {
+    const response = await fetch("/api/cluster", { headers: token ? { Authorization: "Bearer " + token } : {} });
+    if (!response.ok) throw new Error("HTTP " + response.status);
+    const view = await response.json();
+    document.getElementById("error").textContent = "";
+    document.getElementById("coordinator").textContent = view.coordinator + " (mandato " + view.term + ", época " + view.epoch + ")";
+    for (const key of ["alive", "files", "holders", "clients", "suspects"]) {
+      document.getElementById(key).textContent = view.totals[key] + (key === "alive" ? "/" + view.supernodes.length : "");
+    }
+    const nodes = document.getElementById("nodes");
+    nodes.innerHTML = "";
+    for (const node of view.supernodes) {
+      const row = nodes.insertRow();
+      cell(row, node.id);
+      cell(row, node.addr);
+      cell(row, node.alive ? "no ar" : "fora do ar", node.alive ? "up" : "down");
+      cell(row, node.alive ? node.latency_ms.toFixed(1) + " ms" : "-");
+      cell(row, time(node.last_seen));
+      cell(row, node.files);
+      cell(row, node.holders);
+      cell(row, node.clients);
+      cell(row, node.error || "");
+    }
+    const elections = document.getElementById("elections");
+    elections.innerHTML = "";
+    for (const e of view.elections.slice().reverse()) {
+      const row = elections.insertRow();
+      cell(row, time(e.at));
+      cell(row, events[e.event] || e.event);
+      cell(row, e.term);
+      cell(row, e.coordinator);
+      cell(row, e.node || "-");
+    }
+  } catch (err) {
+    document.getElementById("error").textContent = "Erro ao consultar a API: " + err.message;
+  }
+}
+refresh();
+setInterval(refresh, 5000);
+</script>
+</body>
+</html>
+`
+
+// Sessão aberta na porta de clientes, listada pela API de administração do super nó
+type clientSession struct {
+	conn        net.Conn
+	User        string    `json:"user"`
+	Since       time.Time `json:"since"`
+	LastActive  time.Time `json:"last_active"`
+	LastCommand string    `json:"last_command"`
+	Control     bool      `json:"control"` // Canal de controle
+	kicked      bool      // Encerrada pela administração: os arquivos saem na hora, sem tolerância
+}
+
+// Busca em outros super nós em andamento
+type federatedSearch struct {
+	ID      int       `json:"id"`
+	Kind    string    `json:"kind"` // "download" (nome ou hash) ou "find" (padrão)
+	Key     string    `json:"key"`
+	Client  string    `json:"client"`
+	User    string    `json:"user"`
+	Request string    `json:"request"` // ID que aparece nos logs de todos os super nós consultados
+	Started time.Time `json:"started"`
+}
+
+func registerSession(clientIP string, conn net.Conn) *clientSession {
+	session := &clientSession{conn: conn, Since: time.Now(), LastActive: time.Now()}
+	sessionsMu.Lock()
+	if clientSessions[clientIP] == nil {
+		clientSessions[clientIP] = make(map[*clientSession]bool)
+	}
+	clientSessions[clientIP][session] = true
+	sessionsMu.Unlock()
+	return session
+}
+
+// Remove a sessão do registro e diz se ela foi encerrada pela administração
+func unregisterSession(clientIP string, session *clientSession) bool {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	delete(clientSessions[clientIP], session)
+	if len(clientSessions[clientIP]) == 0 {
+		delete(clientSessions, clientIP)
+	}
+	return session.kicked
+}
+
+func touchSession(session *clientSession, command string, user string) {
+	sessionsMu.Lock()
+	session.LastActive, session.LastCommand, session.User = time.Now(), command, user
+	if command == "CONTROL" {
+		session.Control = true
+	}
+	sessionsMu.Unlock()
+}
+
+func beginSearch(kind string, key string, clientIP string, id clientIdentity, requestID string) int {
+	mu.Lock()
+	defer mu.Unlock()
+	nextSearchID++
+	inflightSearches[nextSearchID] = &federatedSearch{ID: nextSearchID, Kind: kind, Key: key, Client: clientIP, User: id.User,
+		Request: requestID, Started: time.Now()}
+	return nextSearchID
+}
+
+func endSearch(searchID int) {
+	mu.Lock()
+	delete(inflightSearches, searchID)
+	mu.Unlock()
+}
+
+// Encerra todas as sessões do cliente e tira seus arquivos do índice na hora;
+// com ban > 0 o IP fica bloqueado por esse tempo
+func kickClient(clientIP string, ban time.Duration) int {
+	if ban > 0 {
+		limitsMu.Lock()
+		limitFor(clientIP).bannedUntil = time.Now().Add(ban)
+		limitsMu.Unlock()
+	}
+
+	sessionsMu.Lock()
+	var conns []net.Conn
+	for session := range clientSessions[clientIP] {
+		session.kicked = true
+		conns = append(conns, session.conn)
+	}
+	sessionsMu.Unlock()
+
+	slog.Info("Cliente removido pela administração", "client", clientIP, "sessions", len(conns))
+	for _, conn := range conns {
+		conn.Close() // A última sessão a terminar tira os arquivos do índice
+	}
+	if len(conns) == 0 {
+		mu.Lock()
+		delete(suspectClients, clientIP)
+		mu.Unlock()
+		dropClient(clientIP)
+	}
+	return len(conns)
+}
+
+// Tira um conteúdo do índice, de todos os detentores ou só de um
+func dropIndexEntry(hash string, clientIP string) int {
+	mu.Lock()
+	defer mu.Unlock()
+	entry := files[hash]
+	if entry == nil {
+		return 0
+	}
+	var holders []string
+	for ip := range entry.Holders {
+		if clientIP == "" || ip == clientIP {
+			holders = append(holders, ip)
+		}
+	}
+	for _, ip := range holders {
+		removeHolder(hash, ip)
+	}
+	slog.Info("Conteúdo retirado do índice pela administração", "hash", hash, "holders", len(holders))
+	return len(holders)
+}
+
+// Super nó da lista recebida do coordenador
+type memberView struct {
+	ID          int    `json:"id"`
+	Addr        string `json:"addr"`
+	Self        bool   `json:"self"`
+	Coordinator bool   `json:"coordinator"`
+}
+
+// Estado geral do super nó
+type nodeView struct {
+	ID          string       `json:"id"`
+	Addr        string       `json:"addr"`
+	Coordinator string       `json:"coordinator"`
+	Term        int          `json:"term"`
+	Epoch       int          `json:"epoch"`
+	DHT         bool         `json:"dht"`
+	SuperNodes  []memberView `json:"supernodes"`
+	Files       int          `json:"files"`
+	Clients     int          `json:"clients"`
+	Searches    int          `json:"searches"`
+	Relays      int          `json:"relays"` // Vagas de retransmissão ocupadas, aguardando a segunda ponta ou em andamento
+}
+
+// Cliente com sessões abertas ou arquivos no índice
+type clientView struct {
+	IP            string          `json:"ip"`
+	Sessions      []clientSession `json:"sessions"`
+	SuspectSince  *time.Time      `json:"suspect_since,omitempty"`
+	Reachable     *bool           `json:"reachable,omitempty"`
+	Ratio         float64         `json:"ratio"`
+	Subscriptions int             `json:"subscriptions"`
+	Shares        []shareView     `json:"shares"`
+}
+
+type shareView struct {
+	Hash       string `json:"hash"`
+	Name       string `json:"name"`
+	Size       int64  `json:"size"`
+	Visibility string `json:"visibility"`
+	Failures   int    `json:"failures"`
+}
+
+// Entrada do índice com todos os detentores
+type fileView struct {
+	Hash      string       `json:"hash"`
+	Size      int64        `json:"size"`
+	Encrypted bool         `json:"encrypted"`
+	Holders   []holderView `json:"holders"`
+}
+
+type holderView struct {
+	IP         string `json:"ip"`
+	Name       string `json:"name"`
+	Owner      string `json:"owner"`
+	Visibility string `json:"visibility"`
+	KeyHolder  bool   `json:"key_holder"`
+	Failures   int    `json:"failures"`
+	Suspect    bool   `json:"suspect"`
+}
+
+// Requer mu.
+func currentMembers() []memberView {
+	members := []memberView{}
+	for id, addr := range knownSuperNodes {
+		if addr != "" {
+			members = append(members, memberView{ID: id, Addr: addr, Self: addr == superNodeAddr, Coordinator: addr == coordinatorIP})
+		}
+	}
+	return members
+}
+
+func currentNodeView() nodeView {
+	sessionsMu.Lock()
+	clients := len(clientSessions)
+	sessionsMu.Unlock()
+
+	mu.Lock()
+	defer mu.Unlock()
+	return nodeView{ID: superNodeID, Addr: superNodeAddr, Coordinator: coordinatorIP, Term: currentTerm, Epoch: membershipEpoch,
+		DHT: useDHT, SuperNodes: currentMembers(), Files: len(files), Clients: clients, Searches: len(inflightSearches),
+		Relays: len(relaySlots)}
+}
+
+func currentClientViews() []clientView {
+	byIP := make(map[string]*clientView)
+	view := func(ip string) *clientView {
+		if byIP[ip] == nil {
+			byIP[ip] = &clientView{IP: ip, Sessions: []clientSession{}, Shares: []shareView{}}
+		}
+		return byIP[ip]
+	}
+
+	sessionsMu.Lock()
+	for ip, sessions := range clientSessions {
+		for session := range sessions {
+			view(ip).Sessions = append(view(ip).Sessions, *session)
+		}
+	}
+	sessionsMu.Unlock()
+
+	mu.Lock()
+	for hash, entry := range files {
+		for ip, holder := range entry.Holders {
+			view(ip).Shares = append(view(ip).Shares, shareView{Hash: hash, Name: holder.Name, Size: entry.Size, Visibility: holder.Visibility, Failures: holder.Failures})
+		}
+	}
+	for ip, client := range byIP {
+		if since, ok := suspectClients[ip]; ok {
+			client.SuspectSince = &since
+		}
+		if state, ok := reachability[ip+peerPort]; ok {
+			reachable := state.Reachable
+			client.Reachable = &reachable
+		}
+		client.Ratio = shareRatio(ip)
+		client.Subscriptions = len(subscriptions[ip])
+	}
+	mu.Unlock()
+
+	clients := []clientView{}
+	for _, client := range byIP {
+		sort.Slice(client.Sessions, func(i, j int) bool { return client.Sessions[i].Since.Before(client.Sessions[j].Since) })
+		sort.Slice(client.Shares, func(i, j int) bool { return client.Shares[i].Name < client.Shares[j].Name })
+		clients = append(clients, *client)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].IP < clients[j].IP })
+	return clients
+}
+
+func currentFileViews() []fileView {
+	mu.Lock()
+	defer mu.Unlock()
+	views := []fileView{}
+	for hash, entry := range files {
+		view := fileView{Hash: hash, Size: entry.Size, Encrypted: entry.Encrypted, Holders: []holderView{}}
+		for ip, holder := range entry.Holders {
+			_, suspect := suspectClients[ip]
+			view.Holders = append(view.Holders, holderView{IP: ip, Name: holder.Name, Owner: holder.Owner, Visibility: holder.Visibility,
+				KeyHolder: holder.KeyHolder, Failures: holder.Failures, Suspect: suspect})
+		}
+		sort.Slice(view.Holders, func(i, j int) bool { return view.Holders[i].IP < view.Holders[j].IP })
+		views = append(views, view)
+	}
+	sort.Slice(views, func(i, j int) bool { return views[i].Hash < views[j].Hash })
+	return views
+}
+
+func currentSearches() []federatedSearch {
+	mu.Lock()
+	defer mu.Unlock()
+	searches := []federatedSearch{}
+	for _, search := range inflightSearches {
+		searches = append(searches, *search)
+	}
+	sort.Slice(searches, func(i, j int) bool { return searches[i].ID < searches[j].ID })
+	return searches
+}
+
+// POST /api/clients/kick?ip=<ip>[&ban=<duração>]
+func handleKickRequest(r *http.Request) (interface{}, int, error) {
+	ip := r.URL.Query().Get("ip")
+	if net.ParseIP(ip) == nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("IP inválido '%s'", ip)
+	}
+	var ban time.Duration
+	if value := r.URL.Query().Get("ban"); value != "" {
+		var err error
+		if ban, err = time.ParseDuration(value); err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("Duração de bloqueio inválida '%s'", value)
+		}
+	}
+	return map[string]interface{}{"ip": ip, "sessions_closed": kickClient(ip, ban), "banned_for": ban.String()}, http.StatusOK, nil
+}
+
+// POST /api/files/drop?hash=<hash>[&ip=<detentor>]
+func handleDropRequest(r *http.Request) (interface{}, int, error) {
+	hash, ip := r.URL.Query().Get("hash"), r.URL.Query().Get("ip")
+	if !isContentHash(hash) {
+		return nil, http.StatusBadRequest, fmt.Errorf("Hash inválido '%s'", hash)
+	}
+	if ip != "" && net.ParseIP(ip) == nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("IP inválido '%s'", ip)
+	}
+	removed := dropIndexEntry(hash, ip)
+	if removed == 0 {
+		return nil, http.StatusNotFound, fmt.Errorf("Conteúdo %s não está no índice", hash)
+	}
+	return map[string]interface{}{"hash": hash, "holders_removed": removed}, http.StatusOK, nil
+}
+
+// Métricas expostas em /metrics pelo servidor de administração
+var (
+	metricsTopClients = 20 // Clientes com série própria nas métricas por cliente
+
+	registrationsTotal = p2p.NewMetric("p2p_registrations_total", "counter", "Registros de super nós no coordenador, por resultado")
+	releasesTotal      = p2p.NewMetric("p2p_releases_total", "counter", "Liberações enviadas pelo coordenador aos super nós, por resultado")
+	electionsStarted   = p2p.NewMetric("p2p_elections_started_total", "counter", "Eleições iniciadas por este nó")
+	electionsWon       = p2p.NewMetric("p2p_elections_won_total", "counter", "Eleições vencidas por este nó")
+	heartbeatMisses    = p2p.NewMetric("p2p_coordinator_heartbeat_misses_total", "counter", "Verificações do coordenador sem resposta")
+	statsMisses        = p2p.NewMetric("p2p_supernode_stats_failures_total", "counter", "Consultas de estado do coordenador a um super nó sem resposta")
+	superNodesGauge    = p2p.NewMetric("p2p_supernodes", "gauge", "Super nós conhecidos pelo coordenador, por estado")
+	coordinatorTerm    = p2p.NewMetric("p2p_coordinator_term", "gauge", "Mandato do coordenador atual")
+	searchRequests     = p2p.NewMetric("p2p_search_requests_total", "counter", "Buscas federadas (SEARCH) atendidas por este super nó, por resultado")
+	downloadLookups    = p2p.NewMetric("p2p_download_lookups_total", "counter", "Pedidos DOWNLOAD de clientes, por onde o conteúdo foi encontrado")
+	broadcastDuration  = p2p.NewMetric("p2p_broadcast_duration_seconds", "histogram", "Duração das buscas por broadcast em outros super nós")
+	broadcastQueries   = p2p.NewMetric("p2p_broadcast_queries_total", "counter", "Super nós consultados pelas buscas por broadcast")
+	indexedFiles       = p2p.NewMetric("p2p_indexed_files", "gauge", "Conteúdos no índice deste super nó")
+	indexedHolders     = p2p.NewMetric("p2p_indexed_holders", "gauge", "Pares (conteúdo, detentor) no índice deste super nó")
+	sessionsGauge      = p2p.NewMetric("p2p_client_sessions", "gauge", "Sessões de clientes abertas")
+	suspectsGauge      = p2p.NewMetric("p2p_suspect_clients", "gauge", "Clientes desconectados dentro do período de tolerância")
+	searchesGauge      = p2p.NewMetric("p2p_inflight_searches", "gauge", "Buscas em outros super nós em andamento")
+	clientUploaded     = p2p.NewMetric("p2p_client_uploaded_bytes", "gauge", "Bytes enviados por cliente, confirmados por quem recebeu")
+	clientDownloaded   = p2p.NewMetric("p2p_client_downloaded_bytes", "gauge", "Bytes recebidos por cliente")
+)
+
+// Atualiza as métricas que refletem o estado atual, antes de cada coleta
+func collectGauges() {
+	sessionsMu.Lock()
+	sessions := 0
+	for _, perIP := range clientSessions {
+		sessions += len(perIP)
+	}
+	sessionsMu.Unlock()
+	sessionsGauge.Set("", float64(sessions))
+
+	mu.Lock()
+	defer mu.Unlock()
+	holders := 0
+	for _, entry := range files {
+		holders += len(entry.Holders)
+	}
+	indexedFiles.Set("", float64(len(files)))
+	indexedHolders.Set("", float64(holders))
+	suspectsGauge.Set("", float64(len(suspectClients)))
+	searchesGauge.Set("", float64(len(inflightSearches)))
+	coordinatorTerm.Set("", float64(currentTerm))
+
+	// Só os clientes com mais bytes têm série própria; os demais ficam em client="other"
+	uploaded := make(map[string]float64, len(credits))
+	downloaded := make(map[string]float64, len(credits))
+	for ip, account := range credits {
+		uploaded[ip] = float64(account.Uploaded)
+		downloaded[ip] = float64(account.Downloaded)
+	}
+	clientUploaded.Reset()
+	clientDownloaded.Reset()
+	clientUploaded.SetTop("client", uploaded, metricsTopClients, "")
+	clientDownloaded.SetTop("client", downloaded, metricsTopClients, "")
+
+	superNodesGauge.Reset()
+	if isMaster {
+		alive, down := 0, 0
+		for _, node := range clusterMembers() {
+			if nodeStatuses[node.ID].Alive {
+				alive++
+			} else {
+				down++
+			}
+		}
+		superNodesGauge.Set(`state="alive"`, float64(alive))
+		superNodesGauge.Set(`state="down"`, float64(down))
+	}
+}
+
+// GET /metrics, no formato de texto do Prometheus; exige o mesmo token da API
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(r) {
+		http.Error(w, "token de administração inválido", http.StatusUnauthorized)
+		return
+	}
+	collectGauges()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	p2p.WriteMetrics(w)
+}
+
+// Papéis gravados em cada linha de log, ao lado do ID do nó
+const (
+	logRoleCoordinator = "coordinator"
+	logRoleSuperNode   = "supernode"
+)
+
+var (
+	logLevel   = "info" // debug, info, warn ou error
+	logFormat  = "text" // text ou json
+	logHandler slog.Handler
+)
+
+// Configura o log estruturado (log/slog) conforme -log-level e -log-format
+func setupLogging() error {
+	handler, err := p2p.NewLogHandler(os.Stderr, logLevel, logFormat)
+	if err != nil {
+		return err
+	}
+	logHandler = handler
+	if masterNode() {
+		setLogIdentity(logRoleCoordinator, coordinatorID)
+	} else {
+		setLogIdentity(logRoleSuperNode, "")
+	}
+	return nil
+}
+
+// Troca o papel e o ID do nó que acompanham as linhas de log; o super nó só
+// conhece o ID depois de se registrar e muda de papel ao vencer uma eleição
+func setLogIdentity(role string, nodeID string) {
+	logger := slog.New(logHandler).With("role", role)
+	if nodeID != "" {
+		logger = logger.With("node", nodeID)
+	}
+	slog.SetDefault(logger)
+
+	p2p.SetTraceService("p2p-"+role, nodeID)
+}
+
+func listnerOtherNodes(listener net.Listener) {
+	for {
+		time.Sleep(1 * time.Second)
+		conn, err := listener.Accept()
+		nodeAddress := strings.Split(conn.RemoteAddr().String(), ":")[0]
+		exist := addressAlreadyExist(nodeAddress)
+		if !exist {
+			if err != nil {
+				slog.Error("Erro ao aceitar conexão de registro", "error", err)
+				continue
+			}
+			go handleSuperNodeRegistration(conn, contSuperNodes)
+			time.Sleep(5 * time.Second)
+			freeNode(superNodes[contSuperNodes])
+			contSuperNodes++
+			broadcastSuperNodes()
+		}
+		defer conn.Close()
+	}
+}
+
+func initializeNode() {
+	if masterNode() {
+		mu.Lock()
+		if currentTerm == 0 {
+			recordElection("initial", coordinatorIP)
+		}
+		mu.Unlock()
+		adminOnce.Do(func() { go startAdminServer() })
+		go monitorSuperNodes()
+		if len(superNodes) > 0 {
+			ln, err := p2p.Listen(registerPort)
+			if err != nil {
+				slog.Error("Erro ao iniciar o servidor de registro", "error", err)
+				return
+			}
+			listnerOtherNodes(ln)
+		} else {
+			ln, err := p2p.Listen(registerPort)
+			if err != nil {
+				slog.Error("Erro ao iniciar o servidor de registro", "error", err)
+				return
+			}
+
+			slog.Info("Coordenador aguardando registros dos super nós")
+
+			for contSuperNodes < 3 {
+				conn, err := ln.Accept()
+				if err != nil {
+					slog.Error("Erro ao aceitar conexão de registro", "error", err)
+					continue
+				}
+				go handleSuperNodeRegistration(conn, contSuperNodes)
+				contSuperNodes++
+			}
+
+			go freeSuperNodes() // Executa freeSuperNodes em goroutine para evitar bloqueio
+			time.Sleep(6 * time.Second)
+			broadcastSuperNodes()
+			listnerOtherNodes(ln)
+		}
+
+	} else {
+		registerWithMaster()
+		released := false
+		for released == false {
+			time.Sleep(3 * time.Second)
+			released = awaitMasterRelease()
+		}
+
+		go checkCoordinator() // Inicia verificação do coordenador em uma goroutine
+		if useDHT {
+			go startDHTServer()
+		}
+		go startRelayServer()
+		go probeHolders()
+		adminOnce.Do(func() { go startAdminServer() })
+		time.Sleep(2 * time.Second)
+
+		// Inicia o servidor para aceitar clientes
+		ln, err := p2p.Listen("0.0.0.0" + clientPort)
+		if err != nil {
+			slog.Error("Erro ao iniciar o super nó", "error", err)
+			return
+		}
+		defer ln.Close()
+
+		slog.Info("Super nó aguardando clientes", "port", clientPort)
+
+		time.Sleep(2 * time.Second)
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				slog.Error("Erro ao aceitar conexão de cliente", "error", err)
+				continue
+			}
+			go handleClient(conn)
+		}
+	}
+}
+
+func main() {
+	flag.BoolVar(&useDHT, "dht", useDHT, "localiza arquivos pela DHT entre super nós em vez de broadcast")
+	flag.BoolVar(&dhtFallback, "dht-fallback", dhtFallback, "com -dht, faz broadcast quando a DHT não encontra o arquivo")
+	flag.StringVar(&usersFile, "users", usersFile, "arquivo de usuários (\"<usuário> <sha256 do token> [grupos]\"); exige autenticação dos clientes")
+	flag.StringVar(&p2p.TLSCAFile, "tls-ca", p2p.TLSCAFile, "certificado da CA do cluster (habilita TLS mútuo com -tls-cert e -tls-key)")
+	flag.StringVar(&p2p.TLSCertFile, "tls-cert", p2p.TLSCertFile, "certificado deste nó, com OU \""+p2p.RoleNode+"\"")
+	flag.StringVar(&p2p.TLSKeyFile, "tls-key", p2p.TLSKeyFile, "chave privada do certificado deste nó")
+	flag.StringVar(&p2p.TLSTestDir, "tls-test", p2p.TLSTestDir, "modo de teste: usa (ou cria) uma CA descartável neste diretório")
+	flag.Float64Var(&rateLimit, "rate", rateLimit, "requisições por segundo permitidas a cada IP de cliente (0 desativa)")
+	flag.Float64Var(&rateBurst, "burst", rateBurst, "rajada máxima de requisições por IP")
+	flag.IntVar(&maxSessionsPerIP, "max-sessions", maxSessionsPerIP, "sessões simultâneas por IP de cliente (0 desativa)")
+	flag.IntVar(&maxFederatedSearches, "max-searches", maxFederatedSearches, "buscas simultâneas em outros super nós (0 desativa)")
+	flag.StringVar(&limitAction, "limit-action", limitAction, "ação ao exceder o limite de requisições: throttle, reject ou ban")
+	flag.DurationVar(&banDuration, "ban", banDuration, "duração do bloqueio com -limit-action ban")
+	flag.DurationVar(&gracePeriod, "grace", gracePeriod, "tempo em que os arquivos de um cliente desconectado ficam como suspeitos antes de serem removidos (0 remove na hora)")
+	flag.DurationVar(&sessionTimeout, "session-timeout", sessionTimeout, "tempo sem mensagens após o qual a sessão de um cliente é encerrada")
+	flag.IntVar(&relayLimit, "relay-limit", relayLimit, "banda de cada transferência retransmitida em KiB/s (0 = sem limite)")
+	flag.IntVar(&relayTotalLimit, "relay-total-limit", relayTotalLimit, "banda total das retransmissões em KiB/s (0 = sem limite)")
+	flag.IntVar(&maxRelays, "max-relays", maxRelays, "retransmissões simultâneas (0 desativa a retransmissão)")
+	flag.DurationVar(&probeInterval, "probe-interval", probeInterval, "intervalo entre as sondagens dos detentores (0 desativa)")
+	flag.IntVar(&maxHolderFailures, "prune-threshold", maxHolderFailures, "falhas seguidas que tiram um detentor do índice")
+	flag.StringVar(&adminAddr, "admin", adminAddr, "endereço da API HTTP de administração (vazio desativa)")
+	flag.StringVar(&adminToken, "admin-token", os.Getenv("P2P_ADMIN_TOKEN"), "token exigido pela API de administração (padrão: variável P2P_ADMIN_TOKEN)")
+	flag.DurationVar(&statsInterval, "stats-interval", statsInterval, "intervalo entre as consultas de estado do coordenador aos super nós")
+	flag.Float64Var(&leecherRatio, "leecher-ratio", leecherRatio, "razão envio/recebimento abaixo da qual o cliente recebe menos detentores")
+	flag.StringVar(&logLevel, "log-level", logLevel, "nível mínimo do log: debug, info, warn ou error")
+	flag.StringVar(&logFormat, "log-format", logFormat, "formato do log: text ou json")
+	flag.StringVar(&p2p.TraceFile, "trace-file", p2p.TraceFile, "arquivo onde gravar os spans do rastreamento em OTLP/JSON (vazio desativa)")
+	flag.StringVar(&p2p.TraceEndpoint, "trace-endpoint", p2p.TraceEndpoint, "coletor OTLP/HTTP que recebe os spans (ex.: http://127.0.0.1:4318/v1/traces)")
+	flag.Parse()
+
+	if err := setupLogging(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	var err error
+	nodePublicKey, nodePrivateKey, err = ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		slog.Error("Erro ao gerar a chave de assinatura do nó", "error", err)
+		return
+	}
+
+	if limitAction != limitThrottle && limitAction != limitReject && limitAction != limitBan {
+		slog.Error("Ação de limite inválida: use throttle, reject ou ban", "action", limitAction)
+		return
+	}
+	if maxFederatedSearches > 0 {
+		federatedSearches = make(chan struct{}, maxFederatedSearches)
+	}
+	relayLimiter = p2p.NewRateLimiter(relayTotalLimit)
+	relaySlots = make(chan struct{}, maxRelays)
+	go reportLimitStats()
+	go handleShutdownSignals()
+	if p2p.TraceFile != "" || p2p.TraceEndpoint != "" {
+		go p2p.ExportSpans()
+	}
+	go expireTransferClaims()
+	go expirePendingDownloads()
+
+	if err := p2p.SetupTLS(p2p.RoleNode, ""); err != nil {
+		slog.Error("Erro ao configurar TLS", "error", err)
+		return
+	}
+	if usersFile != "" {
+		if err := loadUsers(usersFile); err != nil {
+			slog.Error("Erro ao carregar o arquivo de usuários", "error", err)
+			return
+		}
+	}
+	initializeNode()
+}
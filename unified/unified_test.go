@@ -0,0 +1,1219 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vinibalbino/trabalho-p2p-ppd/p2p"
+)
+
+const testHash = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+// Recria o estado global usado pelos testes com um conteúdo publicado por 10.0.0.1
+func resetTestState(t *testing.T) {
+	t.Helper()
+	files = map[string]*FileEntry{testHash: {Hash: testHash, Size: 100, Holders: map[string]holderInfo{
+		"10.0.0.1": {Name: "a.txt", Owner: "alice", Visibility: visibilityPublic},
+	}}}
+	fileNames = map[string]map[string]bool{"a.txt": {testHash: true}}
+	credits = make(map[string]*creditAccount)
+	sentClaims = make(map[string]transferClaim)
+	seenTransfers = make(map[string]time.Time)
+	issuedTransfer = make(map[string]pendingDownload)
+}
+
+func issueTestTransfer(uploader string, downloader string) {
+	issuedTransfer[transferKey(testHash, uploader, downloader)] = pendingDownload{
+		fileMatch: fileMatch{Hash: testHash, Size: 100, Holders: []string{uploader}}, At: time.Now()}
+}
+
+func TestCheckTransferReport(t *testing.T) {
+	tests := []struct {
+		name       string
+		kind       string
+		hash       string
+		bytes      int64
+		uploader   string
+		issued     bool
+		wantBytes  int64
+		wantAccept bool
+	}{
+		{"RECV indicado", "RECV", testHash, 50, "10.0.0.1", true, 50, true},
+		{"RECV limitado ao tamanho", "RECV", testHash, 1 << 30, "10.0.0.1", true, 100, true},
+		{"RECV não indicado", "RECV", testHash, 50, "10.0.0.1", false, 0, false},
+		{"SENT de detentor", "SENT", testHash, 50, "10.0.0.1", false, 50, true},
+		{"SENT limitado ao tamanho", "SENT", testHash, 1 << 30, "10.0.0.1", false, 100, true},
+		{"SENT de quem não é detentor", "SENT", testHash, 50, "10.0.0.9", false, 0, false},
+		{"SENT de hash não indexado", "SENT", strings.Repeat("0", 64), 50, "10.0.0.1", false, 0, false},
+		{"tipo desconhecido", "CHARGE", testHash, 50, "10.0.0.1", true, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetTestState(t)
+			if tt.issued {
+				issueTestTransfer(tt.uploader, "10.0.0.2")
+			}
+			bytes, ok := checkTransferReport(tt.kind, tt.hash, tt.bytes, tt.uploader, "10.0.0.2")
+			if bytes != tt.wantBytes || ok != tt.wantAccept {
+				t.Errorf("checkTransferReport = %d, %v; esperado %d, %v", bytes, ok, tt.wantBytes, tt.wantAccept)
+			}
+		})
+	}
+}
+
+func TestApplyTransferReport(t *testing.T) {
+	tests := []struct {
+		name           string
+		reports        []string // tipos aplicados em sequência
+		bytes          int64
+		wantUploaded   int64
+		wantDownloaded int64
+		wantClaims     int
+	}{
+		{"SENT sem confirmação fica pendente", []string{"SENT"}, 50, 0, 0, 1},
+		{"SENT e depois RECV", []string{"SENT", "RECV"}, 50, 50, 50, 0},
+		{"RECV repetido conta uma vez", []string{"RECV", "RECV", "SENT"}, 50, 50, 50, 0},
+		{"CHARGE só debita quem baixou", []string{"CHARGE"}, 50, 0, 50, 0},
+		{"bytes limitados ao tamanho", []string{"RECV"}, 1 << 30, 100, 100, 0},
+		{"tipo desconhecido", []string{"BOGUS"}, 50, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetTestState(t)
+			for _, kind := range tt.reports {
+				applyTransferReport(kind, testHash, tt.bytes, "10.0.0.1", "10.0.0.2")
+			}
+			if got := creditAccountOf("10.0.0.1").Uploaded; got != tt.wantUploaded {
+				t.Errorf("enviado = %d, esperado %d", got, tt.wantUploaded)
+			}
+			if got := creditAccountOf("10.0.0.2").Downloaded; got != tt.wantDownloaded {
+				t.Errorf("recebido = %d, esperado %d", got, tt.wantDownloaded)
+			}
+			if len(sentClaims) != tt.wantClaims {
+				t.Errorf("envios pendentes = %d, esperado %d", len(sentClaims), tt.wantClaims)
+			}
+		})
+	}
+}
+
+// Quem baixou não pode relatar a si mesmo como detentor
+func TestApplyTransferReportSelf(t *testing.T) {
+	resetTestState(t)
+	if applyTransferReport("RECV", testHash, 50, "10.0.0.1", "10.0.0.1") {
+		t.Fatal("relato com detentor igual a quem baixou foi aceito")
+	}
+	if got := creditAccountOf("10.0.0.1").Uploaded; got != 0 {
+		t.Errorf("enviado = %d, esperado 0", got)
+	}
+}
+
+// A razão de um cliente só é informada a ele mesmo ou a um detentor indicado
+// num download pendente dele
+func TestHandleRatio(t *testing.T) {
+	resetTestState(t)
+	credits["10.0.0.2"] = &creditAccount{Downloaded: creditGrace}
+	pendingDownloads = map[string]map[string]pendingDownload{
+		"10.0.0.2": {testHash: {fileMatch: fileMatch{Hash: testHash, Holders: []string{"10.0.0.1"}}, At: time.Now()}},
+	}
+	t.Cleanup(func() { pendingDownloads = make(map[string]map[string]pendingDownload) })
+
+	tests := []struct {
+		name  string
+		asker string
+		ip    string
+		want  string
+	}{
+		{"próprio IP", "10.0.0.2", "10.0.0.2", "OK 0.50\n"},
+		{"detentor indicado", "10.0.0.1", "10.0.0.2", "OK 0.50\n"},
+		{"cliente sem relação", "10.0.0.3", "10.0.0.2", "ERROR"},
+		{"detentor perguntando de outro", "10.0.0.1", "10.0.0.3", "ERROR"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := newTestConn(tt.asker)
+			handleRatio(conn, tt.asker, tt.ip)
+			if !strings.HasPrefix(conn.out.String(), tt.want) {
+				t.Errorf("resposta %q, esperado %q", conn.out.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestLocalMatchesVisibility(t *testing.T) {
+	resetTestState(t)
+	files[testHash].Holders = map[string]holderInfo{
+		"10.0.0.1": {Name: "a.txt", Owner: "alice", Visibility: visibilityPublic},
+		"10.0.0.2": {Name: "a.txt", Owner: "bob", Visibility: visibilityPrivate},
+		"10.0.0.3": {Name: "a.txt", Owner: "carol", Visibility: visibilityGroup + "lab"},
+	}
+	tests := []struct {
+		name string
+		id   clientIdentity
+		key  string
+		want []string
+	}{
+		{"anônimo vê só o público", anonymousIdentity("10.0.0.9"), "a.txt", []string{"10.0.0.1"}},
+		{"dono vê o privado", clientIdentity{User: "bob"}, "a.txt", []string{"10.0.0.1", "10.0.0.2"}},
+		{"membro do grupo", clientIdentity{User: "dave", Groups: []string{"lab"}}, "a.txt", []string{"10.0.0.1", "10.0.0.3"}},
+		{"fora do grupo", clientIdentity{User: "erin", Groups: []string{"outro"}}, "a.txt", []string{"10.0.0.1"}},
+		{"busca pelo hash", clientIdentity{User: "carol"}, testHash, []string{"10.0.0.1", "10.0.0.3"}},
+		{"nome desconhecido", clientIdentity{User: "alice"}, "b.txt", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, match := range localMatches(tt.key, tt.id) {
+				got = append(got, match.Holders...)
+			}
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("detentores = %v, esperado %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Sem nenhum detentor visível o conteúdo não aparece na busca
+func TestLocalMatchesHidesInvisible(t *testing.T) {
+	resetTestState(t)
+	files[testHash].Holders["10.0.0.1"] = holderInfo{Name: "a.txt", Owner: "alice", Visibility: visibilityPrivate}
+	if matches := localMatches("a.txt", clientIdentity{User: "bob"}); len(matches) != 0 {
+		t.Errorf("busca retornou %d resultados, esperado nenhum", len(matches))
+	}
+}
+
+func TestValidVisibility(t *testing.T) {
+	id := clientIdentity{User: "alice", Groups: []string{"lab"}}
+	tests := []struct {
+		visibility string
+		want       bool
+	}{
+		{visibilityPublic, true},
+		{visibilityPrivate, true},
+		{"group:lab", true},
+		{"group:outro", false},
+		{"group:", false},
+		{"", false},
+		{"todos", false},
+	}
+	for _, tt := range tests {
+		if got := validVisibility(id, tt.visibility); got != tt.want {
+			t.Errorf("validVisibility(%q) = %v, esperado %v", tt.visibility, got, tt.want)
+		}
+	}
+}
+
+func writeTestUsers(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "users.txt")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func testTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestAuthenticate(t *testing.T) {
+	path := writeTestUsers(t, "# usuários de teste\n"+
+		"alice "+testTokenHash("segredo")+" lab,ppd\n"+
+		"bob "+strings.ToUpper(testTokenHash("outro"))+"\n")
+	if err := loadUsers(path); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { users = make(map[string]userAccount) }()
+
+	tests := []struct {
+		name   string
+		user   string
+		token  string
+		ok     bool
+		groups []string
+	}{
+		{"token correto", "alice", "segredo", true, []string{"lab", "ppd"}},
+		{"hash em maiúsculas no arquivo", "bob", "outro", true, nil},
+		{"token errado", "alice", "outro", false, nil},
+		{"token vazio", "alice", "", false, nil},
+		{"usuário desconhecido", "carol", "segredo", false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, ok := authenticate(tt.user, tt.token)
+			if ok != tt.ok {
+				t.Fatalf("authenticate = %v, esperado %v", ok, tt.ok)
+			}
+			if ok && (id.User != tt.user || strings.Join(id.Groups, ",") != strings.Join(tt.groups, ",")) {
+				t.Errorf("identidade = %+v, esperado %s com grupos %v", id, tt.user, tt.groups)
+			}
+		})
+	}
+}
+
+func TestLoadUsersRejectsMalformed(t *testing.T) {
+	for _, content := range []string{"alice\n", "alice abc\n", "alice " + testTokenHash("x") + "00\n"} {
+		if err := loadUsers(writeTestUsers(t, content)); err == nil {
+			t.Errorf("arquivo %q aceito", content)
+		}
+	}
+}
+
+// Monta o anel com IDs fixos, sem passar pelo hash dos endereços
+func setTestRing(t *testing.T, ids ...uint32) {
+	t.Helper()
+	dhtRing = nil
+	for i, id := range ids {
+		dhtRing = append(dhtRing, dhtNode{ID: id, Addr: "10.1.0." + strconv.Itoa(i+1)})
+	}
+	t.Cleanup(func() { dhtRing = nil })
+}
+
+func TestDHTReplicaSet(t *testing.T) {
+	setTestRing(t, 100, 200, 300)
+	tests := []struct {
+		name string
+		id   uint32
+		want []string
+	}{
+		{"antes do primeiro", 50, []string{"10.1.0.1", "10.1.0.2"}},
+		{"igual a um nó", 200, []string{"10.1.0.2", "10.1.0.3"}},
+		{"entre dois nós", 201, []string{"10.1.0.3", "10.1.0.1"}},
+		{"depois do último dá a volta", 301, []string{"10.1.0.1", "10.1.0.2"}},
+		{"fim do anel", ^uint32(0), []string{"10.1.0.1", "10.1.0.2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, node := range dhtReplicaSet(tt.id) {
+				got = append(got, node.Addr)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("réplicas de %d = %v, esperado %v", tt.id, got, tt.want)
+			}
+		})
+	}
+}
+
+// Com menos super nós do que réplicas, cada nó aparece uma vez só
+func TestDHTReplicaSetSmallRing(t *testing.T) {
+	setTestRing(t, 100)
+	if nodes := dhtReplicaSet(500); len(nodes) != 1 || nodes[0].Addr != "10.1.0.1" {
+		t.Errorf("réplicas = %v, esperado só 10.1.0.1", nodes)
+	}
+	setTestRing(t)
+	if _, err := dhtResponsibleNodes("name:a.txt"); err == nil {
+		t.Error("anel vazio não retornou erro")
+	}
+}
+
+// O anel é ordenado pelo hash dos endereços e o responsável pela chave é o
+// primeiro nó a partir do hash dela
+func TestDHTResponsibleNodes(t *testing.T) {
+	oldNodes, oldAddr := knownSuperNodes, superNodeAddr
+	defer func() { knownSuperNodes, superNodeAddr, dhtRing = oldNodes, oldAddr, nil }()
+	resetTestState(t)
+	files = make(map[string]*FileEntry)
+	knownSuperNodes = []string{"10.2.0.1", "10.2.0.2", "", "10.2.0.3", "10.2.0.4"}
+	superNodeAddr = "10.2.0.1"
+	rebuildDHTRing()
+
+	if len(dhtRing) != 4 {
+		t.Fatalf("anel com %d nós, esperado 4", len(dhtRing))
+	}
+	for i := 1; i < len(dhtRing); i++ {
+		if dhtRing[i-1].ID >= dhtRing[i].ID {
+			t.Fatalf("anel fora de ordem: %v", dhtRing)
+		}
+	}
+	for _, node := range dhtRing {
+		if node.ID != dhtHash(node.Addr) {
+			t.Errorf("%s na posição %d, esperado %d", node.Addr, node.ID, dhtHash(node.Addr))
+		}
+	}
+
+	for _, key := range []string{"name:a.txt", "name:b.pdf", "hash:" + testHash} {
+		nodes, err := dhtResponsibleNodes(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// O primeiro responsável é o nó de menor posição >= hash da chave, ou o primeiro do anel
+		want := dhtRing[0]
+		for _, node := range dhtRing {
+			if node.ID >= dhtHash(key) {
+				want = node
+				break
+			}
+		}
+		if len(nodes) != dhtReplicas || nodes[0] != want.Addr || nodes[0] == nodes[1] {
+			t.Errorf("responsáveis por %s = %v, esperado %s e mais uma réplica", key, nodes, want.Addr)
+		}
+	}
+}
+
+// Ao reconstruir o anel, o nó descarta as chaves pelas quais deixou de responder
+func TestRebuildDHTRingDropsForeignKeys(t *testing.T) {
+	oldNodes, oldAddr := knownSuperNodes, superNodeAddr
+	defer func() { knownSuperNodes, superNodeAddr, dhtRing = oldNodes, oldAddr, nil }()
+	resetTestState(t)
+	files = make(map[string]*FileEntry)
+	knownSuperNodes = []string{"10.2.0.1", "10.2.0.2", "10.2.0.3", "10.2.0.4"}
+	superNodeAddr = "10.2.0.1"
+	dhtIndex = make(map[string]map[string]bool)
+	for i := 0; i < 20; i++ {
+		dhtIndex["name:"+strconv.Itoa(i)] = map[string]bool{"v": true}
+	}
+	rebuildDHTRing()
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i := 0; i < 20; i++ {
+		key := "name:" + strconv.Itoa(i)
+		responsible := false
+		for _, node := range dhtReplicaSet(dhtHash(key)) {
+			responsible = responsible || node.Addr == superNodeAddr
+		}
+		if _, kept := dhtIndex[key]; kept != responsible {
+			t.Errorf("chave %s mantida = %v, responsável = %v", key, kept, responsible)
+		}
+	}
+}
+
+// A resposta VALUES não passa de dhtMaxReply bytes
+func TestDHTValuesBounded(t *testing.T) {
+	dhtIndex = map[string]map[string]bool{"name:a.txt": {}}
+	defer func() { dhtIndex = make(map[string]map[string]bool) }()
+	value := strings.Repeat("x", 1000)
+	for i := 0; i < 200; i++ {
+		dhtIndex["name:a.txt"][strconv.Itoa(i)+value] = true
+	}
+	values, truncated := dhtValues("name:a.txt")
+	if !truncated {
+		t.Error("resposta não foi truncada")
+	}
+	if size := len("VALUES " + strings.Join(values, ",") + "\n"); size > dhtMaxReply {
+		t.Errorf("resposta com %d bytes, limite %d", size, dhtMaxReply)
+	}
+
+	dhtIndex["name:b.txt"] = map[string]bool{"v1": true, "v2": true}
+	if values, truncated := dhtValues("name:b.txt"); truncated || len(values) != 2 {
+		t.Errorf("valores = %v (truncado = %v), esperado os 2", values, truncated)
+	}
+}
+
+func testNodeKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return public, private
+}
+
+// Assina a mensagem como o nó dono da chave privada
+func signedBy(private ed25519.PrivateKey, payload string) string {
+	saved := nodePrivateKey
+	defer func() { nodePrivateKey = saved }()
+	nodePrivateKey = private
+	return signMessage(payload)
+}
+
+// Estado de eleição conhecido pelos testes: coordenador 10.3.0.1 no mandato 5, época 2
+func resetElectionState(t *testing.T, coordinatorPublic ed25519.PublicKey, candidatePublic ed25519.PublicKey) {
+	t.Helper()
+	coordinatorIP, coordinatorKey = "10.3.0.1", coordinatorPublic
+	currentTerm, membershipEpoch = 5, 2
+	knownSuperNodes = []string{"10.3.0.1", "10.3.0.2"}
+	knownKeys = map[string]ed25519.PublicKey{"10.3.0.1": coordinatorPublic, "10.3.0.2": candidatePublic}
+	electionHistory = nil
+	t.Cleanup(func() {
+		coordinatorIP, coordinatorKey, currentTerm, membershipEpoch = "", nil, 0, 0
+		knownSuperNodes, knownKeys = []string{}, make(map[string]ed25519.PublicKey)
+	})
+}
+
+func TestMembershipAnnouncement(t *testing.T) {
+	coordinatorPublic, coordinatorPrivate := testNodeKey(t)
+	candidatePublic, _ := testNodeKey(t)
+	_, forgerPrivate := testNodeKey(t)
+	members := "10.3.0.1|" + base64.StdEncoding.EncodeToString(coordinatorPublic) + ",10.3.0.9|" + base64.StdEncoding.EncodeToString(candidatePublic)
+
+	tests := []struct {
+		name    string
+		message string
+		accept  bool
+	}{
+		{"assinada pelo coordenador", signedBy(coordinatorPrivate, "MEMBERS 5 3 "+members), true},
+		{"mandato novo", signedBy(coordinatorPrivate, "MEMBERS 6 1 "+members), true},
+		{"assinatura forjada", signedBy(forgerPrivate, "MEMBERS 5 3 "+members), false},
+		{"sem assinatura", "MEMBERS 5 3 " + members, false},
+		{"assinatura adulterada", signedBy(coordinatorPrivate, "MEMBERS 5 3 "+members) + "x", false},
+		{"conteúdo alterado", strings.Replace(signedBy(coordinatorPrivate, "MEMBERS 5 3 "+members), "10.3.0.9", "10.3.0.8", 1), false},
+		{"mandato antigo", signedBy(coordinatorPrivate, "MEMBERS 4 9 "+members), false},
+		{"época repetida", signedBy(coordinatorPrivate, "MEMBERS 5 2 "+members), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetElectionState(t, coordinatorPublic, candidatePublic)
+			handleMembershipAnnouncement(tt.message)
+			accepted := len(knownSuperNodes) == 2 && knownSuperNodes[1] == "10.3.0.9"
+			if accepted != tt.accept {
+				t.Errorf("lista aceita = %v, esperado %v (super nós: %v)", accepted, tt.accept, knownSuperNodes)
+			}
+		})
+	}
+}
+
+func TestCoordinatorAnnouncement(t *testing.T) {
+	coordinatorPublic, _ := testNodeKey(t)
+	candidatePublic, candidatePrivate := testNodeKey(t)
+	_, forgerPrivate := testNodeKey(t)
+
+	tests := []struct {
+		name    string
+		message string
+		accept  bool
+	}{
+		{"assinado pelo novo coordenador", signedBy(candidatePrivate, "COORDINATOR 6 10.3.0.2"), true},
+		{"assinatura forjada", signedBy(forgerPrivate, "COORDINATOR 6 10.3.0.2"), false},
+		{"assinado por outro super nó", signedBy(candidatePrivate, "COORDINATOR 6 10.3.0.1"), false},
+		{"nó desconhecido", signedBy(candidatePrivate, "COORDINATOR 6 10.3.0.7"), false},
+		{"sem assinatura", "COORDINATOR 6 10.3.0.2", false},
+		{"mandato atual", signedBy(candidatePrivate, "COORDINATOR 5 10.3.0.2"), false},
+		{"mandato antigo", signedBy(candidatePrivate, "COORDINATOR 4 10.3.0.2"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetElectionState(t, coordinatorPublic, candidatePublic)
+			handleCoordinatorAnnouncement(tt.message)
+			accepted := coordinatorIP != "10.3.0.1"
+			if accepted != tt.accept {
+				t.Fatalf("coordenador aceito = %v, esperado %v", accepted, tt.accept)
+			}
+			if accepted && (currentTerm != 6 || membershipEpoch != 0 || !coordinatorKey.Equal(candidatePublic)) {
+				t.Errorf("mandato %d, época %d após aceitar o coordenador", currentTerm, membershipEpoch)
+			}
+			if !accepted && currentTerm != 5 {
+				t.Errorf("mandato mudou para %d num anúncio recusado", currentTerm)
+			}
+		})
+	}
+}
+
+// Conexão falsa: guarda o que o super nó escreve e informa o endereço do cliente
+type testConn struct {
+	net.Conn
+	addr string
+	out  strings.Builder
+}
+
+func newTestConn(ip string) *testConn {
+	return &testConn{addr: ip + ":50000"}
+}
+
+func (c *testConn) Write(p []byte) (int, error) {
+	return c.out.Write(p)
+}
+
+func (c *testConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func (c *testConn) RemoteAddr() net.Addr {
+	addr, _ := net.ResolveTCPAddr("tcp", c.addr)
+	return addr
+}
+
+// Cliente anônimo 10.0.0.1, com um arquivo seu e uma cópia de outro dono, que caiu e ficou suspeito
+func resetResumeState(t *testing.T, auth bool) {
+	t.Helper()
+	resetTestState(t)
+	copyHash := strings.Repeat("ab", 32)
+	owner := "anon@10.0.0.1"
+	if auth {
+		owner = "alice"
+		usersFile = "users.txt"
+	}
+	files[testHash].Holders["10.0.0.1"] = holderInfo{Name: "a.txt", Owner: owner, Visibility: visibilityPrivate}
+	files[copyHash] = &FileEntry{Hash: copyHash, Size: 10, Holders: map[string]holderInfo{
+		"10.0.0.1": {Name: "b.txt", Owner: "bob", Visibility: visibilityPublic},
+	}}
+	suspectClients = map[string]time.Time{"10.0.0.1": time.Now()}
+	subscriptions = make(map[string][]*subscription)
+	pendingDownloads = make(map[string]map[string]pendingDownload)
+	clientTokens = map[string]string{"10.0.0.1": "token1"}
+	sessionTokens = map[string]sessionToken{"token1": {IP: "10.0.0.1", User: owner}}
+	t.Cleanup(func() { usersFile = "" })
+}
+
+func TestResume(t *testing.T) {
+	tests := []struct {
+		name    string
+		auth    bool
+		ip      string
+		id      clientIdentity
+		token   string
+		suspect bool
+		want    string
+		owner   string // dono do arquivo do cliente depois de retomar
+	}{
+		{"anônimo volta por outro IP", false, "10.0.0.5", anonymousIdentity("10.0.0.5"), "token1", true, "OK 2", "anon@10.0.0.5"},
+		{"anônimo volta pelo mesmo IP", false, "10.0.0.1", anonymousIdentity("10.0.0.1"), "token1", true, "OK 2", "anon@10.0.0.1"},
+		{"usuário volta por outro IP", true, "10.0.0.5", clientIdentity{User: "alice"}, "token1", true, "OK 2", "alice"},
+		{"outro usuário com o token", true, "10.0.0.5", clientIdentity{User: "mallory"}, "token1", true, "ERROR", ""},
+		{"token desconhecido", false, "10.0.0.5", anonymousIdentity("10.0.0.5"), "token2", true, "ERROR", ""},
+		{"sessão antiga ainda ativa", false, "10.0.0.5", anonymousIdentity("10.0.0.5"), "token1", false, "ERROR", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetResumeState(t, tt.auth)
+			if !tt.suspect {
+				delete(suspectClients, "10.0.0.1")
+			}
+			conn := newTestConn(tt.ip)
+			handleResume(conn, tt.id, tt.token)
+			if got := strings.TrimSpace(conn.out.String()); !strings.HasPrefix(got, tt.want) {
+				t.Fatalf("resposta = %q, esperado %q", got, tt.want)
+			}
+			if tt.owner == "" {
+				if _, kept := files[testHash].Holders["10.0.0.1"]; !kept {
+					t.Error("arquivos movidos num RESUME recusado")
+				}
+				return
+			}
+			holder, ok := files[testHash].Holders[tt.ip]
+			if !ok || holder.Owner != tt.owner {
+				t.Errorf("detentor em %s = %+v, esperado dono %s", tt.ip, holder, tt.owner)
+			}
+			if copyHolder := files[strings.Repeat("ab", 32)].Holders[tt.ip]; copyHolder.Owner != "bob" {
+				t.Errorf("cópia passou a ser de %q, esperado bob", copyHolder.Owner)
+			}
+			if session := sessionTokens["token1"]; session.IP != tt.ip || session.User != tt.id.User {
+				t.Errorf("sessão = %+v, esperado %s em %s", session, tt.id.User, tt.ip)
+			}
+			// O dono continua vendo o próprio arquivo privado depois de mudar de IP
+			if matches := localMatches(testHash, tt.id); len(matches) != 1 {
+				t.Errorf("arquivo privado invisível para o dono depois do RESUME")
+			}
+		})
+	}
+}
+
+// Os arquivos de um cliente suspeito saem do índice só se ele não voltar a tempo
+func TestSuspectExpiry(t *testing.T) {
+	saved := gracePeriod
+	defer func() { gracePeriod = saved }()
+	gracePeriod = 20 * time.Millisecond
+
+	for _, returns := range []bool{false, true} {
+		resetResumeState(t, false)
+		delete(suspectClients, "10.0.0.1")
+		suspendClient("10.0.0.1")
+		if returns {
+			// handleClient apaga a suspeita quando o cliente volta
+			mu.Lock()
+			delete(suspectClients, "10.0.0.1")
+			mu.Unlock()
+		}
+		time.Sleep(100 * time.Millisecond)
+
+		mu.Lock()
+		kept := files[testHash] != nil && files[testHash].Holders["10.0.0.1"].Name != ""
+		_, token := clientTokens["10.0.0.1"]
+		mu.Unlock()
+		if kept != returns || token != returns {
+			t.Errorf("cliente voltou = %v: arquivos mantidos = %v, token mantido = %v", returns, kept, token)
+		}
+	}
+}
+
+// Solicitante 10.0.0.2 pedindo a 10.0.0.1, que tem canal de controle com este super nó
+func resetConnectState(t *testing.T, slots int) *testConn {
+	t.Helper()
+	resetTestState(t)
+	holder := newTestConn("10.0.0.1")
+	controlChannels = map[string]*controlChannel{holder.addr: {conn: holder, addr: holder.addr}}
+	reachability = make(map[string]reachState)
+	relays = make(map[string]*relaySession)
+	relaySlots = make(chan struct{}, slots)
+	knownSuperNodes = []string{}
+	t.Cleanup(func() { controlChannels = make(map[string]*controlChannel) })
+	return holder
+}
+
+func TestConnectReverseOrRelay(t *testing.T) {
+	token := strings.Repeat("a1", 16)
+	tests := []struct {
+		name      string
+		reachable bool
+		holder    string
+		slots     int
+		want      string
+		control   string // início do aviso ao detentor; vazio se nada é enviado
+	}{
+		{"solicitante alcançável", true, "10.0.0.1", 1, "OK REVERSE", "REVERSE " + token + " 10.0.0.2 "},
+		{"solicitante atrás de NAT", false, "10.0.0.1", 1, "OK RELAY", "RELAY " + token + " "},
+		{"sem vaga de retransmissão", false, "10.0.0.1", 0, "BUSY", ""},
+		{"não é detentor", true, "10.0.0.9", 1, "ERROR", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			holder := resetConnectState(t, tt.slots)
+			reachability["10.0.0.2"+peerPort] = reachState{Reachable: tt.reachable, At: time.Now()}
+			conn := newTestConn("10.0.0.2")
+			handleConnect(conn, anonymousIdentity("10.0.0.2"), tt.holder, testHash, token, p2p.SpanContext{})
+			if got := conn.out.String(); !strings.HasPrefix(got, tt.want) {
+				t.Errorf("resposta = %q, esperado %q", got, tt.want)
+			}
+			if got := holder.out.String(); (tt.control == "" && got != "") || !strings.HasPrefix(got, tt.control) {
+				t.Errorf("aviso ao detentor = %q, esperado %q", got, tt.control)
+			}
+		})
+	}
+}
+
+// Um token repetido não toma a vaga de outra retransmissão, e o prazo de
+// uma reserva antiga não derruba a nova
+func TestRelayTokenReuse(t *testing.T) {
+	resetConnectState(t, 2)
+	token := strings.Repeat("b2", 16)
+
+	first, err := registerRelay(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := registerRelay(token); err != errRelayTokenInUse {
+		t.Fatalf("token repetido: erro %v, esperado %v", err, errRelayTokenInUse)
+	}
+	if len(relaySlots) != 1 {
+		t.Fatalf("%d vagas ocupadas, esperado 1", len(relaySlots))
+	}
+
+	expireRelay(token, first)
+	if len(relaySlots) != 0 || relays[token] != nil {
+		t.Fatalf("reserva expirada não liberou a vaga")
+	}
+	second, err := registerRelay(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expireRelay(token, first) // prazo atrasado da primeira reserva
+	if relays[token] != second || len(relaySlots) != 1 {
+		t.Errorf("o prazo da reserva antiga derrubou a nova")
+	}
+	expireRelay(token, second)
+	if len(relaySlots) != 0 {
+		t.Errorf("%d vagas ocupadas depois de expirar tudo, esperado 0", len(relaySlots))
+	}
+}
+
+// Só conta o relato de falha de um download indicado a quem relata, uma vez por janela
+func TestFailedReport(t *testing.T) {
+	resetTestState(t)
+	holderReports = make(map[string]time.Time)
+	reachability = map[string]reachState{"10.0.0.1" + peerPort: {Reachable: false, At: time.Now()}}
+	knownSuperNodes = []string{}
+
+	failures := func() int { return files[testHash].Holders["10.0.0.1"].Failures }
+
+	conn := newTestConn("10.0.0.2")
+	handleFailedReport(conn, testHash, "10.0.0.1")
+	if !strings.HasPrefix(conn.out.String(), "ERROR") || failures() != 0 {
+		t.Fatalf("relato sem download indicado: resposta %q, falhas %d", conn.out.String(), failures())
+	}
+
+	issueTestTransfer("10.0.0.1", "10.0.0.2")
+	for i := 0; i < 3; i++ {
+		conn := newTestConn("10.0.0.2")
+		handleFailedReport(conn, testHash, "10.0.0.1")
+		if !strings.HasPrefix(conn.out.String(), "OK") {
+			t.Fatalf("resposta = %q, esperado OK", conn.out.String())
+		}
+	}
+	if failures() != 1 {
+		t.Errorf("%d falhas depois de 3 relatos do mesmo cliente, esperado 1", failures())
+	}
+
+	// Detentor de outro super nó: o relato é repassado só da primeira vez
+	other := strings.Repeat("cd", 32)
+	if local, counted := checkReportedHolder(other, "10.0.0.7", "10.0.0.2"); local || !counted {
+		t.Errorf("primeiro relato de detentor remoto: local = %v, contado = %v", local, counted)
+	}
+	if _, counted := checkReportedHolder(other, "10.0.0.7", "10.0.0.2"); counted {
+		t.Error("relato repetido de detentor remoto seria repassado de novo")
+	}
+}
+
+func resetLimits(t *testing.T, rate float64, burst float64, action string) {
+	t.Helper()
+	previousRate, previousBurst, previousAction, previousSessions := rateLimit, rateBurst, limitAction, maxSessionsPerIP
+	rateLimit, rateBurst, limitAction = rate, burst, action
+	limitsMu.Lock()
+	clientLimits = make(map[string]*clientLimit)
+	limitStats = enforcementStats{}
+	limitsMu.Unlock()
+	t.Cleanup(func() {
+		rateLimit, rateBurst, limitAction, maxSessionsPerIP = previousRate, previousBurst, previousAction, previousSessions
+		clientLimits = make(map[string]*clientLimit)
+	})
+}
+
+// A rajada passa inteira; o que excede espera, é recusado ou bloqueia o IP conforme -limit-action
+func TestAllowRequest(t *testing.T) {
+	tests := []struct {
+		action   string
+		wantWait bool
+		wantErr  bool
+		banned   bool
+	}{
+		{limitThrottle, true, false, false},
+		{limitReject, false, true, false},
+		{limitBan, false, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.action, func(t *testing.T) {
+			resetLimits(t, 1, 3, tt.action)
+			for i := 0; i < 3; i++ {
+				if wait, err := allowRequest("10.0.0.2"); wait != 0 || err != nil {
+					t.Fatalf("requisição %d da rajada: espera %v, erro %v", i+1, wait, err)
+				}
+			}
+			wait, err := allowRequest("10.0.0.2")
+			if (err != nil) != tt.wantErr || (wait > 0) != tt.wantWait || wait > time.Second {
+				t.Errorf("requisição além da rajada: espera %v, erro %v", wait, err)
+			}
+			if tt.wantWait && wait < 900*time.Millisecond {
+				t.Errorf("espera %v, esperado cerca de 1s a 1 requisição/s", wait)
+			}
+			if wait, err := allowRequest("10.0.0.3"); wait != 0 || err != nil {
+				t.Errorf("outro IP foi limitado: espera %v, erro %v", wait, err)
+			}
+
+			// Com o balde cheio de novo, só o IP bloqueado continua recusado
+			limitsMu.Lock()
+			clientLimits["10.0.0.2"].tokens = rateBurst
+			limitsMu.Unlock()
+			if _, err := allowRequest("10.0.0.2"); (err != nil) != tt.banned {
+				t.Errorf("depois de recarregar: erro %v, bloqueado = %v", err, tt.banned)
+			}
+			if err := openSession("10.0.0.2", false); (err != nil) != tt.banned {
+				t.Errorf("nova sessão: erro %v, bloqueado = %v", err, tt.banned)
+			}
+		})
+	}
+}
+
+func TestAllowRequestDisabled(t *testing.T) {
+	resetLimits(t, 0, 1, limitReject)
+	for i := 0; i < 10; i++ {
+		if wait, err := allowRequest("10.0.0.2"); wait != 0 || err != nil {
+			t.Fatalf("requisição %d sem limite: espera %v, erro %v", i+1, wait, err)
+		}
+	}
+}
+
+func TestOpenSession(t *testing.T) {
+	resetLimits(t, 1, 1, limitReject)
+	maxSessionsPerIP = 2
+	for i := 0; i < 2; i++ {
+		if err := openSession("10.0.0.2", false); err != nil {
+			t.Fatalf("sessão %d: %v", i+1, err)
+		}
+	}
+	if err := openSession("10.0.0.2", false); err == nil {
+		t.Error("sessão além do limite foi aceita")
+	}
+	if err := openSession("10.0.0.2", true); err != nil {
+		t.Errorf("sessão isenta recusada: %v", err)
+	}
+	if open := closeSession("10.0.0.2"); open != 2 {
+		t.Errorf("%d sessões abertas depois de encerrar uma, esperado 2", open)
+	}
+	closeSession("10.0.0.2")
+	if err := openSession("10.0.0.2", false); err != nil {
+		t.Errorf("sessão recusada depois de liberar vaga: %v", err)
+	}
+	if limitStats.SessionsRefused != 1 {
+		t.Errorf("%d sessões recusadas contadas, esperado 1", limitStats.SessionsRefused)
+	}
+}
+
+func TestAcquireSearchSlot(t *testing.T) {
+	resetLimits(t, 1, 1, limitReject)
+	previous := federatedSearches
+	t.Cleanup(func() { federatedSearches = previous })
+
+	federatedSearches = nil
+	if !acquireSearchSlot() {
+		t.Error("busca recusada sem limite de buscas")
+	}
+
+	federatedSearches = make(chan struct{}, 1)
+	if !acquireSearchSlot() {
+		t.Fatal("vaga livre recusada")
+	}
+	if acquireSearchSlot() {
+		t.Error("busca aceita sem vaga no modo reject")
+	}
+	if limitStats.SearchesRefused != 1 {
+		t.Errorf("%d buscas recusadas contadas, esperado 1", limitStats.SearchesRefused)
+	}
+
+	// No modo throttle a busca espera a vaga ser liberada
+	limitAction = limitThrottle
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		releaseSearchSlot()
+	}()
+	if !acquireSearchSlot() {
+		t.Error("busca não recebeu a vaga liberada no modo throttle")
+	}
+	releaseSearchSlot()
+}
+
+// Conexão em memória com o endereço remoto de um cliente
+type pipeConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c pipeConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// PING é respondido com PONG, CONTROL registra o canal de controle e a sessão
+// calada por sessionTimeout é encerrada, levando o canal junto
+func TestClientSessionKeepalive(t *testing.T) {
+	resetTestState(t)
+	resetLimits(t, 0, 1, limitReject)
+	previousTimeout, previousGrace := sessionTimeout, gracePeriod
+	sessionTimeout, gracePeriod = 200*time.Millisecond, 0
+	t.Cleanup(func() { sessionTimeout, gracePeriod = previousTimeout, previousGrace })
+	mu.Lock()
+	reachability = map[string]reachState{"10.0.0.5" + peerPort: {Reachable: true, At: time.Now()}}
+	controlChannels = make(map[string]*controlChannel)
+	mu.Unlock()
+
+	server, client := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleClient(pipeConn{Conn: server, addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.5"), Port: 50000}})
+	}()
+	reader := bufio.NewReader(client)
+	exchange := func(command string) string {
+		t.Helper()
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := client.Write([]byte(command + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(line)
+	}
+
+	// Os PINGs mantêm a sessão viva além de sessionTimeout
+	for i := 0; i < 4; i++ {
+		if got := exchange("PING"); got != "PONG" {
+			t.Fatalf("PING respondido com %q", got)
+		}
+		time.Sleep(sessionTimeout / 2)
+	}
+	if got := exchange("CONTROL"); !strings.HasPrefix(got, "OK") {
+		t.Fatalf("CONTROL respondido com %q", got)
+	}
+	mu.Lock()
+	_, registered := controlChannels["10.0.0.5:50000"]
+	mu.Unlock()
+	if !registered {
+		t.Error("canal de controle não registrado")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sessão sem PING não foi encerrada")
+	}
+	mu.Lock()
+	_, registered = controlChannels["10.0.0.5:50000"]
+	mu.Unlock()
+	if registered {
+		t.Error("canal de controle continua registrado depois do fim da sessão")
+	}
+}
+
+// Quem tem um download pendente do conteúdo é avisado pelo canal de controle
+// quando o detentor indicado sai
+func TestRemoveHolderNotifiesDownloads(t *testing.T) {
+	resetTestState(t)
+	waiting := newTestConn("10.0.0.2")
+	other := newTestConn("10.0.0.3")
+	channels := map[string]*controlChannel{
+		"10.0.0.2": {conn: waiting, addr: "10.0.0.2:50000"},
+		"10.0.0.3": {conn: other, addr: "10.0.0.3:50000"},
+	}
+	mu.Lock()
+	controlChannels = map[string]*controlChannel{"10.0.0.2:50000": channels["10.0.0.2"], "10.0.0.3:50000": channels["10.0.0.3"]}
+	pendingDownloads = map[string]map[string]pendingDownload{
+		"10.0.0.2": {testHash: {fileMatch: fileMatch{Hash: testHash, Holders: []string{"10.0.0.1"}}, At: time.Now()}},
+		"10.0.0.3": {testHash: {fileMatch: fileMatch{Hash: testHash, Holders: []string{"10.0.0.9"}}, At: time.Now()}},
+	}
+	removeHolder(testHash, "10.0.0.1")
+	mu.Unlock()
+	t.Cleanup(func() {
+		controlChannels = make(map[string]*controlChannel)
+		pendingDownloads = make(map[string]map[string]pendingDownload)
+	})
+
+	output := func(ip string) string {
+		channels[ip].mu.Lock()
+		defer channels[ip].mu.Unlock()
+		return channels[ip].conn.(*testConn).out.String()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for output("10.0.0.2") == "" && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got, want := output("10.0.0.2"), "HOLDER_GONE "+testHash+" 10.0.0.1\n"; got != want {
+		t.Errorf("aviso %q, esperado %q", got, want)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := output("10.0.0.3"); got != "" {
+		t.Errorf("cliente sem download do detentor recebeu %q", got)
+	}
+}
+
+func TestSubscriptionMatches(t *testing.T) {
+	tests := []struct {
+		kind  string
+		value string
+		name  string
+		want  bool
+	}{
+		{"pattern", "*.pdf", "artigo.pdf", true},
+		{"pattern", "*.pdf", "artigo.pdf.txt", false},
+		{"pattern", "relatorio-??.txt", "relatorio-01.txt", true},
+		{"pattern", "relatorio-??.txt", "relatorio-001.txt", false},
+		{"pattern", "[ab]*", "beta.txt", true},
+		{"pattern", "[ab]*", "gama.txt", false},
+		{"pattern", "*", "dir/a.txt", false}, // "*" não atravessa separadores
+		{"name", "a.txt", "a.txt", true},
+		{"name", "a.txt", "A.txt", false},
+		{"hash", testHash, "qualquer.txt", true},
+		{"hash", strings.Repeat("0", 64), "a.txt", false},
+		{"outro", "a.txt", "a.txt", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kind+" "+tt.value+" "+tt.name, func(t *testing.T) {
+			sub := &subscription{Kind: tt.kind, Value: tt.value}
+			if got := sub.matches(testHash, tt.name); got != tt.want {
+				t.Errorf("matches = %v, esperado %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleSubscribe(t *testing.T) {
+	mu.Lock()
+	subscriptions = make(map[string][]*subscription)
+	mu.Unlock()
+	t.Cleanup(func() { subscriptions = make(map[string][]*subscription) })
+
+	tests := []struct {
+		name  string
+		kind  string
+		value string
+		ok    bool
+	}{
+		{"padrão", "pattern", "%2A.pdf", true},
+		{"nome", "name", "a.txt", true},
+		{"hash", "hash", testHash, true},
+		{"padrão malformado", "pattern", "%5Ba", false},
+		{"hash inválido", "hash", "abc", false},
+		{"valor vazio", "name", "", false},
+		{"tipo desconhecido", "regex", "a.*", false},
+	}
+	accepted := 0
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := newTestConn("10.0.0.2")
+			handleSubscribe(conn, anonymousIdentity("10.0.0.2"), tt.kind, tt.value)
+			if got := strings.HasPrefix(conn.out.String(), "OK "); got != tt.ok {
+				t.Errorf("resposta %q, esperado ok = %v", conn.out.String(), tt.ok)
+			}
+			if tt.ok {
+				accepted++
+			}
+		})
+	}
+	if got := len(subscriptions["10.0.0.2"]); got != accepted {
+		t.Errorf("%d assinaturas registradas, esperado %d", got, accepted)
+	}
+	if sub := subscriptions["10.0.0.2"][0]; sub.Value != "*.pdf" {
+		t.Errorf("padrão registrado %q, esperado decodificado", sub.Value)
+	}
+}
+
+// Cada assinatura é avisada uma vez por hash e só de arquivos visíveis ao assinante
+func TestNotifySubscribers(t *testing.T) {
+	waiting := newTestConn("10.0.0.2")
+	channel := &controlChannel{conn: waiting, addr: "10.0.0.2:50000"}
+	mu.Lock()
+	controlChannels = map[string]*controlChannel{channel.addr: channel}
+	subscriptions = map[string][]*subscription{"10.0.0.2": {
+		{ID: 1, Kind: "pattern", Value: "*.pdf", Identity: clientIdentity{User: "bob", Groups: []string{"lab"}}, Notified: make(map[string]bool)},
+	}}
+	mu.Unlock()
+	t.Cleanup(func() {
+		controlChannels = make(map[string]*controlChannel)
+		subscriptions = make(map[string][]*subscription)
+	})
+
+	other := strings.Repeat("ab", 32)
+	notifySubscribers(testHash, holderInfo{Name: "a.pdf", Owner: "alice", Visibility: visibilityPublic})
+	notifySubscribers(testHash, holderInfo{Name: "a.pdf", Owner: "carol", Visibility: visibilityPublic})
+	notifySubscribers(other, holderInfo{Name: "b.pdf", Owner: "alice", Visibility: visibilityPrivate})
+	notifySubscribers(other, holderInfo{Name: "b.txt", Owner: "alice", Visibility: visibilityPublic})
+	notifySubscribers(other, holderInfo{Name: "b.pdf", Owner: "alice", Visibility: visibilityGroup + "lab"})
+
+	want := "MATCH 1 " + testHash + " a.pdf\nMATCH 1 " + other + " b.pdf\n"
+	if got := waiting.out.String(); got != want {
+		t.Errorf("avisos %q, esperado %q", got, want)
+	}
+}
+
+func setAdminToken(t *testing.T, token string) {
+	t.Helper()
+	previous := adminToken
+	adminToken = token
+	t.Cleanup(func() { adminToken = previous })
+}
+
+// Endpoint que só registra se foi chamado
+func countingEndpoint(calls *int) adminEndpoint {
+	return func(r *http.Request) (interface{}, int, error) {
+		*calls++
+		return map[string]string{"ok": "sim"}, http.StatusOK, nil
+	}
+}
+
+// Com -admin-token as consultas exigem "Authorization: Bearer <token>"
+func TestAdminHandlerToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string
+		header string
+		method string
+		status int
+	}{
+		{"sem token configurado", "", "", http.MethodGet, http.StatusOK},
+		{"token correto", "segredo", "Bearer segredo", http.MethodGet, http.StatusOK},
+		{"sem cabeçalho", "segredo", "", http.MethodGet, http.StatusUnauthorized},
+		{"token errado", "segredo", "Bearer outro", http.MethodGet, http.StatusUnauthorized},
+		{"método errado", "segredo", "Bearer segredo", http.MethodPut, http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setAdminToken(t, tt.token)
+			calls := 0
+			request := httptest.NewRequest(tt.method, "/api/cluster", nil)
+			if tt.header != "" {
+				request.Header.Set("Authorization", tt.header)
+			}
+			recorder := httptest.NewRecorder()
+			adminHandler(http.MethodGet, countingEndpoint(&calls))(recorder, request)
+			if recorder.Code != tt.status {
+				t.Errorf("status %d, esperado %d (%s)", recorder.Code, tt.status, recorder.Body.String())
+			}
+			if called := calls > 0; called != (tt.status == http.StatusOK) {
+				t.Errorf("endpoint chamado = %v com status %d", called, recorder.Code)
+			}
+			if recorder.Code != http.StatusOK && !strings.Contains(recorder.Body.String(), `"error"`) {
+				t.Errorf("falha sem campo error: %s", recorder.Body.String())
+			}
+		})
+	}
+}
+
+// Rotas que alteram o estado (POST) só existem com -admin-token: sem ele, uma
+// página qualquer aberta no navegador poderia chamá-las
+func TestAdminHandlerPost(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string
+		header string
+		method string
+		status int
+	}{
+		{"sem token configurado", "", "", http.MethodPost, http.StatusForbidden},
+		{"sem cabeçalho", "segredo", "", http.MethodPost, http.StatusUnauthorized},
+		{"token errado", "segredo", "Bearer outro", http.MethodPost, http.StatusUnauthorized},
+		{"token correto", "segredo", "Bearer segredo", http.MethodPost, http.StatusOK},
+		{"GET numa rota POST", "segredo", "Bearer segredo", http.MethodGet, http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setAdminToken(t, tt.token)
+			calls := 0
+			request := httptest.NewRequest(tt.method, "/api/clients/kick?ip=10.0.0.2", nil)
+			if tt.header != "" {
+				request.Header.Set("Authorization", tt.header)
+			}
+			recorder := httptest.NewRecorder()
+			adminHandler(http.MethodPost, countingEndpoint(&calls))(recorder, request)
+			if recorder.Code != tt.status {
+				t.Errorf("status %d, esperado %d (%s)", recorder.Code, tt.status, recorder.Body.String())
+			}
+			if called := calls > 0; called != (tt.status == http.StatusOK) {
+				t.Errorf("endpoint chamado = %v com status %d", called, recorder.Code)
+			}
+		})
+	}
+}
+
+func TestAdminPostParameters(t *testing.T) {
+	resetTestState(t)
+	tests := []struct {
+		name     string
+		endpoint adminEndpoint
+		query    string
+		status   int
+	}{
+		{"kick sem IP", handleKickRequest, "", http.StatusBadRequest},
+		{"kick com bloqueio inválido", handleKickRequest, "ip=10.0.0.2&ban=sempre", http.StatusBadRequest},
+		{"drop com hash inválido", handleDropRequest, "hash=abc", http.StatusBadRequest},
+		{"drop com IP inválido", handleDropRequest, "hash=" + testHash + "&ip=x", http.StatusBadRequest},
+		{"drop de conteúdo ausente", handleDropRequest, "hash=" + strings.Repeat("0", 64), http.StatusNotFound},
+		{"drop de outro detentor", handleDropRequest, "hash=" + testHash + "&ip=10.0.0.9", http.StatusNotFound},
+		{"drop do detentor", handleDropRequest, "hash=" + testHash + "&ip=10.0.0.1", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, status, _ := tt.endpoint(httptest.NewRequest(http.MethodPost, "/?"+tt.query, nil))
+			if status != tt.status {
+				t.Errorf("status %d, esperado %d", status, tt.status)
+			}
+		})
+	}
+	if files[testHash] != nil {
+		t.Error("conteúdo continua no índice depois do drop do único detentor")
+	}
+}